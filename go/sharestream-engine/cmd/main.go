@@ -2,41 +2,124 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/pion/webrtc/v4"
+	"sharestream-engine/internal/auth"
 	"sharestream-engine/internal/engine"
+	"sharestream-engine/internal/events"
 	torrenthttp "sharestream-engine/internal/http"
+	"sharestream-engine/internal/ice"
 	"sharestream-engine/internal/ipc"
+	"sharestream-engine/internal/memstore"
+	"sharestream-engine/internal/ratelimit"
+	"sharestream-engine/internal/transcode"
 )
 
-type ProgressEvent struct {
-	Event      string  `json:"event"`
-	Downloaded float64 `json:"downloaded"`
-	Speed      int     `json:"speed"`
-	Peers      int     `json:"peers"`
-	Name       string  `json:"name,omitempty"`
-}
-
 func main() {
 	dataDir := flag.String("data-dir", "./data", "Directory for torrent data")
 	listenPort := flag.Int("port", 6881, "Torrent client listen port")
-	httpAddr := flag.String("http", ":0", "HTTP server address (use :0 for auto-assign)")
+	httpAddr := flag.String("http", "127.0.0.1:0", "HTTP server address (port 0 auto-assigns)")
+	lan := flag.Bool("lan", false, "Share with LAN clients using a separate token; listens on every interface unless -http is set")
+	lanToken := flag.String("lan-token", "", "Bearer token for LAN clients (random if empty)")
+	adminToken := flag.String("admin-token", "", "Bearer token that may use every HTTP route from any address, to control the engine remotely (off if empty)")
+	trackers := flag.String("trackers", strings.Join(engine.DefaultTrackers, ","), "Comma separated default tracker URLs (empty for none)")
+	ffmpeg := flag.String("ffmpeg", "ffmpeg", "ffmpeg binary used for HLS output")
+	uploadLimit := flag.Int64("upload-limit", 0, "Upload limit in KiB/s (0 for unlimited)")
+	downloadLimit := flag.Int64("download-limit", 0, "Download limit in KiB/s (0 for unlimited)")
+	altUploadLimit := flag.Int64("alt-upload-limit", 0, "Alternative upload limit in KiB/s (0 for unlimited)")
+	altDownloadLimit := flag.Int64("alt-download-limit", 0, "Alternative download limit in KiB/s (0 for unlimited)")
+	altSchedule := flag.String("alt-schedule", "", `When alternative limits apply, e.g. "mon-fri 09:00-17:00; sat,sun 00:00-08:00"`)
+	seedRatio := flag.Float64("seed-ratio", 0, "Stop seeding downloads after uploading this many times their size (0 for no limit)")
+	seedMinutes := flag.Float64("seed-minutes", 0, "Stop seeding downloads after this many minutes complete (0 for no limit)")
+	quota := flag.Float64("quota", 0, "Most GiB downloads may take in -data-dir; completed downloads are evicted to stay within it (0 for unlimited)")
+	storage := flag.String("storage", engine.StorageFile, `Where downloads keep their data: "file" in -data-dir or "memory" to stream without keeping a copy`)
+	memoryLimit := flag.Int64("memory-limit", memstore.DefaultCapacity>>20, "MiB of memory shared by memory-stored downloads")
+	metadataTimeout := flag.Duration("metadata-timeout", engine.DefaultMetadataTimeout, "How long to wait for a magnet's metadata before reporting metadata-timeout")
+	localDiscovery := flag.Bool("lsd", false, "Find peers on the local network by multicast (BEP 14 Local Service Discovery), announcing torrents that aren't private or in a room")
+	webTorrent := flag.Bool("webtorrent", false, "Connect to WebRTC peers found through WebSocket trackers")
+	iceURL := flag.String("ice-url", "", "Room member's /api/turn URL on the signal server (room.ice) to fetch STUN/TURN servers for WebRTC peers from, renewed before the TURN credentials expire")
 	flag.Parse()
 
+	if *lan && !flagSet("http") {
+		*httpAddr = ":0"
+	}
+
 	// IMPORTANT: slog goes to stderr so stdout stays clean for IPC JSON
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
-	eng, err := engine.New(*dataDir, *listenPort, logger)
+	keys, err := auth.New(*lan, *lanToken, *adminToken)
+	if err != nil {
+		logger.Error("failed to generate credentials", "error", err)
+		os.Exit(1)
+	}
+
+	schedule, err := ratelimit.ParseSchedule(*altSchedule)
+	if err != nil {
+		logger.Error("invalid -alt-schedule", "error", err)
+		os.Exit(1)
+	}
+
+	// Non-nil, so an empty -trackers disables the default trackers
+	defaultTrackers := append([]string{}, engine.ParseTrackers(*trackers)...)
+	var iceServers []webrtc.ICEServer
+	var iceTTL time.Duration
+	var iceErr error
+	if *webTorrent {
+		if !flagSet("trackers") {
+			defaultTrackers = append(defaultTrackers, engine.WebTorrentTrackers...)
+		}
+		if *iceURL != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			iceServers, iceTTL, iceErr = ice.Fetch(ctx, *iceURL)
+			cancel()
+			if iceErr != nil {
+				logger.Warn("failed to fetch ICE servers, using STUN only until they can be", "url", *iceURL, "error", iceErr)
+			}
+		}
+	}
+
+	// Every event goes through the bus: IPC writes it to stdout and
+	// /api/v1/events streams it to HTTP clients.
+	bus := events.NewBus()
+
+	eng, err := engine.New(engine.Config{
+		DataDir:    *dataDir,
+		ListenPort: *listenPort,
+		Trackers:   defaultTrackers,
+		Events:     bus,
+		Limits: ratelimit.Limits{
+			Upload:   *uploadLimit << 10,
+			Download: *downloadLimit << 10,
+		},
+		AltLimits: ratelimit.Limits{
+			Upload:   *altUploadLimit << 10,
+			Download: *altDownloadLimit << 10,
+		},
+		AltSchedule: schedule,
+		SeedPolicy: engine.SeedPolicy{
+			Ratio:   *seedRatio,
+			Minutes: *seedMinutes,
+		},
+		Quota:           int64(*quota * (1 << 30)),
+		Storage:         *storage,
+		MemoryCapacity:  *memoryLimit << 20,
+		MetadataTimeout: *metadataTimeout,
+		LocalDiscovery:  *localDiscovery,
+		WebTorrent:      *webTorrent,
+		ICEServers:      iceServers,
+	}, logger)
 	if err != nil {
 		logger.Error("failed to create engine", "error", err)
 		os.Exit(1)
@@ -45,6 +128,14 @@ func main() {
 
 	logger.Info("engine started", "port", eng.GetListenPort())
 
+	// Renew the TURN credentials before they expire, or keep trying to
+	// get them if the first fetch failed.
+	if *webTorrent && *iceURL != "" {
+		if wait := ice.Next(iceTTL, iceErr); wait > 0 {
+			go ice.Refresh(context.Background(), *iceURL, wait, eng.SetICEServers, logger)
+		}
+	}
+
 	// Bind HTTP listener to get the actual port (supports :0 auto-assign)
 	httpListener, err := net.Listen("tcp", *httpAddr)
 	if err != nil {
@@ -52,10 +143,23 @@ func main() {
 		os.Exit(1)
 	}
 	actualPort := httpListener.Addr().(*net.TCPAddr).Port
-	logger.Info("http listener bound", "port", actualPort)
+	logger.Info("http listener bound", "port", actualPort, "lan", keys.LAN())
 
 	httpServer := torrenthttp.NewWithListener(eng, httpListener, logger)
 
+	transcoder, err := transcode.New(transcode.Config{
+		FFmpeg:  *ffmpeg,
+		WorkDir: filepath.Join(*dataDir, "hls"),
+	}, logger)
+	if err != nil {
+		logger.Error("failed to create transcoder", "error", err)
+		os.Exit(1)
+	}
+	defer transcoder.Close()
+	httpServer.SetTranscoder(transcoder)
+	httpServer.SetEvents(bus)
+	httpServer.SetAuth(keys)
+
 	go func() {
 		logger.Info("http server starting", "address", httpListener.Addr().String())
 		if err := httpServer.StartWithListener(); err != nil && err != http.ErrServerClosed {
@@ -63,7 +167,8 @@ func main() {
 		}
 	}()
 
-	ipcServer := ipc.NewIPC(eng, actualPort, logger)
+	ipcServer := ipc.NewIPC(eng, bus, keys, actualPort, logger)
+	ipcServer.SetTranscoder(transcoder)
 
 	go func() {
 		if err := ipcServer.Run(); err != nil {
@@ -71,37 +176,6 @@ func main() {
 		}
 	}()
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
-		writer := os.Stdout
-		for {
-			select {
-			case <-ticker.C:
-				info := eng.GetInfo()
-				if info.Active {
-					progress := ProgressEvent{
-						Event:      "progress",
-						Downloaded: info.Progress,
-						Speed:      info.Speed,
-						Peers:      info.Peers,
-						Name:       info.Name,
-					}
-					b, _ := json.Marshal(progress)
-					writer.Write(append(b, '\n'))
-				}
-			}
-		}
-	}()
-
-	// Send ready event with the HTTP port
-	readyEvent := map[string]interface{}{
-		"event": "ready",
-		"port":  actualPort,
-	}
-	readyBytes, _ := json.Marshal(readyEvent)
-	os.Stdout.Write(append(readyBytes, '\n'))
-
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -117,3 +191,14 @@ func main() {
 
 	logger.Info("shutdown complete")
 }
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,192 @@
+// Package auth holds the engine HTTP server's per-session credentials.
+//
+// Each engine run generates a secret for loopback clients, from which come
+// a bearer token and HMAC signatures for expiring, torrent-scoped URLs.
+// LAN sharing, when enabled, gets a separate secret and token, so the
+// credentials handed to the parent process are never valid off the
+// machine. An admin token, when set, controls the engine from anywhere.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultTTL is how long a signed URL stays valid.
+const DefaultTTL = 24 * time.Hour
+
+// Scope says who a credential is for.
+type Scope int
+
+const (
+	// Local credentials are only accepted from loopback addresses.
+	Local Scope = iota
+	// LAN credentials are accepted from any address when LAN sharing is
+	// enabled.
+	LAN
+	// Admin credentials are accepted from any address when an admin token
+	// is set. They are only ever a bearer token, never a signature.
+	Admin
+)
+
+type credentials struct {
+	secret []byte
+	token  string
+}
+
+func newCredentials(token string) (*credentials, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	if token == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate token: %w", err)
+		}
+		token = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return &credentials{secret: secret, token: token}, nil
+}
+
+// Keys are the credentials of one engine session.
+type Keys struct {
+	local *credentials
+	lan   *credentials // nil unless LAN sharing is enabled
+	admin *credentials // nil unless an admin token is set
+}
+
+// New generates a session's credentials. With lan set LAN sharing is
+// enabled, using lanToken as its bearer token, or a random one if empty.
+// A non-empty adminToken enables admin access with that token.
+func New(lan bool, lanToken, adminToken string) (*Keys, error) {
+	local, err := newCredentials("")
+	if err != nil {
+		return nil, err
+	}
+	k := &Keys{local: local}
+	if lan {
+		if k.lan, err = newCredentials(lanToken); err != nil {
+			return nil, err
+		}
+	}
+	if adminToken != "" {
+		if lan && adminToken == k.lan.token {
+			return nil, fmt.Errorf("admin token must differ from the LAN token")
+		}
+		if k.admin, err = newCredentials(adminToken); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// LAN reports whether LAN sharing is enabled.
+func (k *Keys) LAN() bool {
+	return k.lan != nil
+}
+
+// Admin reports whether admin access is enabled.
+func (k *Keys) Admin() bool {
+	return k.admin != nil
+}
+
+// Token returns the bearer token for scope, or "" if scope's access is
+// disabled.
+func (k *Keys) Token(scope Scope) string {
+	c := k.creds(scope)
+	if c == nil {
+		return ""
+	}
+	return c.token
+}
+
+func (k *Keys) creds(scope Scope) *credentials {
+	switch scope {
+	case LAN:
+		return k.lan
+	case Admin:
+		return k.admin
+	}
+	return k.local
+}
+
+// Sign returns the exp and sig query parameters that authorize requests
+// for infoHash until now+ttl. They are valid on every route for that
+// torrent, so they can be appended to any of its stream, HLS or subtitle
+// URLs. Sign returns nil for Admin and for a disabled scope.
+func (k *Keys) Sign(scope Scope, infoHash string, ttl time.Duration) url.Values {
+	c := k.creds(scope)
+	if c == nil || scope == Admin {
+		return nil
+	}
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return url.Values{
+		"exp": {exp},
+		"sig": {signature(c.secret, infoHash, exp)},
+	}
+}
+
+func signature(secret []byte, infoHash, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(infoHash + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CheckToken reports whether token is the bearer token of scope or, for a
+// Local request, of LAN.
+func (k *Keys) CheckToken(scope Scope, token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range k.accepted(scope) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSignature reports whether query carries an unexpired signature for
+// infoHash, made by Sign for scope or, for a Local request, for LAN.
+func (k *Keys) CheckSignature(scope Scope, infoHash string, query url.Values) bool {
+	exp, sig := query.Get("exp"), query.Get("sig")
+	if infoHash == "" || exp == "" || sig == "" {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	for _, c := range k.accepted(scope) {
+		if hmac.Equal([]byte(sig), []byte(signature(c.secret, infoHash, exp))) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepted returns the credentials a request from scope may present.
+func (k *Keys) accepted(scope Scope) []*credentials {
+	if scope == Admin {
+		if k.admin == nil {
+			return nil
+		}
+		return []*credentials{k.admin}
+	}
+	var cs []*credentials
+	if scope == Local {
+		cs = append(cs, k.local)
+	}
+	if k.lan != nil {
+		cs = append(cs, k.lan)
+	}
+	return cs
+}
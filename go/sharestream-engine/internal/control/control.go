@@ -0,0 +1,171 @@
+// Package control implements the commands that change the engine's
+// session. The IPC protocol and the HTTP API both go through it, so a
+// torrent added or stopped either way is handled identically.
+package control
+
+import (
+	"fmt"
+	"io"
+
+	"sharestream-engine/internal/engine"
+)
+
+// Added describes a torrent that was seeded or added.
+type Added struct {
+	InfoHash  string `json:"infoHash"`
+	Name      string `json:"name,omitempty"`
+	MagnetURI string `json:"magnetURI,omitempty"`
+}
+
+type Controller struct {
+	engine *engine.TorrentEngine
+}
+
+func New(eng *engine.TorrentEngine) *Controller {
+	return &Controller{engine: eng}
+}
+
+// Seed hashes a local file and seeds it; see
+// engine.CreateTorrentFromFile. It returns context.Canceled if hashing is
+// cancelled.
+//
+// Seed, AddMagnet and AddTorrent give the torrent policy as its seeding
+// policy, if it isn't nil. AddMagnet and AddTorrent store the download in
+// storage; see engine.AddMagnet.
+func (c *Controller) Seed(filePath string, trackers []string, policy *engine.SeedPolicy, onProgress func(engine.HashProgress)) (Added, error) {
+	if filePath == "" {
+		return Added{}, fmt.Errorf("seed requires filePath")
+	}
+	if err := validatePolicy(policy); err != nil {
+		return Added{}, err
+	}
+	infoHash, mi, err := c.engine.CreateTorrentFromFile(filePath, trackers, onProgress)
+	if err != nil {
+		return Added{}, err
+	}
+	if err := c.setPolicy(infoHash, policy); err != nil {
+		return Added{}, err
+	}
+
+	added := c.added(infoHash)
+	if mi != nil {
+		added.MagnetURI = mi.Magnet(nil, nil).String()
+	}
+	return added, nil
+}
+
+// AddMagnet adds a magnet link.
+func (c *Controller) AddMagnet(magnetURI string, trackers []string, policy *engine.SeedPolicy, storage string) (Added, error) {
+	if err := validatePolicy(policy); err != nil {
+		return Added{}, err
+	}
+	infoHash, err := c.engine.AddMagnet(magnetURI, trackers, storage)
+	if err != nil {
+		return Added{}, err
+	}
+	if err := c.setPolicy(infoHash, policy); err != nil {
+		return Added{}, err
+	}
+	return c.added(infoHash), nil
+}
+
+// AddTorrent adds a torrent from bencoded metainfo.
+func (c *Controller) AddTorrent(r io.Reader, trackers []string, policy *engine.SeedPolicy, storage string) (Added, error) {
+	if err := validatePolicy(policy); err != nil {
+		return Added{}, err
+	}
+	infoHash, err := c.engine.AddTorrent(r, trackers, storage)
+	if err != nil {
+		return Added{}, err
+	}
+	if err := c.setPolicy(infoHash, policy); err != nil {
+		return Added{}, err
+	}
+	added := c.added(infoHash)
+	added.MagnetURI, _ = c.engine.CreateMagnetLink(infoHash)
+	return added, nil
+}
+
+func validatePolicy(policy *engine.SeedPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	return policy.Validate()
+}
+
+func (c *Controller) setPolicy(infoHash string, policy *engine.SeedPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	return c.engine.SetSeedPolicy(infoHash, *policy)
+}
+
+func (c *Controller) added(infoHash string) Added {
+	return Added{
+		InfoHash: infoHash,
+		Name:     c.engine.GetTorrentName(infoHash),
+	}
+}
+
+// Stop drops a torrent from the session. An empty infoHash drops every
+// torrent.
+func (c *Controller) Stop(infoHash string) error {
+	if infoHash == "" {
+		c.engine.DropAllTorrents()
+		return nil
+	}
+	return c.engine.DropTorrent(infoHash)
+}
+
+// Pause stops a torrent transferring data without dropping it.
+func (c *Controller) Pause(infoHash string) error {
+	if infoHash == "" {
+		return fmt.Errorf("pause requires infoHash")
+	}
+	return c.engine.PauseTorrent(infoHash)
+}
+
+// SetSeedPolicy replaces a torrent's seeding policy.
+func (c *Controller) SetSeedPolicy(infoHash string, policy engine.SeedPolicy) error {
+	if infoHash == "" {
+		return fmt.Errorf("policy requires infoHash")
+	}
+	return c.engine.SetSeedPolicy(infoHash, policy)
+}
+
+// RoomEnded removes the torrents whose seeding policy ends with room.
+func (c *Controller) RoomEnded(room string) ([]string, error) {
+	if room == "" {
+		return nil, fmt.Errorf("room-ended requires room")
+	}
+	return c.engine.RoomEnded(room), nil
+}
+
+// SetRoomPeers records the addresses of a room's members.
+func (c *Controller) SetRoomPeers(room string, addrs []string) error {
+	if room == "" {
+		return fmt.Errorf("room-peers requires room")
+	}
+	c.engine.SetRoomPeers(room, addrs)
+	return nil
+}
+
+// AddPeers connects a torrent to peers given as ip:port and returns how
+// many were new to it.
+func (c *Controller) AddPeers(infoHash string, addrs []string) (int, error) {
+	if infoHash == "" {
+		return 0, fmt.Errorf("add-peers requires infoHash")
+	}
+	if len(addrs) == 0 {
+		return 0, fmt.Errorf("add-peers requires peers")
+	}
+	return c.engine.AddPeers(infoHash, addrs)
+}
+
+// Resume restarts a paused torrent.
+func (c *Controller) Resume(infoHash string) error {
+	if infoHash == "" {
+		return fmt.Errorf("resume requires infoHash")
+	}
+	return c.engine.ResumeTorrent(infoHash)
+}
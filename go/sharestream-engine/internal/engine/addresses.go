@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"sharestream-engine/internal/events"
+)
+
+// selfAddressInterval is how often the host's addresses are checked for
+// changes, such as joining another network.
+const selfAddressInterval = 30 * time.Second
+
+// SelfAddresses returns the ip:port endpoints other engines may reach this
+// one on: the listen port, which takes both TCP and uTP, on each of the
+// host's interface addresses, IPv4 first. Loopback and link-local
+// addresses are left out. Behind NAT these are private addresses, reachable
+// only on the same network; the public address is the one the signal
+// server sees.
+func (e *TorrentEngine) SelfAddresses() []string {
+	port := e.client.LocalPort()
+	if port == 0 {
+		return nil
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		e.logger.Warn("failed to list interface addresses", "error", err)
+		return nil
+	}
+	var ips []netip.Addr
+	for _, a := range ifaddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	slices.SortFunc(ips, func(a, b netip.Addr) int {
+		if a.Is4() != b.Is4() {
+			if a.Is4() {
+				return -1
+			}
+			return 1
+		}
+		return a.Compare(b)
+	})
+	ips = slices.Compact(ips)
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+	return addrs
+}
+
+// checkSelfAddresses publishes a "self-addresses" event if the host's
+// addresses have changed since the last check.
+func (e *TorrentEngine) checkSelfAddresses() {
+	addrs := e.SelfAddresses()
+	if slices.Equal(addrs, e.selfAddrs) {
+		return
+	}
+	e.selfAddrs = addrs
+	e.events.Publish(events.Event{Event: "self-addresses", Addresses: addrs})
+}
@@ -1,64 +1,415 @@
 package engine
 
 import (
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
+	"sharestream-engine/internal/events"
+	"sharestream-engine/internal/lsd"
+	"sharestream-engine/internal/media"
+	"sharestream-engine/internal/memstore"
+	"sharestream-engine/internal/ratelimit"
+)
+
+// Errors returned for an unknown info hash or a path that isn't in the
+// torrent.
+var (
+	ErrTorrentNotFound = errors.New("torrent not found")
+	ErrFileNotFound    = errors.New("file not found in torrent")
 )
 
 type TorrentEngine struct {
 	client   *torrent.Client
 	dataDir  string
-	torrents map[string]*torrent.Torrent
+	trackers []string
+	torrents map[string]*managedTorrent
+	maxConns int
 	mu       sync.RWMutex
 	logger   *slog.Logger
+
+	// pieceCompletion is shared by the data dir storage and every seed
+	// storage, so there is a single .torrent.db for the whole engine.
+	pieceCompletion storage.PieceCompletion
+
+	saveMu sync.Mutex
+	// saveReq and saverDone belong to the saver goroutine.
+	saveReq   chan struct{}
+	saverDone chan struct{}
+	restored  []string
+
+	// hashing holds the cancel funcs of seeds being hashed, by path.
+	hashing map[string]context.CancelFunc
+	// hashCacheMu serialises reading, writing and pruning the hash cache.
+	hashCacheMu sync.Mutex
+
+	events    *events.Bus
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Bandwidth limits; see limits.go. upLimiter and downLimiter are the
+	// client's, set to the global or alternative limits in force.
+	upLimiter   *rate.Limiter
+	downLimiter *rate.Limiter
+	limits      ratelimit.Limits
+	altLimits   ratelimit.Limits
+	altMode     string
+	altSchedule ratelimit.Schedule
+	altOn       bool
+	applied     ratelimit.Limits
+
+	seedPolicy SeedPolicy
+
+	// quota bounds the data directory's downloads in bytes; see
+	// enforceQuota. dropped holds the downloads dropped from the session
+	// whose data is still in the data directory, by info hash.
+	quota   int64
+	dropped map[string]droppedData
+
+	// memory holds the pieces of ephemeral torrents; storage is the
+	// default for downloads, StorageFile or StorageMemory.
+	memory  *memstore.Client
+	storage string
+
+	metadataTimeout time.Duration
+
+	// wire follows each peer's choke and interest messages; roomPeers holds
+	// the IPs of each room's members, from SetRoomPeers.
+	wire      *peerWire
+	roomPeers map[string]map[string]bool
+
+	// selfAddrs are the addresses last reported by checkSelfAddresses.
+	// Only monitor uses them.
+	selfAddrs []string
+
+	// lsd announces torrents on the local network; nil if local discovery
+	// is off or unavailable.
+	lsd *lsd.Service
+
+	// iceServers is the list the client's WebRTC connections are made
+	// with, maxICEServers long, nil if WebTorrent is off; see
+	// SetICEServers.
+	iceServers []webrtc.ICEServer
+}
+
+// managedTorrent is the engine's bookkeeping for a single torrent in the
+// session. Every field other than t is guarded by TorrentEngine.mu.
+type managedTorrent struct {
+	t      *torrent.Torrent
+	prio   *prioritizer
+	paused bool
+
+	// Persisted with the session so the torrent can be restored on restart.
+	magnet      string
+	trackers    []string
+	seedPath    string
+	seedSize    int64
+	seedModTime time.Time
+	files       []string
+
+	// Verification pass state; see VerifyTorrent.
+	verifying bool
+	verified  int
+
+	// Speed is derived from the change in payload bytes read between samples.
+	lastBytes  int64
+	lastSample time.Time
+	speed      int
+
+	// Probe results by file path; see ProbeFile.
+	probes map[string]*media.Info
+
+	// Seeding policy; see SeedPolicy. seedingSince is when the torrent was
+	// first seen complete, moved on by the time it has spent paused since,
+	// and uploaded is what it uploaded in earlier runs. pausedAt is when a
+	// paused torrent was paused. All are persisted with the session.
+	policy       SeedPolicy
+	seedingSince time.Time
+	pausedAt     time.Time
+	uploaded     int64
+
+	// lastAccess is when the torrent was added or, as of the last session
+	// save, last streamed; see lastAccessLocked.
+	lastAccess time.Time
+
+	// ephemeral torrents are stored in memory and left out of the session.
+	ephemeral bool
+
+	// Per-torrent limits; see throttle.
+	limits        ratelimit.Limits
+	upMeter       ratelimit.Meter
+	downMeter     ratelimit.Meter
+	throttledUp   bool
+	throttledDown bool
+
+	// Monitor state; see monitor. announce asks for the torrent to be
+	// announced on the local network at the next tick; see announceLocal.
+	sampled       bool
+	complete      bool
+	stalledSince  time.Time
+	stallReported bool
+	newPieces     []int
+	announce      bool
+}
+
+// Config configures a TorrentEngine.
+type Config struct {
+	DataDir    string
+	ListenPort int
+
+	// Trackers are announced to for every torrent, after any trackers given
+	// when the torrent is added. Nil means DefaultTrackers, and with
+	// WebTorrent WebTorrentTrackers too; an empty, non-nil slice disables
+	// default trackers.
+	Trackers []string
+
+	// Events receives the engine's progress, peer, piece and stall events.
+	// It may be nil.
+	Events *events.Bus
+
+	// Limits are the global bandwidth limits. AltLimits replace them while
+	// alternative limits are on, which by default is during AltSchedule.
+	Limits      ratelimit.Limits
+	AltLimits   ratelimit.Limits
+	AltSchedule ratelimit.Schedule
+
+	// SeedPolicy applies to torrents downloaded with AddMagnet and
+	// AddTorrent until SetSeedPolicy replaces it. Local files being seeded
+	// have no policy by default.
+	SeedPolicy SeedPolicy
+
+	// Quota is the most space downloads may take in DataDir, in bytes.
+	// Completed downloads nobody is watching are evicted, least recently
+	// watched first, to stay within it. Zero means unlimited.
+	Quota int64
+
+	// Storage is where downloads keep their data unless they are added
+	// with another: StorageFile (the default) or StorageMemory.
+	// MemoryCapacity bounds the memory shared by StorageMemory torrents,
+	// memstore.DefaultCapacity if zero.
+	Storage        string
+	MemoryCapacity int64
+
+	// MetadataTimeout bounds every wait for a torrent's metadata, and is
+	// how long after a torrent is added a "metadata-timeout" event is
+	// sent if it still has none. Zero means DefaultMetadataTimeout.
+	MetadataTimeout time.Duration
+
+	// LocalDiscovery finds peers on the local network with BEP 14 Local
+	// Service Discovery: torrents that aren't paused, private or in a room
+	// are announced by multicast, and hosts announcing the same ones are
+	// connected to.
+	LocalDiscovery bool
+
+	// WebTorrent connects to WebRTC peers, such as browser WebTorrent
+	// clients, found through WebSocket trackers. ICEServers are the STUN
+	// and TURN servers those connections use, DefaultICEServers if nil,
+	// at most maxICEServers; renew expiring TURN credentials with
+	// SetICEServers.
+	WebTorrent bool
+	ICEServers []webrtc.ICEServer
 }
 
-func New(dataDir string, port int, logger *slog.Logger) (*TorrentEngine, error) {
+// Storage backends for downloads. StorageFile keeps a torrent's files in
+// DataDir. StorageMemory keeps only the pieces around each playhead and
+// those peers ask for most in a bounded pool of memory, leaving nothing on
+// disk; see memstore.
+const (
+	StorageFile   = "file"
+	StorageMemory = "memory"
+)
+
+func New(config Config, logger *slog.Logger) (*TorrentEngine, error) {
+	dataDir := config.DataDir
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data dir: %w", err)
 	}
 
+	pieceCompletion, err := storage.NewDefaultPieceCompletionForDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open piece completion: %w", err)
+	}
+
 	cfg := torrent.NewDefaultClientConfig()
 	cfg.DataDir = dataDir
-	cfg.ListenPort = port
+	cfg.DefaultStorage = storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   dataDir,
+		PieceCompletion: pieceCompletion,
+	})
+	cfg.ListenPort = config.ListenPort
 	cfg.NoDHT = false
 	cfg.Seed = true
+	cfg.DisableWebtorrent = !config.WebTorrent
+	var iceServers []webrtc.ICEServer
+	if config.WebTorrent {
+		servers := config.ICEServers
+		if servers == nil {
+			servers = DefaultICEServers
+		}
+		if len(servers) > maxICEServers {
+			pieceCompletion.Close()
+			return nil, fmt.Errorf("%d ICE servers, at most %d are supported", len(servers), maxICEServers)
+		}
+		iceServers = make([]webrtc.ICEServer, maxICEServers)
+		copy(iceServers, servers)
+		cfg.ICEServerList = iceServers
+	}
+	cfg.Callbacks.CompletedHandshake = peerConnected(config.Events)
+	wire := newPeerWire()
+	cfg.Callbacks.ReadMessage = wire.read
+	cfg.Callbacks.PeerConnClosed = wire.closed
+	if err := config.SeedPolicy.Validate(); err != nil {
+		pieceCompletion.Close()
+		return nil, err
+	}
+	defaultStorage := config.Storage
+	if defaultStorage == "" {
+		defaultStorage = StorageFile
+	}
+	if defaultStorage != StorageFile && defaultStorage != StorageMemory {
+		pieceCompletion.Close()
+		return nil, fmt.Errorf("invalid storage %q", config.Storage)
+	}
+	if err := validateLimits(config.Limits); err != nil {
+		pieceCompletion.Close()
+		return nil, err
+	}
+	if err := validateLimits(config.AltLimits); err != nil {
+		pieceCompletion.Close()
+		return nil, err
+	}
+	upLimiter, downLimiter := ratelimit.NewLimiter(0), ratelimit.NewLimiter(0)
+	cfg.UploadRateLimiter = upLimiter
+	cfg.DownloadRateLimiter = downLimiter
 
 	client, err := torrent.NewClient(cfg)
 	if err != nil {
+		pieceCompletion.Close()
 		return nil, fmt.Errorf("failed to create torrent client: %w", err)
 	}
 
+	trackers := config.Trackers
+	if trackers == nil {
+		trackers = DefaultTrackers
+		if config.WebTorrent {
+			trackers = append(slices.Clone(trackers), WebTorrentTrackers...)
+		}
+	}
+	for _, tr := range trackers {
+		if err := validateTracker(tr); err != nil {
+			client.Close()
+			pieceCompletion.Close()
+			return nil, err
+		}
+	}
+
 	engine := &TorrentEngine{
-		client:   client,
-		dataDir:  dataDir,
-		torrents: make(map[string]*torrent.Torrent),
-		logger:   logger,
+		client:          client,
+		trackers:        trackers,
+		dataDir:         dataDir,
+		torrents:        make(map[string]*managedTorrent),
+		hashing:         make(map[string]context.CancelFunc),
+		dropped:         make(map[string]droppedData),
+		maxConns:        cfg.EstablishedConnsPerTorrent,
+		logger:          logger,
+		pieceCompletion: pieceCompletion,
+		events:          config.Events,
+		closed:          make(chan struct{}),
+		saveReq:         make(chan struct{}, 1),
+		saverDone:       make(chan struct{}),
+		upLimiter:       upLimiter,
+		downLimiter:     downLimiter,
+		limits:          config.Limits,
+		altLimits:       config.AltLimits,
+		altMode:         ratelimit.AltSchedule,
+		altSchedule:     config.AltSchedule,
+		seedPolicy:      config.SeedPolicy,
+		quota:           config.Quota,
+		memory:          memstore.New(config.MemoryCapacity),
+		storage:         defaultStorage,
+		metadataTimeout: config.MetadataTimeout,
+		wire:            wire,
+		roomPeers:       make(map[string]map[string]bool),
+		iceServers:      iceServers,
+	}
+	if engine.metadataTimeout <= 0 {
+		engine.metadataTimeout = DefaultMetadataTimeout
 	}
+	engine.applyLimitsLocked(time.Now())
+	engine.selfAddrs = engine.SelfAddresses()
+	if config.LocalDiscovery {
+		engine.lsd, err = lsd.New(lsd.Config{
+			Port:     client.LocalPort(),
+			Torrents: engine.lsdTorrents,
+			Peer:     engine.lsdPeer,
+		}, logger)
+		if err != nil {
+			logger.Warn("local peer discovery unavailable", "error", err)
+		}
+	}
+
+	go engine.saver()
+	engine.restoreSession()
+	go engine.monitor()
 
 	return engine, nil
 }
 
-func (e *TorrentEngine) CreateTorrentFromFile(filePath string) (string, *metainfo.MetaInfo, error) {
-	info := metainfo.Info{
-		PieceLength: 256 * 1024,
+// CreateTorrentFromFile hashes filePath and seeds it from where it is on
+// disk; see seedStorage. trackers are announced to ahead of the engine's
+// defaults. Hashing progress is passed to onProgress, which may be nil, and
+// hashing can be aborted with CancelHashing.
+func (e *TorrentEngine) CreateTorrentFromFile(filePath string, trackers []string, onProgress func(HashProgress)) (string, *metainfo.MetaInfo, error) {
+	announce, err := e.mergeTrackers(trackers)
+	if err != nil {
+		return "", nil, err
+	}
+	filePath, err = filepath.Abs(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve file path: %w", err)
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	if err := info.BuildFromFilePath(filePath); err != nil {
-		return "", nil, fmt.Errorf("failed to build info from file: %w", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.mu.Lock()
+	if _, busy := e.hashing[filePath]; busy {
+		e.mu.Unlock()
+		return "", nil, fmt.Errorf("already hashing %s", filePath)
 	}
+	e.hashing[filePath] = cancel
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.hashing, filePath)
+		e.mu.Unlock()
+	}()
 
-	info.Name = filepath.Base(filePath)
+	info, err := e.buildSeedInfo(ctx, filePath, onProgress)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("failed to build info from file: %w", err)
+	}
 
 	infoBytes, err := bencode.Marshal(info)
 	if err != nil {
@@ -66,33 +417,52 @@ func (e *TorrentEngine) CreateTorrentFromFile(filePath string) (string, *metainf
 	}
 
 	mi := &metainfo.MetaInfo{
-		InfoBytes: infoBytes,
-	}
-
-	mi.AnnounceList = [][]string{
-		{"udp://tracker.opentrackr.org:1337/announce"},
-		{"udp://tracker.openbittorrent.com:6969/announce"},
+		InfoBytes:    infoBytes,
+		AnnounceList: announceList(announce),
 	}
 
-	t, err := e.client.AddTorrent(mi)
+	// No piece is recorded as complete up front: the client checks each
+	// one against the file before seeding it, so a file that changed after
+	// hashing is never served as if it hadn't.
+	t, err := e.addSeed(mi, filePath)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to add torrent: %w", err)
 	}
 
-	infoHash := t.InfoHash().HexString()
-	e.mu.Lock()
-	e.torrents[infoHash] = t
-	e.mu.Unlock()
-
-	go func() {
-		<-t.GotInfo()
-		t.DownloadAll()
-	}()
+	infoHash := e.track(&managedTorrent{
+		t:           t,
+		trackers:    trackers,
+		seedPath:    filePath,
+		seedSize:    fi.Size(),
+		seedModTime: fi.ModTime(),
+	})
+	e.saveSession()
 
 	return infoHash, mi, nil
 }
 
-func (e *TorrentEngine) AddMagnet(magnetURI string) (string, error) {
+// CancelHashing aborts an in-progress CreateTorrentFromFile for filePath,
+// which then returns context.Canceled.
+func (e *TorrentEngine) CancelHashing(filePath string) error {
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cancel, ok := e.hashing[filePath]
+	if !ok {
+		return fmt.Errorf("not hashing %s", filePath)
+	}
+	cancel()
+	return nil
+}
+
+// AddMagnet adds a magnet link. trackers are announced to alongside any in
+// the link and the engine's defaults. storage is StorageFile or
+// StorageMemory, or "" for the engine's default.
+func (e *TorrentEngine) AddMagnet(magnetURI string, trackers []string, storage string) (string, error) {
 	// Validate magnet URI format
 	if !strings.HasPrefix(magnetURI, "magnet:?") {
 		return "", fmt.Errorf("invalid magnet URI: must start with 'magnet:?'")
@@ -101,125 +471,266 @@ func (e *TorrentEngine) AddMagnet(magnetURI string) (string, error) {
 		return "", fmt.Errorf("invalid magnet URI: missing info hash (xt=urn:btih:)")
 	}
 
-	t, err := e.client.AddMagnet(magnetURI)
+	announce, err := e.mergeTrackers(trackers)
 	if err != nil {
-		return "", fmt.Errorf("failed to add magnet: %w", err)
+		return "", err
+	}
+	ephemeral, err := e.ephemeral(storage)
+	if err != nil {
+		return "", err
 	}
 
-	infoHash := t.InfoHash().HexString()
-	e.mu.Lock()
-	e.torrents[infoHash] = t
-	e.mu.Unlock()
+	spec, err := torrent.TorrentSpecFromMagnetUri(magnetURI)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse magnet: %w", err)
+	}
+	spec.Trackers = append(spec.Trackers, announceList(announce)...)
+	if ephemeral {
+		spec.Storage = e.memory
+	}
 
-	go func() {
-		<-t.GotInfo()
-		t.DownloadAll()
-	}()
+	t, err := e.addSpec(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to add magnet: %w", err)
+	}
+
+	infoHash := e.track(&managedTorrent{
+		t:         t,
+		magnet:    magnetURI,
+		trackers:  trackers,
+		policy:    e.seedPolicy,
+		ephemeral: ephemeral,
+	})
+	e.saveSession()
 
 	return infoHash, nil
 }
 
-func (e *TorrentEngine) AddTorrentFile(torrentPath string) (string, error) {
-	mi, err := metainfo.LoadFromFile(torrentPath)
+// AddTorrentFile adds a .torrent file. trackers are announced to alongside
+// the file's own and the engine's defaults.
+func (e *TorrentEngine) AddTorrentFile(torrentPath string, trackers []string) (string, error) {
+	f, err := os.Open(torrentPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to load torrent file: %w", err)
 	}
+	defer f.Close()
+	return e.AddTorrent(f, trackers, "")
+}
 
-	t, err := e.client.AddTorrent(mi)
+// AddTorrent adds a torrent from bencoded metainfo, as uploaded over HTTP.
+// trackers are announced to alongside the metainfo's own and the engine's
+// defaults, and storage is as for AddMagnet.
+func (e *TorrentEngine) AddTorrent(r io.Reader, trackers []string, storage string) (string, error) {
+	announce, err := e.mergeTrackers(trackers)
 	if err != nil {
-		return "", fmt.Errorf("failed to add torrent: %w", err)
+		return "", err
+	}
+	ephemeral, err := e.ephemeral(storage)
+	if err != nil {
+		return "", err
 	}
 
-	infoHash := t.InfoHash().HexString()
-	e.mu.Lock()
-	e.torrents[infoHash] = t
-	e.mu.Unlock()
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to load torrent file: %w", err)
+	}
 
-	go func() {
-		<-t.GotInfo()
-		t.DownloadAll()
-	}()
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return "", fmt.Errorf("failed to load torrent file: %w", err)
+	}
+	spec.Trackers = append(spec.Trackers, announceList(announce)...)
+	if ephemeral {
+		spec.Storage = e.memory
+	}
+
+	t, err := e.addSpec(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to add torrent: %w", err)
+	}
+
+	infoHash := e.track(&managedTorrent{
+		t:         t,
+		trackers:  trackers,
+		policy:    e.seedPolicy,
+		ephemeral: ephemeral,
+	})
+	e.saveSession()
 
 	return infoHash, nil
 }
 
-func (e *TorrentEngine) GetTorrent(infoHash string) *torrent.Torrent {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-	return e.torrents[infoHash]
+// ephemeral reports whether a download added with storage is kept in
+// memory.
+func (e *TorrentEngine) ephemeral(storage string) (bool, error) {
+	switch storage {
+	case "":
+		return e.storage == StorageMemory, nil
+	case StorageFile:
+		return false, nil
+	case StorageMemory:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid storage %q", storage)
 }
 
-func (e *TorrentEngine) ListTorrents() []string {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
+// addSpec adds spec to the client. If the torrent is already present, the
+// spec's trackers are added to it instead.
+func (e *TorrentEngine) addSpec(spec *torrent.TorrentSpec) (*torrent.Torrent, error) {
+	t, isNew, err := e.client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !isNew {
+		t.AddTrackers(spec.Trackers)
+	}
+	return t, nil
+}
 
-	hashes := make([]string, 0, len(e.torrents))
-	for hash := range e.torrents {
-		hashes = append(hashes, hash)
+// track registers mt with the session and starts downloading once metadata
+// is available. An existing entry for the same info hash is kept (the client
+// dedupes torrents by info hash as well).
+func (e *TorrentEngine) track(mt *managedTorrent) string {
+	infoHash := mt.t.InfoHash().HexString()
+	e.mu.Lock()
+	if _, ok := e.torrents[infoHash]; ok {
+		e.mu.Unlock()
+		return infoHash
 	}
-	return hashes
+	mt.prio = newPrioritizer(mt.t)
+	if mt.ephemeral {
+		ih := mt.t.InfoHash()
+		mt.prio.pin = func(pieces []int) { e.memory.Pin(ih, pieces) }
+	}
+	if mt.lastAccess.IsZero() {
+		mt.lastAccess = time.Now()
+	}
+	mt.announce = true
+	e.torrents[infoHash] = mt
+	if _, ok := e.dropped[infoHash]; ok {
+		// Its data is the torrent's again.
+		delete(e.dropped, infoHash)
+		e.requestSave()
+	}
+	e.mu.Unlock()
+
+	go e.activate(infoHash, mt)
+	return infoHash
 }
 
-func (e *TorrentEngine) GetTorrentInfo(infoHash string) (map[string]interface{}, error) {
-	t := e.GetTorrent(infoHash)
-	if t == nil {
-		return nil, fmt.Errorf("torrent not found")
+// activate waits for metadata (see awaitMetadata), persists it so a restart
+// doesn't need peers to fetch it again, and applies the torrent's file
+// selection.
+func (e *TorrentEngine) activate(infoHash string, mt *managedTorrent) {
+	if !e.awaitMetadata(infoHash, mt) {
+		return
 	}
 
-	<-t.GotInfo()
+	if !mt.ephemeral {
+		if err := e.saveMetainfo(infoHash, mt.t); err != nil {
+			e.logger.Warn("failed to persist metainfo", "infoHash", infoHash, "error", err)
+		}
+	}
+	e.applySelection(mt)
+	e.saveSession()
+	e.watchPieces(mt)
+}
 
-	info := t.Info()
-	if info == nil {
-		return nil, fmt.Errorf("torrent info not available")
+// applySelection downloads the selected files, or everything when no
+// selection has been made. Ephemeral torrents only fetch what is streamed,
+// so selection doesn't apply to them.
+func (e *TorrentEngine) applySelection(mt *managedTorrent) {
+	if mt.ephemeral {
+		return
+	}
+	e.mu.RLock()
+	selected := make(map[string]bool, len(mt.files))
+	for _, path := range mt.files {
+		selected[path] = true
 	}
+	e.mu.RUnlock()
 
-	files := t.Files()
-	fileList := make([]map[string]interface{}, len(files))
-	for i, f := range files {
-		fileList[i] = map[string]interface{}{
-			"path":      f.Path(),
-			"length":    f.Length(),
-			"completed": f.BytesCompleted(),
+	if len(selected) == 0 {
+		mt.t.DownloadAll()
+		return
+	}
+	for _, f := range mt.t.Files() {
+		if selected[f.Path()] {
+			f.Download()
+		} else {
+			f.SetPriority(torrent.PiecePriorityNone)
 		}
 	}
+}
 
-	return map[string]interface{}{
-		"name":         t.Name(),
-		"infoHash":     infoHash,
-		"totalBytes":   t.Length(),
-		"bytesDone":    t.BytesCompleted(),
-		"bytesMissing": t.BytesMissing(),
-		"files":        fileList,
-		"numPieces":    t.NumPieces(),
-		"complete":     t.Complete().Bool(),
-		"seeding":      t.Seeding(),
-	}, nil
+// SelectFiles restricts downloading to the given file paths. An empty list
+// selects every file.
+func (e *TorrentEngine) SelectFiles(infoHash string, paths []string) error {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	if mt.t.Info() != nil {
+		known := make(map[string]bool)
+		for _, f := range mt.t.Files() {
+			known[f.Path()] = true
+		}
+		for _, path := range paths {
+			if !known[path] {
+				e.mu.Unlock()
+				return fmt.Errorf("file not found in torrent: %s", path)
+			}
+		}
+	}
+	mt.files = append([]string(nil), paths...)
+	e.mu.Unlock()
+
+	if mt.t.Info() != nil {
+		e.applySelection(mt)
+	}
+	e.saveSession()
+	return nil
 }
 
-func (e *TorrentEngine) GetTorrentStats(infoHash string) (map[string]interface{}, error) {
-	t := e.GetTorrent(infoHash)
-	if t == nil {
-		return nil, fmt.Errorf("torrent not found")
+func (e *TorrentEngine) GetTorrent(infoHash string) *torrent.Torrent {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return nil
 	}
+	return mt.t
+}
 
-	stats := t.Stats()
+func (e *TorrentEngine) ListTorrents() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
-	return map[string]interface{}{
-		"activePeers":  stats.ActivePeers,
-		"totalPeers":   stats.TotalPeers,
-		"pendingPeers": stats.PendingPeers,
-		"bytesRead":    stats.BytesRead.Int64(),
-		"bytesWritten": stats.BytesWritten.Int64(),
-	}, nil
+	hashes := make([]string, 0, len(e.torrents))
+	for hash := range e.torrents {
+		hashes = append(hashes, hash)
+	}
+	return hashes
 }
 
-func (e *TorrentEngine) ReadFile(infoHash string, filePath string, offset, length int64) (io.ReadCloser, error) {
-	t := e.GetTorrent(infoHash)
-	if t == nil {
-		return nil, fmt.Errorf("torrent not found")
+// ReadFile opens a reader over a file in a torrent, waiting for its
+// metadata as WaitMetadata does. Reads stop when ctx is done. The reader's
+// position is tracked by the torrent's prioritizer, so pieces ahead of it
+// are fetched first; the returned reader also implements io.Seeker.
+func (e *TorrentEngine) ReadFile(ctx context.Context, infoHash string, filePath string, offset, length int64) (io.ReadCloser, error) {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, ErrTorrentNotFound
 	}
+	t := mt.t
 
-	<-t.GotInfo()
+	if err := e.waitInfo(ctx, mt); err != nil {
+		return nil, err
+	}
 
 	files := t.Files()
 	var file *torrent.File
@@ -231,24 +742,50 @@ func (e *TorrentEngine) ReadFile(infoHash string, filePath string, offset, lengt
 	}
 
 	if file == nil {
-		return nil, fmt.Errorf("file not found in torrent")
+		return nil, ErrFileNotFound
 	}
 
 	reader := file.NewReader()
+	reader.SetContext(ctx)
+	stream := mt.prio.open(file, reader)
 	if offset > 0 {
-		_, err := reader.Seek(offset, io.SeekStart)
+		_, err := stream.Seek(offset, io.SeekStart)
 		if err != nil {
-			reader.Close()
+			stream.Close()
 			return nil, fmt.Errorf("failed to seek: %w", err)
 		}
 	}
 
-	return &readerWrapper{Reader: reader, Closer: reader, limit: length, read: 0}, nil
+	return &readerWrapper{ReadSeekCloser: stream, limit: length, read: 0}, nil
+}
+
+// ModTime returns when a seeded torrent's files were last modified, or the
+// zero time for downloaded torrents, whose content is fixed by the info
+// hash alone.
+func (e *TorrentEngine) ModTime(infoHash string) time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if mt, ok := e.torrents[infoHash]; ok {
+		return mt.seedModTime
+	}
+	return time.Time{}
+}
+
+// SetFileDuration tells the prioritizer how long a file plays for, so its
+// streaming windows are sized from the file's actual bitrate.
+func (e *TorrentEngine) SetFileDuration(infoHash, filePath string, d time.Duration) error {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	e.mu.RUnlock()
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.prio.setDuration(filePath, d)
+	return nil
 }
 
 type readerWrapper struct {
-	io.Reader
-	io.Closer
+	io.ReadSeekCloser
 	limit int64
 	read  int64
 }
@@ -263,7 +800,7 @@ func (rw *readerWrapper) Read(p []byte) (n int, err error) {
 			p = p[:remaining]
 		}
 	}
-	n, err = rw.Reader.Read(p)
+	n, err = rw.ReadSeekCloser.Read(p)
 	rw.read += int64(n)
 	if err == io.EOF && rw.read < rw.limit {
 		return n, nil
@@ -275,20 +812,29 @@ func (e *TorrentEngine) DropTorrent(infoHash string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	t, ok := e.torrents[infoHash]
+	mt, ok := e.torrents[infoHash]
 	if !ok {
-		return fmt.Errorf("torrent not found")
+		return ErrTorrentNotFound
 	}
+	e.dropLocked(infoHash, mt)
+	return nil
+}
 
-	t.Drop()
+// dropLocked removes mt from the client and the session. Its data stays in
+// the data directory, where the quota still counts it; see
+// keepDroppedLocked. The caller must hold e.mu for writing.
+func (e *TorrentEngine) dropLocked(infoHash string, mt *managedTorrent) {
+	e.keepDroppedLocked(infoHash, mt)
+	mt.t.Drop()
 	delete(e.torrents, infoHash)
-	return nil
+	e.forgetMetainfo(infoHash)
+	e.requestSave()
 }
 
 func (e *TorrentEngine) CreateMagnetLink(infoHash string) (string, error) {
 	t := e.GetTorrent(infoHash)
 	if t == nil {
-		return "", fmt.Errorf("torrent not found")
+		return "", ErrTorrentNotFound
 	}
 
 	info := t.Info()
@@ -296,17 +842,26 @@ func (e *TorrentEngine) CreateMagnetLink(infoHash string) (string, error) {
 		return "", fmt.Errorf("torrent info not available")
 	}
 
-	ihBytes, _ := hex.DecodeString(infoHash)
-	var ih metainfo.Hash
-	copy(ih[:], ihBytes)
-
-	_ = ih
-	magnetURI := fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=%s", infoHash, info.Name)
-	return magnetURI, nil
+	// The torrent's metainfo carries every tracker it announces to.
+	ih := t.InfoHash()
+	mi := t.Metainfo()
+	return mi.Magnet(&ih, info).String(), nil
 }
 
 func (e *TorrentEngine) Close() error {
+	e.closeOnce.Do(func() { close(e.closed) })
+	// Wait out any save in progress, then write the final session, which
+	// also keeps upload totals for seeding policies.
+	<-e.saverDone
+	e.saveSession()
+	if e.lsd != nil {
+		e.lsd.Close()
+	}
 	errs := e.client.Close()
+	e.memory.Close()
+	if err := e.pieceCompletion.Close(); err != nil {
+		errs = append(errs, err)
+	}
 	if len(errs) > 0 {
 		return errs[0]
 	}
@@ -320,55 +875,172 @@ func (e *TorrentEngine) GetListenPort() int {
 func (e *TorrentEngine) GetTorrentName(infoHash string) string {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
-	t, ok := e.torrents[infoHash]
+	mt, ok := e.torrents[infoHash]
 	if !ok {
 		return ""
 	}
-	return t.Name()
+	return mt.t.Name()
+}
+
+// DropAllTorrents drops every torrent in the session. It backs the legacy
+// "stop" command sent without an info hash.
+func (e *TorrentEngine) DropAllTorrents() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for infoHash, mt := range e.torrents {
+		e.keepDroppedLocked(infoHash, mt)
+		mt.t.Drop()
+		e.forgetMetainfo(infoHash)
+	}
+	e.torrents = make(map[string]*managedTorrent)
+	e.requestSave()
 }
 
-func (e *TorrentEngine) DropCurrentTorrent() {
+// PauseTorrent stops all data transfer for a torrent and disconnects its
+// peers, without forgetting it or its downloaded pieces.
+func (e *TorrentEngine) PauseTorrent(infoHash string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	for _, t := range e.torrents {
-		t.Drop()
+
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return ErrTorrentNotFound
 	}
-	e.torrents = make(map[string]*torrent.Torrent)
+	if mt.paused {
+		return nil
+	}
+
+	mt.t.DisallowDataDownload()
+	mt.t.DisallowDataUpload()
+	mt.t.SetMaxEstablishedConns(0)
+	mt.paused = true
+	mt.speed = 0
+	// A restored torrent keeps the time it was paused in an earlier run.
+	if mt.pausedAt.IsZero() {
+		mt.pausedAt = time.Now()
+	}
+	e.requestSave()
+	return nil
 }
 
+// ResumeTorrent undoes PauseTorrent.
+func (e *TorrentEngine) ResumeTorrent(infoHash string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	if !mt.paused {
+		return nil
+	}
+
+	mt.t.SetMaxEstablishedConns(e.maxConns)
+	if !mt.throttledUp {
+		mt.t.AllowDataUpload()
+	}
+	if mt.seedPath == "" && !mt.throttledDown {
+		mt.t.AllowDataDownload()
+	}
+	mt.paused = false
+	mt.announce = true
+	resumeSeedingClock(mt, time.Now())
+	e.requestSave()
+	return nil
+}
+
+// Info is a torrent's status as listed by ListInfo.
 type Info struct {
-	Name       string
-	ServerURL  string
-	Progress   float64
-	Peers      int
-	Speed      int
-	Active     bool
-	Complete   bool
+	InfoHash  string  `json:"infoHash"`
+	Name      string  `json:"name"`
+	ServerURL string  `json:"serverUrl,omitempty"`
+	Progress  float64 `json:"progress"`
+	Peers     int     `json:"peers"`
+	Speed     int     `json:"speed"`
+	Active    bool    `json:"active"`
+	Complete  bool    `json:"complete"`
+	Paused    bool    `json:"paused"`
+	Verifying bool    `json:"verifying"`
+	Verified  float64 `json:"verified"`
 }
 
-func (e *TorrentEngine) GetInfo() Info {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
+// GetInfo reports the state of a single torrent.
+func (e *TorrentEngine) GetInfo(infoHash string) (Info, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	info := Info{
-		Active: len(e.torrents) > 0,
-	}
-
-	if len(e.torrents) > 0 {
-		for _, t := range e.torrents {
-			info.Name = t.Name()
-			stats := t.Stats()
-			info.Peers = stats.ActivePeers
-			if t.Info() != nil {
-				info.Complete = t.Complete().Bool()
-				total := t.Length()
-				if total > 0 {
-					info.Progress = float64(t.BytesCompleted()) / float64(total)
-				}
-			}
-			break // Just get first torrent
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return Info{}, ErrTorrentNotFound
+	}
+	return e.infoLocked(infoHash, mt, time.Now()), nil
+}
+
+// ListInfo reports the state of every torrent in the session, ordered by
+// name so repeated listings are stable.
+func (e *TorrentEngine) ListInfo() []Info {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.listInfoLocked(time.Now())
+}
+
+// listInfoLocked is ListInfo with e.mu held for writing.
+func (e *TorrentEngine) listInfoLocked(now time.Time) []Info {
+	infos := make([]Info, 0, len(e.torrents))
+	for infoHash, mt := range e.torrents {
+		infos = append(infos, e.infoLocked(infoHash, mt, now))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].InfoHash < infos[j].InfoHash
+	})
+	return infos
+}
+
+// infoLocked builds the Info for mt and refreshes its speed sample. The
+// caller must hold e.mu for writing.
+func (e *TorrentEngine) infoLocked(infoHash string, mt *managedTorrent, now time.Time) Info {
+	t := mt.t
+	stats := t.Stats()
+
+	read := stats.BytesReadData.Int64()
+	if !mt.lastSample.IsZero() {
+		if elapsed := now.Sub(mt.lastSample); elapsed >= 500*time.Millisecond {
+			mt.speed = int(float64(read-mt.lastBytes) / elapsed.Seconds())
+			mt.lastBytes = read
+			mt.lastSample = now
 		}
+	} else {
+		mt.lastBytes = read
+		mt.lastSample = now
 	}
 
+	info := Info{
+		InfoHash: infoHash,
+		Name:     t.Name(),
+		Peers:    stats.ActivePeers,
+		Speed:    mt.speed,
+		Active:   !mt.paused,
+		Paused:   mt.paused,
+	}
+	if mt.paused {
+		info.Speed = 0
+	}
+	if mt.verifying {
+		info.Verifying = true
+		if n := t.NumPieces(); n > 0 {
+			info.Verified = float64(mt.verified) / float64(n)
+		}
+	}
+	if t.Info() != nil {
+		info.Complete = t.Complete().Bool()
+		total := t.Length()
+		if total > 0 {
+			info.Progress = float64(t.BytesCompleted()) / float64(total)
+		}
+	}
 	return info
 }
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"sharestream-engine/internal/events"
+)
+
+const (
+	// progressInterval is how often "progress" and "pieces" events are
+	// published for each torrent.
+	progressInterval = time.Second
+
+	// stallTimeout is how long a torrent that still wants data may go
+	// without receiving any before a "stalled" event.
+	stallTimeout = 30 * time.Second
+)
+
+// peerConnected publishes a "peer" event for a completed handshake. It is
+// called by the client, so it must not block.
+func peerConnected(bus *events.Bus) func(*torrent.PeerConn, metainfo.Hash) {
+	return func(pc *torrent.PeerConn, ih metainfo.Hash) {
+		bus.Publish(events.Event{
+			Event:    "peer",
+			InfoHash: ih.HexString(),
+			Address:  pc.RemoteAddr.String(),
+			Network:  pc.Network,
+		})
+	}
+}
+
+// monitor publishes each torrent's periodic events until the engine is
+// closed: "progress", "pieces" for newly completed pieces, "done" when a
+// download completes, "seeding-finished" when its seeding policy removes
+// it, "evicted" when the disk quota removes it, and "stalled"/"unstalled"
+// when data stops and starts flowing. It also enforces bandwidth limits and
+// the disk quota, see throttle and enforceQuota, and publishes
+// "self-addresses" when the host's addresses change.
+func (e *TorrentEngine) monitor() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	throttle := time.NewTicker(throttleInterval)
+	defer throttle.Stop()
+	quota := time.NewTicker(quotaInterval)
+	defer quota.Stop()
+	addrs := time.NewTicker(selfAddressInterval)
+	defer addrs.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, ev := range e.sample(now) {
+				e.events.Publish(ev)
+			}
+			e.announceLocal()
+		case now := <-throttle.C:
+			e.throttle(now)
+		case <-quota.C:
+			e.enforceQuota()
+		case <-addrs.C:
+			e.checkSelfAddresses()
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+// sample collects the events for one monitor tick, ordered by torrent name.
+func (e *TorrentEngine) sample(now time.Time) []events.Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var evs []events.Event
+	for _, info := range e.listInfoLocked(now) {
+		mt := e.torrents[info.InfoHash]
+		evs = append(evs, events.Event{
+			Event:      "progress",
+			InfoHash:   info.InfoHash,
+			Downloaded: info.Progress,
+			Speed:      info.Speed,
+			Peers:      info.Peers,
+			Name:       info.Name,
+			Paused:     info.Paused,
+			Verifying:  info.Verifying,
+			Verified:   info.Verified,
+		})
+
+		if len(mt.newPieces) > 0 {
+			evs = append(evs, events.Event{Event: "pieces", InfoHash: info.InfoHash, Pieces: mt.newPieces})
+			mt.newPieces = nil
+		}
+
+		// A torrent first seen complete, like a seed, was never
+		// downloading.
+		if info.Complete && !mt.complete && mt.sampled {
+			evs = append(evs, events.Event{Event: "done", InfoHash: info.InfoHash, Name: info.Name})
+		}
+		mt.complete = info.Complete
+		mt.sampled = true
+
+		if info.Complete && mt.seedingSince.IsZero() {
+			mt.seedingSince = now
+			e.requestSave()
+		}
+		if info.Complete && !info.Paused && !info.Verifying {
+			if reason := seedingDone(mt, now); reason != "" {
+				evs = append(evs, finishedEvent(info.InfoHash, mt, reason))
+				e.dropLocked(info.InfoHash, mt)
+				continue
+			}
+		}
+
+		if info.Speed > 0 || info.Paused || info.Verifying || !wantsData(mt.t) {
+			if mt.stallReported {
+				evs = append(evs, events.Event{Event: "unstalled", InfoHash: info.InfoHash, Name: info.Name})
+			}
+			mt.stalledSince = time.Time{}
+			mt.stallReported = false
+			continue
+		}
+		if mt.stalledSince.IsZero() {
+			mt.stalledSince = now
+		}
+		if stalled := now.Sub(mt.stalledSince); stalled >= stallTimeout && !mt.stallReported {
+			mt.stallReported = true
+			evs = append(evs, events.Event{
+				Event:    "stalled",
+				InfoHash: info.InfoHash,
+				Name:     info.Name,
+				Peers:    info.Peers,
+				Stalled:  stalled.Seconds(),
+			})
+		}
+	}
+	return evs
+}
+
+// wantsData reports whether t still has selected data, or its metadata,
+// to download.
+func wantsData(t *torrent.Torrent) bool {
+	if t.Info() == nil {
+		return true
+	}
+	for _, f := range t.Files() {
+		if f.Priority() != torrent.PiecePriorityNone && f.BytesCompleted() < f.Length() {
+			return true
+		}
+	}
+	return false
+}
+
+// watchPieces records the pieces of mt that complete for the next
+// "pieces" event, until the torrent is closed.
+func (e *TorrentEngine) watchPieces(mt *managedTorrent) {
+	sub := mt.t.SubscribePieceStateChanges()
+	defer sub.Close()
+
+	done := make([]bool, mt.t.NumPieces())
+	for i := range done {
+		done[i] = mt.t.PieceState(i).Completion.Complete
+	}
+	for {
+		select {
+		case c, ok := <-sub.Values:
+			if !ok {
+				return
+			}
+			if c.Index >= len(done) || done[c.Index] || !c.Completion.Complete {
+				continue
+			}
+			done[c.Index] = true
+			e.mu.Lock()
+			mt.newPieces = append(mt.newPieces, c.Index)
+			e.mu.Unlock()
+		case <-mt.t.Closed():
+			return
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	seedPieceLength = 256 * 1024
+
+	// Pieces are handed to hashing workers in batches so each worker reads
+	// a contiguous region of the file.
+	hashBatchPieces = 64
+
+	hashProgressInterval = 500 * time.Millisecond
+	hashCacheDirName     = "hashcache"
+
+	// Cached hashes are kept after their seed stops, so seeding the file
+	// again is instant, and pruned when the cache is written.
+	hashCacheMaxAge   = 90 * 24 * time.Hour
+	hashCacheMaxBytes = 64 << 20
+)
+
+// HashProgress reports how far hashing a seed has got.
+type HashProgress struct {
+	Path  string
+	Bytes int64
+	Total int64
+	ETA   time.Duration
+}
+
+// hashFile is one file that makes up a seed, in torrent order.
+type hashFile struct {
+	path    string
+	relPath []string
+	length  int64
+	modTime time.Time
+}
+
+// listHashFiles returns the files of a seed path in the order
+// metainfo.Info.BuildFromFilePath would lay them out.
+func listHashFiles(root string) ([]hashFile, bool, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, false, err
+	}
+	if !fi.IsDir() {
+		return []hashFile{{path: root, length: fi.Size(), modTime: fi.ModTime()}}, false, nil
+	}
+
+	var files []hashFile
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, hashFile{
+			path:    path,
+			relPath: strings.Split(filepath.ToSlash(rel), "/"),
+			length:  fi.Size(),
+			modTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Join(files[i].relPath, "/") < strings.Join(files[j].relPath, "/")
+	})
+	return files, true, nil
+}
+
+// buildSeedInfo builds the info dictionary for a seed path, hashing pieces on
+// several goroutines. Results are cached by path, size and modification
+// time, so seeding an unchanged file again skips hashing entirely.
+func (e *TorrentEngine) buildSeedInfo(ctx context.Context, root string, onProgress func(HashProgress)) (metainfo.Info, error) {
+	files, isDir, err := listHashFiles(root)
+	if err != nil {
+		return metainfo.Info{}, err
+	}
+
+	info := metainfo.Info{
+		Name:        filepath.Base(root),
+		PieceLength: seedPieceLength,
+	}
+	var total int64
+	for _, f := range files {
+		total += f.length
+		if isDir {
+			info.Files = append(info.Files, metainfo.FileInfo{Path: f.relPath, Length: f.length})
+		}
+	}
+	if !isDir {
+		info.Length = total
+	}
+	if total == 0 {
+		return metainfo.Info{}, fmt.Errorf("nothing to seed: %s is empty", root)
+	}
+
+	key := hashCacheKey(root, files, info.PieceLength)
+	if pieces, ok := e.loadCachedPieces(root, key); ok {
+		e.logger.Info("using cached piece hashes", "path", root)
+		info.Pieces = pieces
+		if onProgress != nil {
+			onProgress(HashProgress{Path: root, Bytes: total, Total: total})
+		}
+		return info, nil
+	}
+
+	pieces, err := hashPieces(ctx, root, files, total, info.PieceLength, onProgress)
+	if err != nil {
+		return metainfo.Info{}, err
+	}
+	info.Pieces = pieces
+	e.storeCachedPieces(root, key, pieces)
+	return info, nil
+}
+
+func hashPieces(ctx context.Context, root string, files []hashFile, total, pieceLength int64, onProgress func(HashProgress)) ([]byte, error) {
+	numPieces := int((total + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, numPieces*sha1.Size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashed atomic.Int64
+	batches := make(chan int)
+	errc := make(chan error, 1)
+
+	workers := runtime.NumCPU()
+	if workers > 8 {
+		workers = 8
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newMultiFileReader(files)
+			defer r.Close()
+
+			buf := make([]byte, pieceLength)
+			h := sha1.New()
+			for first := range batches {
+				for i := first; i < first+hashBatchPieces && i < numPieces; i++ {
+					if ctx.Err() != nil {
+						return
+					}
+					off := int64(i) * pieceLength
+					n := pieceLength
+					if off+n > total {
+						n = total - off
+					}
+					if _, err := r.ReadAt(buf[:n], off); err != nil {
+						select {
+						case errc <- fmt.Errorf("failed to read piece %d: %w", i, err):
+						default:
+						}
+						cancel()
+						return
+					}
+					h.Reset()
+					h.Write(buf[:n])
+					copy(pieces[i*sha1.Size:], h.Sum(nil))
+					hashed.Add(n)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	if onProgress != nil {
+		go func() {
+			start := time.Now()
+			ticker := time.NewTicker(hashProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					onProgress(hashProgressAt(root, hashed.Load(), total, time.Since(start)))
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < numPieces; i += hashBatchPieces {
+		select {
+		case batches <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(batches)
+	wg.Wait()
+	close(done)
+
+	select {
+	case err := <-errc:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if onProgress != nil {
+		onProgress(HashProgress{Path: root, Bytes: total, Total: total})
+	}
+	return pieces, nil
+}
+
+func hashProgressAt(path string, done, total int64, elapsed time.Duration) HashProgress {
+	p := HashProgress{Path: path, Bytes: done, Total: total}
+	if done > 0 && done < total {
+		rate := float64(done) / elapsed.Seconds()
+		p.ETA = time.Duration(float64(total-done) / rate * float64(time.Second))
+	}
+	return p
+}
+
+// multiFileReader reads the concatenation of a seed's files, opening each
+// one on first use.
+type multiFileReader struct {
+	files   []hashFile
+	offsets []int64
+	open    map[int]*os.File
+}
+
+func newMultiFileReader(files []hashFile) *multiFileReader {
+	offsets := make([]int64, len(files))
+	var off int64
+	for i, f := range files {
+		offsets[i] = off
+		off += f.length
+	}
+	return &multiFileReader{files: files, offsets: offsets, open: make(map[int]*os.File)}
+}
+
+func (r *multiFileReader) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+	if i < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	read := 0
+	for ; read < len(p) && i < len(r.files); i++ {
+		f, ok := r.open[i]
+		if !ok {
+			var err error
+			f, err = os.Open(r.files[i].path)
+			if err != nil {
+				return read, err
+			}
+			r.open[i] = f
+		}
+		fileOff := off + int64(read) - r.offsets[i]
+		want := r.files[i].length - fileOff
+		if want > int64(len(p)-read) {
+			want = int64(len(p) - read)
+		}
+		n, err := f.ReadAt(p[read:read+int(want)], fileOff)
+		read += n
+		if err != nil && !(err == io.EOF && int64(n) == want) {
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.ErrUnexpectedEOF
+	}
+	return read, nil
+}
+
+func (r *multiFileReader) Close() error {
+	for _, f := range r.open {
+		f.Close()
+	}
+	return nil
+}
+
+// hashCacheKey identifies a seed's content by its files' paths, sizes and
+// modification times.
+func hashCacheKey(root string, files []hashFile, pieceLength int64) string {
+	h := sha1.New()
+	io.WriteString(h, root)
+	io.WriteString(h, "\x00"+strconv.FormatInt(pieceLength, 10))
+	for _, f := range files {
+		io.WriteString(h, "\x00"+strings.Join(f.relPath, "/"))
+		io.WriteString(h, "\x00"+strconv.FormatInt(f.length, 10))
+		io.WriteString(h, "\x00"+strconv.FormatInt(f.modTime.UnixNano(), 10))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashCacheRoot prefixes a seed path's cache entries, so the entries left
+// behind when the path's files change can be found and pruned.
+func hashCacheRoot(root string) string {
+	sum := sha1.Sum([]byte(root))
+	return hex.EncodeToString(sum[:8]) + "-"
+}
+
+func (e *TorrentEngine) hashCachePath(root, key string) string {
+	return filepath.Join(e.dataDir, hashCacheDirName, hashCacheRoot(root)+key+".pieces")
+}
+
+// The cache stores the raw concatenated piece hashes. Entries outlive their
+// seeds; a hit marks the entry recently used for pruneHashCache.
+func (e *TorrentEngine) loadCachedPieces(root, key string) ([]byte, bool) {
+	e.hashCacheMu.Lock()
+	defer e.hashCacheMu.Unlock()
+	path := e.hashCachePath(root, key)
+	pieces, err := os.ReadFile(path)
+	if err != nil || len(pieces) == 0 || len(pieces)%sha1.Size != 0 {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return pieces, true
+}
+
+func (e *TorrentEngine) storeCachedPieces(root, key string, pieces []byte) {
+	e.hashCacheMu.Lock()
+	defer e.hashCacheMu.Unlock()
+	path := e.hashCachePath(root, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		e.logger.Warn("failed to create hash cache dir", "error", err)
+		return
+	}
+	if err := writeFileAtomic(path, pieces); err != nil {
+		e.logger.Warn("failed to write hash cache", "error", err)
+		return
+	}
+	if err := pruneHashCache(filepath.Dir(path), path, hashCacheRoot(root), time.Now(), hashCacheMaxAge, hashCacheMaxBytes); err != nil {
+		e.logger.Warn("failed to prune hash cache", "error", err)
+	}
+}
+
+// pruneHashCache removes from dir the entries sharing keep's root prefix,
+// whose files have changed since they were hashed, the entries unused for
+// maxAge, and then the least recently used until the rest fit in maxBytes.
+// keep itself is never removed.
+func pruneHashCache(dir, keep, rootPrefix string, now time.Time, maxAge time.Duration, maxBytes int64) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	var firstErr error
+	remove := func(path string) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, d := range dirEntries {
+		name := d.Name()
+		if !strings.HasSuffix(name, ".pieces") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		if path != keep && (strings.HasPrefix(name, rootPrefix) || now.Sub(info.ModTime()) > maxAge) {
+			remove(path)
+			continue
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, en := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if en.path == keep {
+			continue
+		}
+		remove(en.path)
+		total -= en.size
+	}
+	return firstErr
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneHashCache(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	root := hashCacheRoot("/media/film.mkv")
+	other := hashCacheRoot("/media/other.mkv")
+
+	type entry struct {
+		name string
+		size int
+		age  time.Duration
+	}
+	tests := []struct {
+		name     string
+		entries  []entry
+		keep     string
+		maxBytes int64
+		want     []string
+	}{
+		{
+			name:     "dropped seed kept",
+			entries:  []entry{{other + "a.pieces", 20, time.Hour}, {root + "new.pieces", 20, 0}},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{other + "a.pieces", root + "new.pieces"},
+		},
+		{
+			name:     "file changed",
+			entries:  []entry{{root + "old.pieces", 20, time.Hour}, {root + "new.pieces", 20, 0}},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{root + "new.pieces"},
+		},
+		{
+			name:     "unused too long",
+			entries:  []entry{{other + "a.pieces", 20, hashCacheMaxAge + time.Hour}, {root + "new.pieces", 20, 0}},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{root + "new.pieces"},
+		},
+		{
+			name: "over the size cap",
+			entries: []entry{
+				{other + "a.pieces", 40, 3 * time.Hour},
+				{hashCacheRoot("/media/b") + "b.pieces", 40, time.Hour},
+				{root + "new.pieces", 40, 0},
+			},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{hashCacheRoot("/media/b") + "b.pieces", root + "new.pieces"},
+		},
+		{
+			name:     "kept entry over the cap on its own",
+			entries:  []entry{{root + "new.pieces", 200, 0}},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{root + "new.pieces"},
+		},
+		{
+			name:     "temporary files left alone",
+			entries:  []entry{{root + "old.pieces.tmp", 20, hashCacheMaxAge + time.Hour}, {root + "new.pieces", 20, 0}},
+			keep:     root + "new.pieces",
+			maxBytes: 100,
+			want:     []string{root + "new.pieces", root + "old.pieces.tmp"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, en := range tt.entries {
+				path := filepath.Join(dir, en.name)
+				if err := os.WriteFile(path, make([]byte, en.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				used := now.Add(-en.age)
+				if err := os.Chtimes(path, used, used); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := pruneHashCache(dir, filepath.Join(dir, tt.keep), root, now, hashCacheMaxAge, tt.maxBytes); err != nil {
+				t.Fatal(err)
+			}
+			dirEntries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, d := range dirEntries {
+				got = append(got, d.Name())
+			}
+			sort.Strings(tt.want)
+			if len(got) != len(tt.want) {
+				t.Fatalf("left %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("left %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"sharestream-engine/internal/events"
+	"sharestream-engine/internal/ratelimit"
+)
+
+// throttleInterval is how often per-torrent limits are enforced.
+const throttleInterval = 250 * time.Millisecond
+
+// Limits reports the limits in force: global and alternative limits, and
+// with an infoHash that torrent's own limits.
+func (e *TorrentEngine) Limits(infoHash string) (ratelimit.Status, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	status := e.limitStatusLocked()
+	if infoHash != "" {
+		mt, ok := e.torrents[infoHash]
+		if !ok {
+			return ratelimit.Status{}, ErrTorrentNotFound
+		}
+		l := mt.limits
+		status.Torrent = &l
+	}
+	return status, nil
+}
+
+func (e *TorrentEngine) limitStatusLocked() ratelimit.Status {
+	return ratelimit.Status{
+		Global:  e.limits,
+		Alt:     e.altLimits,
+		AltMode: e.altMode,
+		AltOn:   e.altOn,
+	}
+}
+
+// SetLimits changes the global limits, which apply to the whole client
+// while alternative limits are off.
+func (e *TorrentEngine) SetLimits(l ratelimit.Limits) error {
+	if err := validateLimits(l); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.limits = l
+	e.applyLimitsLocked(time.Now())
+	return nil
+}
+
+// SetAltLimits changes the alternative global limits.
+func (e *TorrentEngine) SetAltLimits(l ratelimit.Limits) error {
+	if err := validateLimits(l); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.altLimits = l
+	e.applyLimitsLocked(time.Now())
+	return nil
+}
+
+// SetAltMode turns alternative limits on or off, or back to following
+// the schedule; see ratelimit.AltOn, AltOff and AltSchedule.
+func (e *TorrentEngine) SetAltMode(mode string) error {
+	switch mode {
+	case ratelimit.AltOn, ratelimit.AltOff, ratelimit.AltSchedule:
+	default:
+		return fmt.Errorf("invalid alt speed mode %q", mode)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.altMode = mode
+	e.applyLimitsLocked(time.Now())
+	return nil
+}
+
+// SetTorrentLimits limits a single torrent, on top of the global limits.
+func (e *TorrentEngine) SetTorrentLimits(infoHash string, l ratelimit.Limits) error {
+	if err := validateLimits(l); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	mt.limits = l
+	e.mu.Unlock()
+
+	e.requestSave()
+	return nil
+}
+
+func validateLimits(l ratelimit.Limits) error {
+	if l.Upload < 0 || l.Download < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// applyLimitsLocked sets the client's limiters to the global or
+// alternative limits, whichever are in force at now. It reports whether
+// alternative limits were switched on or off. The caller must hold e.mu for
+// writing.
+func (e *TorrentEngine) applyLimitsLocked(now time.Time) bool {
+	altOn := e.altMode == ratelimit.AltOn ||
+		(e.altMode == ratelimit.AltSchedule && e.altSchedule.Active(now))
+	switched := altOn != e.altOn
+	e.altOn = altOn
+
+	l := e.limitStatusLocked().Effective()
+	if l != e.applied {
+		ratelimit.Apply(e.upLimiter, l.Upload)
+		ratelimit.Apply(e.downLimiter, l.Download)
+		e.applied = l
+	}
+	return switched
+}
+
+// throttle enforces per-torrent limits, which the client has no limiter
+// for, by stopping a torrent's transfers while it is over its limit. It
+// also switches scheduled alternative limits, publishing a "limits" event
+// when they change.
+func (e *TorrentEngine) throttle(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.applyLimitsLocked(now) {
+		status := e.limitStatusLocked()
+		e.events.Publish(events.Event{Event: "limits", Limits: &status})
+	}
+
+	for _, mt := range e.torrents {
+		if mt.limits == (ratelimit.Limits{}) && !mt.throttledDown && !mt.throttledUp {
+			continue
+		}
+		stats := mt.t.Stats()
+		down := mt.downMeter.Over(mt.limits.Download, stats.BytesReadData.Int64(), now)
+		up := mt.upMeter.Over(mt.limits.Upload, stats.BytesWrittenData.Int64(), now)
+
+		// Paused torrents and seeds are already stopped; only the flags
+		// change, for ResumeTorrent to honour.
+		if down != mt.throttledDown && !mt.paused && mt.seedPath == "" {
+			if down {
+				mt.t.DisallowDataDownload()
+			} else {
+				mt.t.AllowDataDownload()
+			}
+		}
+		if up != mt.throttledUp && !mt.paused {
+			if up {
+				mt.t.DisallowDataUpload()
+			} else {
+				mt.t.AllowDataUpload()
+			}
+		}
+		mt.throttledDown, mt.throttledUp = down, up
+	}
+}
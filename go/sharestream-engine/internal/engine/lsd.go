@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"net/netip"
+
+	"github.com/anacrolix/torrent"
+)
+
+// peerSourceLSD marks peers found by local service discovery.
+const peerSourceLSD torrent.PeerSource = "Lsd"
+
+// lsdTorrents returns the torrents to announce on the local network; see
+// lsdShared.
+func (e *TorrentEngine) lsdTorrents() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var infoHashes []string
+	for infoHash, mt := range e.torrents {
+		if lsdShared(mt) {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	return infoHashes
+}
+
+// lsdPeer connects to a host on the local network that announced
+// infoHash, and reports whether the torrent is ours to announce back.
+func (e *TorrentEngine) lsdPeer(infoHash string, addr netip.AddrPort) bool {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	ok = ok && lsdShared(mt)
+	e.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	mt.t.AddPeers([]torrent.PeerInfo{{Addr: addr, Source: peerSourceLSD}})
+	return true
+}
+
+// announceLocal announces the torrents added or resumed since the last
+// monitor tick on the local network, rather than at the next periodic
+// announce, so hosts already sharing them connect within moments. Waiting
+// for the tick gives a new torrent's policy time to be set, so a room's
+// torrent is never announced.
+func (e *TorrentEngine) announceLocal() {
+	if e.lsd == nil {
+		return
+	}
+	var infoHashes []string
+	e.mu.Lock()
+	for infoHash, mt := range e.torrents {
+		if mt.announce && lsdShared(mt) {
+			infoHashes = append(infoHashes, infoHash)
+		}
+		mt.announce = false
+	}
+	e.mu.Unlock()
+	if len(infoHashes) > 0 {
+		e.lsd.Announce(infoHashes...)
+	}
+}
+
+// lsdShared reports whether mt may be announced on the local network: it
+// isn't paused, private or shared in a room, whose torrents are only for
+// its members.
+func lsdShared(mt *managedTorrent) bool {
+	return !mt.paused && !private(mt.t) && mt.policy.Room == ""
+}
+
+// private reports whether t is a private torrent, which BEP 27 keeps to
+// its trackers. A magnet without metadata yet is assumed not to be.
+func private(t *torrent.Torrent) bool {
+	info := t.Info()
+	return info != nil && info.Private != nil && *info.Private
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"sharestream-engine/internal/events"
+)
+
+// DefaultMetadataTimeout is how long a wait for a torrent's metadata lasts
+// when Config.MetadataTimeout isn't set.
+const DefaultMetadataTimeout = 2 * time.Minute
+
+// ErrMetadataTimeout is returned when a torrent's metadata doesn't arrive
+// within the metadata timeout, which usually means nobody is sharing it.
+var ErrMetadataTimeout = errors.New("timed out waiting for torrent metadata")
+
+// WaitMetadata waits for a torrent's metadata. It returns ctx's error if
+// ctx is done first, and ErrMetadataTimeout if the metadata timeout passes.
+func (e *TorrentEngine) WaitMetadata(ctx context.Context, infoHash string) error {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	e.mu.RUnlock()
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	return e.waitInfo(ctx, mt)
+}
+
+func (e *TorrentEngine) waitInfo(ctx context.Context, mt *managedTorrent) error {
+	select {
+	case <-mt.t.GotInfo():
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(e.metadataTimeout)
+	defer timer.Stop()
+	select {
+	case <-mt.t.GotInfo():
+		return nil
+	case <-mt.t.Closed():
+		return ErrTorrentNotFound
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrMetadataTimeout
+	}
+}
+
+// awaitMetadata waits for a newly tracked torrent's metadata, publishing
+// "metadata-pending" if it isn't known yet, "metadata-timeout" once the
+// metadata timeout passes without it, and "metadata" when it arrives, which
+// may still be after a timeout. It reports false if the torrent is dropped
+// first.
+func (e *TorrentEngine) awaitMetadata(infoHash string, mt *managedTorrent) bool {
+	select {
+	case <-mt.t.GotInfo():
+	default:
+		e.events.Publish(events.Event{Event: "metadata-pending", InfoHash: infoHash})
+		timer := time.NewTimer(e.metadataTimeout)
+		defer timer.Stop()
+		select {
+		case <-mt.t.GotInfo():
+		case <-mt.t.Closed():
+			return false
+		case <-timer.C:
+			stats := mt.t.Stats()
+			e.events.Publish(events.Event{
+				Event:    "metadata-timeout",
+				InfoHash: infoHash,
+				Peers:    stats.ActivePeers,
+			})
+			select {
+			case <-mt.t.GotInfo():
+			case <-mt.t.Closed():
+				return false
+			}
+		}
+	}
+
+	files := mt.t.Files()
+	ev := events.Event{
+		Event:    "metadata",
+		InfoHash: infoHash,
+		Name:     mt.t.Name(),
+		Size:     mt.t.Length(),
+		Files:    make([]events.File, len(files)),
+	}
+	for i, f := range files {
+		ev.Files[i] = events.File{Path: f.Path(), Length: f.Length()}
+	}
+	e.events.Publish(ev)
+	return true
+}
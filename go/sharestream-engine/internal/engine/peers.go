@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+	"sharestream-engine/internal/events"
+)
+
+// PeerDetail describes a connected peer.
+type PeerDetail = events.Peer
+
+// Transports and encryption methods reported for a peer.
+const (
+	TransportTCP    = "tcp"
+	TransportUTP    = "utp"
+	TransportWebRTC = "webrtc"
+
+	EncryptionNone   = "none"
+	EncryptionHeader = "header"
+	EncryptionRC4    = "rc4"
+)
+
+// peerWire tracks what each connected peer has told us about its choke and
+// interest state. The torrent client keeps its own copy but doesn't export
+// it, so the engine follows the messages as they are read.
+type peerWire struct {
+	mu    sync.Mutex
+	state map[*torrent.PeerConn]wireState
+}
+
+// wireState is a peer's side of a connection. The zero value is how every
+// connection starts: the peer is choking us and not interested.
+type wireState struct {
+	unchoked   bool
+	interested bool
+}
+
+func newPeerWire() *peerWire {
+	return &peerWire{state: make(map[*torrent.PeerConn]wireState)}
+}
+
+// read is the client's ReadMessage callback.
+func (w *peerWire) read(pc *torrent.PeerConn, msg *pp.Message) {
+	switch msg.Type {
+	case pp.Choke, pp.Unchoke, pp.Interested, pp.NotInterested:
+	default:
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.state[pc]
+	switch msg.Type {
+	case pp.Choke:
+		s.unchoked = false
+	case pp.Unchoke:
+		s.unchoked = true
+	case pp.Interested:
+		s.interested = true
+	case pp.NotInterested:
+		s.interested = false
+	}
+	w.state[pc] = s
+}
+
+// closed is the client's PeerConnClosed callback.
+func (w *peerWire) closed(pc *torrent.PeerConn) {
+	w.mu.Lock()
+	delete(w.state, pc)
+	w.mu.Unlock()
+}
+
+func (w *peerWire) get(pc *torrent.PeerConn) wireState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state[pc]
+}
+
+// SetRoomPeers records the addresses of a room's members, replacing any
+// given before. Peers are matched by IP, so an address may carry a port or
+// not. An empty list forgets the room, as does RoomEnded.
+func (e *TorrentEngine) SetRoomPeers(room string, addrs []string) {
+	if room == "" {
+		return
+	}
+	hosts := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if h := peerHost(addr); h != "" {
+			hosts[h] = true
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(hosts) == 0 {
+		delete(e.roomPeers, room)
+		return
+	}
+	e.roomPeers[room] = hosts
+}
+
+// roomMember reports whether addr belongs to a member of any room.
+func (e *TorrentEngine) roomMember(addr string) bool {
+	h := peerHost(addr)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, hosts := range e.roomPeers {
+		if hosts[h] {
+			return true
+		}
+	}
+	return false
+}
+
+// peerHost returns the IP of addr, with or without a port, in canonical
+// form, or "" if it isn't one.
+func peerHost(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// peerTransport names the transport of a connection from its network.
+func peerTransport(network string) string {
+	switch {
+	case network == "webrtc":
+		return TransportWebRTC
+	case strings.Contains(network, "udp"):
+		return TransportUTP
+	default:
+		return TransportTCP
+	}
+}
+
+// peerEncryption reports how a connection is encrypted. The client keeps
+// this unexported, so it is read from the connection's String.
+func peerEncryption(pc *torrent.PeerConn) string {
+	return encryptionFromString(pc.String())
+}
+
+// encryptionFromString reads the encryption flag from a PeerConn's String.
+// In anacrolix/torrent v1.61 that is formatted as
+//
+//	%T %p [flags=%v id=%+q, exts=%v, v=%q]
+//
+// with comma separated flags: the peer source, "U" for uTP, then "E" for
+// an RC4 stream or "e" for an obfuscated handshake only, then "v1" or
+// "v2". Anything else reads as unencrypted. The format isn't part of the
+// client's API, so TestEncryptionFromString pins it.
+func encryptionFromString(s string) string {
+	_, flags, ok := strings.Cut(s, "[flags=")
+	if !ok {
+		return EncryptionNone
+	}
+	flags, _, _ = strings.Cut(flags, " ")
+	for _, f := range strings.Split(flags, ",") {
+		switch f {
+		case "E":
+			return EncryptionRC4
+		case "e":
+			return EncryptionHeader
+		}
+	}
+	return EncryptionNone
+}
+
+// AddPeers connects a torrent to peers given as ip:port, such as the
+// engines of a room's other members, and returns how many were new to it.
+// None are added if any address is invalid.
+func (e *TorrentEngine) AddPeers(infoHash string, addrs []string) (int, error) {
+	t := e.GetTorrent(infoHash)
+	if t == nil {
+		return 0, ErrTorrentNotFound
+	}
+	peers := make([]torrent.PeerInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil || ap.Port() == 0 {
+			return 0, fmt.Errorf("invalid peer address %q", addr)
+		}
+		peers = append(peers, torrent.PeerInfo{
+			Addr:    ap,
+			Source:  torrent.PeerSourceDirect,
+			Trusted: true,
+		})
+	}
+	return t.AddPeers(peers), nil
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+)
+
+// peerConnFormat is PeerConn.String's format in anacrolix/torrent v1.61.0,
+// the version in go.mod. If an upgrade changes it, update both this and
+// encryptionFromString.
+const peerConnFormat = "%T %p [flags=%v id=%+q, exts=%v, v=%q]"
+
+func TestEncryptionFromString(t *testing.T) {
+	pc := new(torrent.PeerConn)
+	tests := []struct {
+		flags string
+		want  string
+	}{
+		{"Tr,E,v1", EncryptionRC4},
+		{"Tr,U,E,v1", EncryptionRC4},
+		{"Hg,e,v1", EncryptionHeader},
+		{"Lsd,U,e,v2", EncryptionHeader},
+		{"Tr,v1", EncryptionNone},
+		{"U,v1", EncryptionNone},
+		{",v1", EncryptionNone},
+	}
+	for _, tt := range tests {
+		s := fmt.Sprintf(peerConnFormat, pc, pc, tt.flags, "-qB4630-abcdefghijkl", "0000000000100005", "qBittorrent/4.6.3")
+		if got := encryptionFromString(s); got != tt.want {
+			t.Errorf("encryptionFromString(%q) = %q, want %q", s, got, tt.want)
+		}
+	}
+
+	// A client name or peer ID that happens to hold a flag doesn't count.
+	s := fmt.Sprintf(peerConnFormat, pc, pc, "Tr,v1", "-E-", "E", "e,E")
+	if got := encryptionFromString(s); got != EncryptionNone {
+		t.Errorf("encryptionFromString(%q) = %q, want %q", s, got, EncryptionNone)
+	}
+	if got := encryptionFromString("unrecognised"); got != EncryptionNone {
+		t.Errorf("encryptionFromString without flags = %q, want %q", got, EncryptionNone)
+	}
+}
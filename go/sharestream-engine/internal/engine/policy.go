@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"sharestream-engine/internal/events"
+)
+
+// Reasons a torrent stops seeding, reported in "seeding-finished" events.
+const (
+	FinishedRatio = "ratio"
+	FinishedTime  = "time"
+	FinishedRoom  = "room"
+)
+
+// SeedPolicy says when a torrent stops seeding and is removed from the
+// session. Ratio and Minutes count once the torrent is complete, and
+// whichever is reached first applies; zero disables either. A torrent with
+// a Room is removed when RoomEnded is called for it, complete or not.
+type SeedPolicy struct {
+	// Ratio is bytes uploaded over the torrent's size.
+	Ratio float64 `json:"ratio,omitempty"`
+	// Minutes is time spent complete.
+	Minutes float64 `json:"minutes,omitempty"`
+	Room    string  `json:"room,omitempty"`
+}
+
+// Validate reports whether p is usable.
+func (p SeedPolicy) Validate() error {
+	if p.Ratio < 0 || p.Minutes < 0 {
+		return fmt.Errorf("seed policy must not be negative")
+	}
+	return nil
+}
+
+// SetSeedPolicy replaces a torrent's seeding policy.
+func (e *TorrentEngine) SetSeedPolicy(infoHash string, p SeedPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	mt.policy = p
+	e.mu.Unlock()
+
+	e.requestSave()
+	return nil
+}
+
+// RoomEnded removes every torrent whose policy names room, publishing a
+// "seeding-finished" event for each, and returns their info hashes. The
+// room's members are forgotten.
+func (e *TorrentEngine) RoomEnded(room string) []string {
+	if room == "" {
+		return nil
+	}
+	e.mu.Lock()
+	delete(e.roomPeers, room)
+	var ended []string
+	var evs []events.Event
+	for infoHash, mt := range e.torrents {
+		if mt.policy.Room != room {
+			continue
+		}
+		ended = append(ended, infoHash)
+		evs = append(evs, finishedEvent(infoHash, mt, FinishedRoom))
+		e.dropLocked(infoHash, mt)
+	}
+	e.mu.Unlock()
+
+	for _, ev := range evs {
+		e.events.Publish(ev)
+	}
+	return ended
+}
+
+// uploadedLocked returns the payload bytes mt has uploaded, including in
+// earlier runs.
+func uploadedLocked(mt *managedTorrent) int64 {
+	stats := mt.t.Stats()
+	return mt.uploaded + stats.BytesWrittenData.Int64()
+}
+
+// seedingDone reports why a complete torrent has finished seeding under its
+// policy, or "" if it hasn't.
+func seedingDone(mt *managedTorrent, now time.Time) string {
+	p := mt.policy
+	if p.Ratio > 0 {
+		if size := mt.t.Length(); size > 0 && float64(uploadedLocked(mt))/float64(size) >= p.Ratio {
+			return FinishedRatio
+		}
+	}
+	if p.Minutes > 0 && now.Sub(mt.seedingSince).Minutes() >= p.Minutes {
+		return FinishedTime
+	}
+	return ""
+}
+
+// resumeSeedingClock moves seedingSince on by the time mt spent paused, so
+// a seeding time limit only counts time spent seeding.
+func resumeSeedingClock(mt *managedTorrent, now time.Time) {
+	if !mt.seedingSince.IsZero() && !mt.pausedAt.IsZero() {
+		// A torrent first seen complete while paused started its clock
+		// then.
+		from := mt.pausedAt
+		if mt.seedingSince.After(from) {
+			from = mt.seedingSince
+		}
+		if paused := now.Sub(from); paused > 0 {
+			mt.seedingSince = mt.seedingSince.Add(paused)
+		}
+	}
+	mt.pausedAt = time.Time{}
+}
+
+func finishedEvent(infoHash string, mt *managedTorrent, reason string) events.Event {
+	return events.Event{
+		Event:    "seeding-finished",
+		InfoHash: infoHash,
+		Name:     mt.t.Name(),
+		Reason:   reason,
+		Uploaded: uploadedLocked(mt),
+	}
+}
@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeSeedingClock(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name         string
+		seedingSince time.Time
+		pausedAt     time.Time
+		resumed      time.Time
+		want         time.Time
+	}{
+		{"paused while seeding", at(0), at(10), at(40), at(30)},
+		{"complete while paused", at(20), at(10), at(40), at(40)},
+		{"never complete", time.Time{}, at(10), at(40), time.Time{}},
+		{"restored from an old session", at(0), time.Time{}, at(40), at(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := &managedTorrent{seedingSince: tt.seedingSince, pausedAt: tt.pausedAt}
+			resumeSeedingClock(mt, tt.resumed)
+			if !mt.seedingSince.Equal(tt.want) {
+				t.Errorf("seedingSince = %v, want %v", mt.seedingSince, tt.want)
+			}
+			if !mt.pausedAt.IsZero() {
+				t.Errorf("pausedAt = %v after resume, want zero", mt.pausedAt)
+			}
+		})
+	}
+}
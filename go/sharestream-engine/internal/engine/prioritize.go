@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Streaming windows ahead of each playhead, in seconds of playback. Pieces
+// in the urgent window are needed before playback can continue; the high
+// window covers what a player buffers after a seek; the normal window keeps
+// a deselected file flowing while it is being watched.
+const (
+	urgentWindow = 2 * time.Second
+	highWindow   = 10 * time.Second
+	normalWindow = 60 * time.Second
+
+	// Used to estimate a file's bitrate until its real duration is known.
+	assumedDuration = 100 * time.Minute
+	minBitrate      = 256 * 1024      // bytes/s, ~2 Mbit/s
+	maxBitrate      = 6 * 1024 * 1024 // bytes/s, ~50 Mbit/s
+)
+
+// prioritizer raises piece priorities in a window ahead of every active
+// stream's read position. Pieces it no longer needs are reset, which lets
+// them fall back to their file's priority.
+type prioritizer struct {
+	t *torrent.Torrent
+
+	mu        sync.Mutex
+	streams   map[*fileStream]struct{}
+	applied   map[int]torrent.PiecePriority
+	durations map[string]time.Duration
+
+	// lastAccess is when a stream was last opened or closed.
+	lastAccess time.Time
+
+	// pin, if set, is given the pieces around every playhead, which
+	// memory storage must keep.
+	pin func(pieces []int)
+}
+
+func newPrioritizer(t *torrent.Torrent) *prioritizer {
+	return &prioritizer{
+		t:         t,
+		streams:   make(map[*fileStream]struct{}),
+		applied:   make(map[int]torrent.PiecePriority),
+		durations: make(map[string]time.Duration),
+	}
+}
+
+// setDuration records a file's playback duration, which sizes its windows
+// from its real bitrate.
+func (p *prioritizer) setDuration(filePath string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.durations[filePath] = d
+	p.updateLocked()
+}
+
+// bitrate estimates a file's bitrate in bytes per second.
+func (p *prioritizer) bitrate(f *torrent.File) int64 {
+	d, ok := p.durations[f.Path()]
+	if !ok || d <= 0 {
+		d = assumedDuration
+	}
+	rate := int64(float64(f.Length()) / d.Seconds())
+	if rate < minBitrate {
+		rate = minBitrate
+	}
+	if rate > maxBitrate {
+		rate = maxBitrate
+	}
+	return rate
+}
+
+// open starts tracking a stream over f read through r.
+func (p *prioritizer) open(f *torrent.File, r torrent.Reader) *fileStream {
+	s := &fileStream{p: p, file: f, reader: r, lastPiece: -1}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.SetResponsive()
+	r.SetReadahead(int64(highWindow.Seconds()) * p.bitrate(f))
+	p.streams[s] = struct{}{}
+	p.lastAccess = time.Now()
+	p.updateLocked()
+	return s
+}
+
+func (p *prioritizer) close(s *fileStream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.streams, s)
+	p.lastAccess = time.Now()
+	p.updateLocked()
+}
+
+// access reports whether any stream is open and when one last opened or
+// closed.
+func (p *prioritizer) access() (streaming bool, last time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.streams) > 0, p.lastAccess
+}
+
+// moved is called when a stream's position changes. Priorities are only
+// recomputed when the stream enters a different piece, or on every seek.
+func (p *prioritizer) moved(s *fileStream, seek bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	piece := s.pieceLocked()
+	if !seek && piece == s.lastPiece {
+		return
+	}
+	s.lastPiece = piece
+	p.updateLocked()
+}
+
+func (p *prioritizer) updateLocked() {
+	info := p.t.Info()
+	if info == nil {
+		return
+	}
+	pieceLength := info.PieceLength
+	numPieces := p.t.NumPieces()
+
+	want := make(map[int]torrent.PiecePriority)
+	var pinned []int
+	raise := func(from, to int64, prio torrent.PiecePriority) {
+		if to <= from {
+			return
+		}
+		first := int(from / pieceLength)
+		last := int((to - 1) / pieceLength)
+		for i := first; i <= last && i < numPieces; i++ {
+			if want[i] < prio {
+				want[i] = prio
+			}
+		}
+	}
+
+	for s := range p.streams {
+		f := s.file
+		rate := p.bitrate(f)
+		start := f.Offset() + s.pos
+		end := f.Offset() + f.Length()
+		clamp := func(off int64) int64 {
+			if off > end {
+				return end
+			}
+			return off
+		}
+		urgent := clamp(start + int64(urgentWindow.Seconds())*rate)
+		if urgent < clamp(start+pieceLength) {
+			urgent = clamp(start + pieceLength)
+		}
+		high := clamp(start + int64(highWindow.Seconds())*rate)
+		normal := clamp(start + int64(normalWindow.Seconds())*rate)
+
+		raise(start, urgent, torrent.PiecePriorityNow)
+		raise(urgent, high, torrent.PiecePriorityHigh)
+		raise(high, normal, torrent.PiecePriorityNormal)
+
+		if p.pin != nil {
+			// Keep a little behind the playhead too, for players that
+			// re-read what they just played.
+			behind := max(start-int64(urgentWindow.Seconds())*rate, f.Offset())
+			for i := int(behind / pieceLength); i <= int((normal-1)/pieceLength) && i < numPieces; i++ {
+				pinned = append(pinned, i)
+			}
+		}
+	}
+	if p.pin != nil {
+		p.pin(pinned)
+	}
+
+	for i := range p.applied {
+		if _, ok := want[i]; !ok {
+			p.t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+			delete(p.applied, i)
+		}
+	}
+	for i, prio := range want {
+		if p.applied[i] != prio {
+			p.t.Piece(i).SetPriority(prio)
+			p.applied[i] = prio
+		}
+	}
+}
+
+// fileStream is a reader over a torrent file whose read position drives
+// the torrent's piece priorities.
+type fileStream struct {
+	p      *prioritizer
+	file   *torrent.File
+	reader torrent.Reader
+
+	// Guarded by p.mu.
+	pos       int64
+	lastPiece int
+}
+
+func (s *fileStream) pieceLocked() int {
+	info := s.p.t.Info()
+	if info == nil || info.PieceLength == 0 {
+		return 0
+	}
+	return int((s.file.Offset() + s.pos) / info.PieceLength)
+}
+
+func (s *fileStream) Read(b []byte) (int, error) {
+	n, err := s.reader.Read(b)
+	if n > 0 {
+		s.p.mu.Lock()
+		s.pos += int64(n)
+		s.p.mu.Unlock()
+		s.p.moved(s, false)
+	}
+	return n, err
+}
+
+func (s *fileStream) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.reader.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	s.p.mu.Lock()
+	s.pos = pos
+	s.p.mu.Unlock()
+	s.p.moved(s, true)
+	return pos, nil
+}
+
+func (s *fileStream) Close() error {
+	s.p.close(s)
+	return s.reader.Close()
+}
+
+var _ io.ReadSeekCloser = (*fileStream)(nil)
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"sharestream-engine/internal/media"
+)
+
+// ProbeFile reads a file's container metadata. Only the pieces holding the
+// headers are fetched; see sparseReader. An empty filePath probes
+// the torrent's largest file. Results are cached, and a known duration is
+// passed on to the prioritizer as with SetFileDuration.
+func (e *TorrentEngine) ProbeFile(ctx context.Context, infoHash, filePath string) (*media.Info, error) {
+	mt, file, err := e.lookupFile(ctx, infoHash, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	cached := mt.probes[file.Path()]
+	e.mu.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	r := sparseReader(ctx, file)
+	defer r.Close()
+
+	start := time.Now()
+	info, err := media.Probe(r, file.Length())
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s: %w", file.Path(), err)
+	}
+	e.logger.Debug("probed file", "infoHash", infoHash, "file", file.Path(), "container", info.Container, "duration", info.Duration, "took", time.Since(start))
+
+	e.mu.Lock()
+	if mt.probes == nil {
+		mt.probes = make(map[string]*media.Info)
+	}
+	mt.probes[file.Path()] = info
+	e.mu.Unlock()
+
+	if info.Duration > 0 {
+		mt.prio.setDuration(file.Path(), time.Duration(info.Duration*float64(time.Second)))
+	}
+	return info, nil
+}
+
+// lookupFile waits for a torrent's info and returns one of its files. An
+// empty filePath selects the largest file.
+func (e *TorrentEngine) lookupFile(ctx context.Context, infoHash, filePath string) (*managedTorrent, *torrent.File, error) {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrTorrentNotFound
+	}
+
+	if err := e.waitInfo(ctx, mt); err != nil {
+		return nil, nil, err
+	}
+
+	var file *torrent.File
+	for _, f := range mt.t.Files() {
+		if f.Path() == filePath || (filePath == "" && (file == nil || f.Length() > file.Length())) {
+			file = f
+		}
+	}
+	if file == nil {
+		return nil, nil, ErrFileNotFound
+	}
+	return mt, file, nil
+}
+
+// sparseReader opens a reader that fetches only the pieces it reads, for
+// parsers that seek around a file. Unlike ReadFile's readers it has no
+// readahead and isn't tracked by the prioritizer, so it raises no
+// streaming window. Reads fail once ctx is done.
+func sparseReader(ctx context.Context, f *torrent.File) torrent.Reader {
+	r := f.NewReader()
+	r.SetContext(ctx)
+	r.SetResponsive()
+	r.SetReadahead(0)
+	return r
+}
@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"sharestream-engine/internal/events"
+	"sharestream-engine/internal/quota"
+)
+
+// quotaInterval is how often the data directory is checked against its
+// quota.
+const quotaInterval = 10 * time.Second
+
+// DiskUsage reports the space downloads take in the data directory against
+// its quota. Seeds are read from where they are and ephemeral torrents are
+// held in memory, so neither is counted. Only complete downloads nobody is
+// streaming, verifying or connected to, and that no room is sharing, may
+// be evicted, along with the data of every dropped download.
+func (e *TorrentEngine) DiskUsage() quota.Usage {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.usageLocked()
+}
+
+// usageLocked is DiskUsage with e.mu held, ordered by name.
+func (e *TorrentEngine) usageLocked() quota.Usage {
+	u := quota.Usage{Quota: e.quota, Torrents: []quota.Torrent{}}
+	for infoHash, mt := range e.torrents {
+		if mt.seedPath != "" || mt.ephemeral {
+			continue
+		}
+		streaming, _ := mt.prio.access()
+		t := quota.Torrent{
+			InfoHash:   infoHash,
+			Name:       mt.t.Name(),
+			LastAccess: lastAccessLocked(mt),
+		}
+		if mt.t.Info() != nil {
+			t.Bytes = mt.t.BytesCompleted()
+			t.Evictable = mt.t.Complete().Bool() && !streaming && !mt.verifying &&
+				mt.t.Stats().ActivePeers == 0 && mt.policy.Room == ""
+		}
+		u.Used += t.Bytes
+		u.Torrents = append(u.Torrents, t)
+	}
+	for infoHash, d := range e.dropped {
+		u.Used += d.Bytes
+		u.Torrents = append(u.Torrents, quota.Torrent{
+			InfoHash:   infoHash,
+			Name:       d.Name,
+			Bytes:      d.Bytes,
+			LastAccess: d.LastAccess,
+			Evictable:  true,
+			Dropped:    true,
+		})
+	}
+	sort.Slice(u.Torrents, func(i, j int) bool {
+		a, b := u.Torrents[i], u.Torrents[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.InfoHash < b.InfoHash
+	})
+	return u
+}
+
+// lastAccessLocked returns when mt was last streamed, or added if it never
+// was.
+func lastAccessLocked(mt *managedTorrent) time.Time {
+	if _, last := mt.prio.access(); last.After(mt.lastAccess) {
+		return last
+	}
+	return mt.lastAccess
+}
+
+// droppedData is what a download dropped from the session left in the data
+// directory: stopping a torrent, or its seeding policy finishing, keeps its
+// files. It is kept in the session until enforceQuota evicts it or the
+// torrent is added again.
+type droppedData struct {
+	Name       string    `json:"name"`
+	Bytes      int64     `json:"bytes"`
+	LastAccess time.Time `json:"lastAccess"`
+	NumPieces  int       `json:"numPieces"`
+	Paths      []string  `json:"paths"`
+}
+
+// keepDroppedLocked records the data mt leaves in the data directory when
+// it is dropped. The caller must hold e.mu for writing.
+func (e *TorrentEngine) keepDroppedLocked(infoHash string, mt *managedTorrent) {
+	if mt.seedPath != "" || mt.ephemeral || mt.t.Info() == nil {
+		return
+	}
+	d := droppedData{
+		Name:       mt.t.Name(),
+		Bytes:      mt.t.BytesCompleted(),
+		LastAccess: lastAccessLocked(mt),
+		NumPieces:  mt.t.NumPieces(),
+	}
+	if d.Bytes == 0 {
+		return
+	}
+	for _, f := range mt.t.Files() {
+		d.Paths = append(d.Paths, f.Path())
+	}
+	e.dropped[infoHash] = d
+}
+
+// restoreDropped keeps the dropped downloads of the previous session whose
+// files are still there.
+func (e *TorrentEngine) restoreDropped(dropped map[string]droppedData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for infoHash, d := range dropped {
+		if _, ok := e.torrents[infoHash]; ok {
+			continue
+		}
+		if b, err := hex.DecodeString(infoHash); err != nil || len(b) != metainfo.HashSize {
+			continue
+		}
+		for _, p := range d.Paths {
+			rel := filepath.FromSlash(p)
+			if !filepath.IsLocal(rel) {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(e.dataDir, rel)); err == nil {
+				e.dropped[infoHash] = d
+				break
+			}
+		}
+	}
+}
+
+// evictedTorrent is what enforceQuota needs to delete a dropped torrent's
+// data.
+type evictedTorrent struct {
+	quota.Torrent
+	ih        metainfo.Hash
+	numPieces int
+	paths     []string
+}
+
+// enforceQuota evicts completed, idle downloads, least recently watched
+// first, until the data directory is within its quota. Their data is
+// deleted, and each is reported with an "evicted" event.
+func (e *TorrentEngine) enforceQuota() {
+	if e.quota <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	var evicted []evictedTorrent
+	for _, v := range e.usageLocked().Victims() {
+		if d, ok := e.dropped[v.InfoHash]; ok {
+			delete(e.dropped, v.InfoHash)
+			e.requestSave()
+			evicted = append(evicted, evictedTorrent{
+				Torrent:   v,
+				ih:        metainfo.NewHashFromHex(v.InfoHash),
+				numPieces: d.NumPieces,
+				paths:     d.Paths,
+			})
+			continue
+		}
+		mt := e.torrents[v.InfoHash]
+		ev := evictedTorrent{Torrent: v, ih: mt.t.InfoHash(), numPieces: mt.t.NumPieces()}
+		for _, f := range mt.t.Files() {
+			ev.paths = append(ev.paths, f.Path())
+		}
+		e.dropLocked(v.InfoHash, mt)
+		delete(e.dropped, v.InfoHash)
+		evicted = append(evicted, ev)
+	}
+	// Torrents can share a name; never delete files another one still uses.
+	inUse := make(map[string]bool)
+	if len(evicted) > 0 {
+		for _, mt := range e.torrents {
+			if mt.seedPath != "" || mt.ephemeral || mt.t.Info() == nil {
+				continue
+			}
+			for _, f := range mt.t.Files() {
+				inUse[f.Path()] = true
+			}
+		}
+		for _, d := range e.dropped {
+			for _, p := range d.Paths {
+				inUse[p] = true
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	for _, ev := range evicted {
+		e.logger.Info("evicting torrent", "infoHash", ev.InfoHash, "bytes", ev.Bytes, "lastAccess", ev.LastAccess)
+		e.removeData(ev, inUse)
+		e.events.Publish(events.Event{
+			Event:    "evicted",
+			InfoHash: ev.InfoHash,
+			Name:     ev.Name,
+			Bytes:    ev.Bytes,
+		})
+	}
+}
+
+// removeData deletes an evicted torrent's files and any directories left
+// empty, and forgets its piece completion so it downloads afresh if it is
+// added again.
+func (e *TorrentEngine) removeData(ev evictedTorrent, inUse map[string]bool) {
+	for _, p := range ev.paths {
+		rel := filepath.FromSlash(p)
+		if inUse[p] || !filepath.IsLocal(rel) {
+			continue
+		}
+		path := filepath.Join(e.dataDir, rel)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			e.logger.Warn("failed to remove evicted file", "path", path, "error", err)
+			continue
+		}
+		for dir := filepath.Dir(path); dir != e.dataDir; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	for i := 0; i < ev.numPieces; i++ {
+		if err := e.pieceCompletion.Set(metainfo.PieceKey{InfoHash: ev.ih, Index: i}, false); err != nil {
+			e.logger.Warn("failed to reset piece completion", "infoHash", ev.InfoHash, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sharestream-engine/internal/events"
+)
+
+const (
+	droppedHash = "0123456789abcdef0123456789abcdef01234567"
+	otherHash   = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+func writeDataFile(t *testing.T, dataDir, path string) {
+	t.Helper()
+	full := filepath.Join(dataDir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnforceQuotaEvictsDroppedData(t *testing.T) {
+	dataDir := t.TempDir()
+	writeDataFile(t, dataDir, "Old Movie/movie.mkv")
+	writeDataFile(t, dataDir, "New Movie/movie.mkv")
+
+	bus := events.NewBus()
+	sub := bus.Subscribe(4, nil)
+	defer sub.Close()
+	e := &TorrentEngine{
+		dataDir:  dataDir,
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events:   bus,
+		torrents: make(map[string]*managedTorrent),
+		quota:    150,
+		dropped: map[string]droppedData{
+			droppedHash: {Name: "Old Movie", Bytes: 100, LastAccess: time.Unix(1000, 0), Paths: []string{"Old Movie/movie.mkv"}},
+			otherHash:   {Name: "New Movie", Bytes: 100, LastAccess: time.Unix(2000, 0), Paths: []string{"New Movie/movie.mkv"}},
+		},
+	}
+
+	u := e.DiskUsage()
+	if u.Used != 200 || len(u.Torrents) != 2 || !u.Torrents[0].Dropped || !u.Torrents[0].Evictable {
+		t.Fatalf("usage = %+v, want both dropped torrents counted and evictable", u)
+	}
+
+	e.enforceQuota()
+	if _, ok := e.dropped[droppedHash]; ok {
+		t.Error("least recently watched dropped data still recorded")
+	}
+	if _, ok := e.dropped[otherHash]; !ok {
+		t.Error("dropped data evicted beyond the quota")
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "Old Movie")); !os.IsNotExist(err) {
+		t.Errorf("evicted data left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "New Movie", "movie.mkv")); err != nil {
+		t.Errorf("kept data removed: %v", err)
+	}
+	select {
+	case ev := <-sub.C:
+		if ev.Event != "evicted" || ev.InfoHash != droppedHash || ev.Bytes != 100 {
+			t.Errorf("event = %+v, want evicted %s", ev, droppedHash)
+		}
+	default:
+		t.Error("no evicted event")
+	}
+}
+
+func TestRestoreDropped(t *testing.T) {
+	dataDir := t.TempDir()
+	writeDataFile(t, dataDir, "Movie/movie.mkv")
+
+	e := &TorrentEngine{
+		dataDir:  dataDir,
+		torrents: make(map[string]*managedTorrent),
+		dropped:  make(map[string]droppedData),
+	}
+	e.restoreDropped(map[string]droppedData{
+		droppedHash:  {Name: "Movie", Bytes: 4, Paths: []string{"Missing/a.mkv", "Movie/movie.mkv"}},
+		otherHash:    {Name: "Gone", Bytes: 4, Paths: []string{"Gone/movie.mkv"}},
+		"not-a-hash": {Name: "Movie", Bytes: 4, Paths: []string{"Movie/movie.mkv"}},
+	})
+	if len(e.dropped) != 1 {
+		t.Fatalf("restored %v, want only %s", e.dropped, droppedHash)
+	}
+	if _, ok := e.dropped[droppedHash]; !ok {
+		t.Fatalf("restored %v, want %s", e.dropped, droppedHash)
+	}
+}
@@ -0,0 +1,298 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"sharestream-engine/internal/ratelimit"
+)
+
+// The session lives in <dataDir>/session: session.json lists the torrents
+// and <infoHash>.torrent holds each torrent's metainfo once it is known.
+// Piece completion is already kept by the client in <dataDir>/.torrent.db,
+// so restored torrents resume without re-hashing their data. dropped lists
+// the data dropped torrents left behind, for the quota.
+const (
+	sessionDirName  = "session"
+	sessionFileName = "session.json"
+)
+
+type sessionFile struct {
+	Torrents []sessionEntry         `json:"torrents"`
+	Dropped  map[string]droppedData `json:"dropped,omitempty"`
+}
+
+type sessionEntry struct {
+	InfoHash    string    `json:"infoHash"`
+	Magnet      string    `json:"magnet,omitempty"`
+	Trackers    []string  `json:"trackers,omitempty"`
+	SeedPath    string    `json:"seedPath,omitempty"`
+	SeedSize    int64     `json:"seedSize,omitempty"`
+	SeedModTime time.Time `json:"seedModTime,omitzero"`
+	Files       []string  `json:"files,omitempty"`
+	Paused      bool      `json:"paused,omitempty"`
+
+	Limits ratelimit.Limits `json:"limits,omitzero"`
+
+	Policy       SeedPolicy `json:"policy,omitzero"`
+	SeedingSince time.Time  `json:"seedingSince,omitzero"`
+	PausedAt     time.Time  `json:"pausedAt,omitzero"`
+	Uploaded     int64      `json:"uploaded,omitempty"`
+	LastAccess   time.Time  `json:"lastAccess,omitzero"`
+}
+
+func (e *TorrentEngine) sessionDir() string {
+	return filepath.Join(e.dataDir, sessionDirName)
+}
+
+func (e *TorrentEngine) metainfoPath(infoHash string) string {
+	return filepath.Join(e.sessionDir(), infoHash+".torrent")
+}
+
+// requestSave asks the saver to write the session. Requests made while a
+// save is pending are folded into it, so callers never wait on the disk.
+func (e *TorrentEngine) requestSave() {
+	select {
+	case e.saveReq <- struct{}{}:
+	default:
+	}
+}
+
+// saver is the single writer behind requestSave. It runs until the engine
+// is closed; Close then writes the final session itself.
+func (e *TorrentEngine) saver() {
+	defer close(e.saverDone)
+	for {
+		select {
+		case <-e.saveReq:
+			e.saveSession()
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+// saveSession writes the current torrent list to disk. Writes are
+// serialized and each one snapshots the latest state, so the file on disk
+// never goes backwards.
+func (e *TorrentEngine) saveSession() {
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+
+	e.mu.RLock()
+	sf := sessionFile{Torrents: make([]sessionEntry, 0, len(e.torrents)), Dropped: maps.Clone(e.dropped)}
+	for infoHash, mt := range e.torrents {
+		if mt.ephemeral {
+			continue
+		}
+		sf.Torrents = append(sf.Torrents, sessionEntry{
+			InfoHash:    infoHash,
+			Magnet:      mt.magnet,
+			Trackers:    mt.trackers,
+			SeedPath:    mt.seedPath,
+			SeedSize:    mt.seedSize,
+			SeedModTime: mt.seedModTime,
+			Files:       mt.files,
+			Paused:      mt.paused,
+			Limits:      mt.limits,
+
+			Policy:       mt.policy,
+			SeedingSince: mt.seedingSince,
+			PausedAt:     mt.pausedAt,
+			Uploaded:     uploadedLocked(mt),
+			LastAccess:   lastAccessLocked(mt),
+		})
+	}
+	e.mu.RUnlock()
+
+	sort.Slice(sf.Torrents, func(i, j int) bool {
+		return sf.Torrents[i].InfoHash < sf.Torrents[j].InfoHash
+	})
+
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		e.logger.Error("failed to marshal session", "error", err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(e.sessionDir(), sessionFileName), b); err != nil {
+		e.logger.Error("failed to save session", "error", err)
+	}
+}
+
+// saveMetainfo stores t's metainfo alongside the session file.
+func (e *TorrentEngine) saveMetainfo(infoHash string, t *torrent.Torrent) error {
+	path := e.metainfoPath(infoHash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	mi := t.Metainfo()
+	f, err := os.CreateTemp(e.sessionDir(), infoHash+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create metainfo file: %w", err)
+	}
+	if err := mi.Write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write metainfo: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write metainfo: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (e *TorrentEngine) forgetMetainfo(infoHash string) {
+	if err := os.Remove(e.metainfoPath(infoHash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		e.logger.Warn("failed to remove metainfo", "infoHash", infoHash, "error", err)
+	}
+}
+
+// restoreSession re-adds every torrent from the previous run. Entries that
+// can't be restored are logged and skipped rather than failing startup.
+func (e *TorrentEngine) restoreSession() {
+	if err := os.MkdirAll(e.sessionDir(), 0755); err != nil {
+		e.logger.Error("failed to create session dir", "error", err)
+		return
+	}
+
+	b, err := os.ReadFile(filepath.Join(e.sessionDir(), sessionFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			e.logger.Error("failed to read session", "error", err)
+		}
+		return
+	}
+
+	var sf sessionFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		e.logger.Error("failed to parse session", "error", err)
+		return
+	}
+
+	for _, entry := range sf.Torrents {
+		if err := e.restoreEntry(entry); err != nil {
+			e.logger.Warn("failed to restore torrent", "infoHash", entry.InfoHash, "error", err)
+			continue
+		}
+		e.restored = append(e.restored, entry.InfoHash)
+		e.logger.Info("restored torrent", "infoHash", entry.InfoHash)
+	}
+	e.restoreDropped(sf.Dropped)
+}
+
+func (e *TorrentEngine) restoreEntry(entry sessionEntry) error {
+	if entry.SeedPath != "" {
+		return e.restoreSeed(entry)
+	}
+
+	var spec *torrent.TorrentSpec
+	mi, err := metainfo.LoadFromFile(e.metainfoPath(entry.InfoHash))
+	switch {
+	case err == nil:
+		spec, err = torrent.TorrentSpecFromMetaInfoErr(mi)
+	case errors.Is(err, os.ErrNotExist) && entry.Magnet != "":
+		// Metadata never arrived last time; start over from the magnet.
+		spec, err = torrent.TorrentSpecFromMagnetUri(entry.Magnet)
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("no metainfo or magnet to restore from")
+	}
+	if err != nil {
+		return err
+	}
+	announce, err := e.mergeTrackers(entry.Trackers)
+	if err != nil {
+		return err
+	}
+	spec.Trackers = append(spec.Trackers, announceList(announce)...)
+
+	t, err := e.addSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	infoHash := e.track(&managedTorrent{
+		t:        t,
+		magnet:   entry.Magnet,
+		trackers: entry.Trackers,
+		files:    entry.Files,
+		limits:   entry.Limits,
+
+		policy:       entry.Policy,
+		seedingSince: entry.SeedingSince,
+		pausedAt:     entry.PausedAt,
+		uploaded:     entry.Uploaded,
+		lastAccess:   entry.LastAccess,
+	})
+	if entry.Paused {
+		return e.PauseTorrent(infoHash)
+	}
+	return nil
+}
+
+// restoreSeed re-adds a seeded torrent in place. If the file changed since
+// it was last seen, its pieces are verified again before they are trusted.
+func (e *TorrentEngine) restoreSeed(entry sessionEntry) error {
+	fi, err := os.Stat(entry.SeedPath)
+	if err != nil {
+		return fmt.Errorf("seed file unavailable: %w", err)
+	}
+	mi, err := metainfo.LoadFromFile(e.metainfoPath(entry.InfoHash))
+	if err != nil {
+		return fmt.Errorf("failed to load metainfo: %w", err)
+	}
+	t, err := e.addSeed(mi, entry.SeedPath)
+	if err != nil {
+		return err
+	}
+
+	infoHash := e.track(&managedTorrent{
+		t:           t,
+		trackers:    entry.Trackers,
+		seedPath:    entry.SeedPath,
+		seedSize:    fi.Size(),
+		seedModTime: fi.ModTime(),
+		files:       entry.Files,
+		limits:      entry.Limits,
+
+		policy:       entry.Policy,
+		seedingSince: entry.SeedingSince,
+		pausedAt:     entry.PausedAt,
+		uploaded:     entry.Uploaded,
+		lastAccess:   entry.LastAccess,
+	})
+
+	if fi.Size() != entry.SeedSize || !fi.ModTime().Equal(entry.SeedModTime) {
+		e.logger.Info("seed file changed since last run", "infoHash", infoHash, "path", entry.SeedPath)
+		if err := e.VerifyTorrent(infoHash); err != nil {
+			return err
+		}
+	}
+	if entry.Paused {
+		return e.PauseTorrent(infoHash)
+	}
+	return nil
+}
+
+// RestoredTorrents returns the info hashes restored from the previous
+// session when the engine was created.
+func (e *TorrentEngine) RestoredTorrents() []string {
+	return append([]string(nil), e.restored...)
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"sharestream-engine/internal/media"
+	"sharestream-engine/internal/subtitles"
+)
+
+// TorrentDetail is a torrent's status and metadata. Until the metadata has
+// arrived only the embedded Info, SeedPolicy, Uploaded and Storage are
+// filled in.
+type TorrentDetail struct {
+	Info
+	HasMetadata  bool                `json:"hasMetadata"`
+	TotalBytes   int64               `json:"totalBytes"`
+	BytesDone    int64               `json:"bytesDone"`
+	BytesMissing int64               `json:"bytesMissing"`
+	NumPieces    int                 `json:"numPieces"`
+	PieceLength  int64               `json:"pieceLength"`
+	Seeding      bool                `json:"seeding"`
+	Files        []FileDetail        `json:"files"`
+	Subtitles    []subtitles.Sidecar `json:"subtitles"`
+	SeedPolicy   SeedPolicy          `json:"seedPolicy"`
+	Uploaded     int64               `json:"uploaded"`
+	// Storage is StorageFile or StorageMemory; MemoryBytes is what a
+	// StorageMemory torrent holds.
+	Storage     string `json:"storage"`
+	MemoryBytes int64  `json:"memoryBytes,omitempty"`
+}
+
+// FileDetail describes one file of a torrent.
+type FileDetail struct {
+	Index     int     `json:"index"`
+	Path      string  `json:"path"`
+	Length    int64   `json:"length"`
+	Offset    int64   `json:"offset"`
+	Completed int64   `json:"completed"`
+	Progress  float64 `json:"progress"`
+	Priority  string  `json:"priority"`
+	Selected  bool    `json:"selected"`
+
+	// Media is the file's probe result, if it has been probed.
+	Media *media.Info `json:"media,omitempty"`
+}
+
+// TorrentStats are a torrent's swarm and transfer counters.
+type TorrentStats struct {
+	ActivePeers      int   `json:"activePeers"`
+	TotalPeers       int   `json:"totalPeers"`
+	PendingPeers     int   `json:"pendingPeers"`
+	HalfOpenPeers    int   `json:"halfOpenPeers"`
+	ConnectedSeeders int   `json:"connectedSeeders"`
+	PiecesComplete   int   `json:"piecesComplete"`
+	BytesRead        int64 `json:"bytesRead"`
+	BytesWritten     int64 `json:"bytesWritten"`
+	BytesReadData    int64 `json:"bytesReadData"`
+	BytesWrittenData int64 `json:"bytesWrittenData"`
+	Speed            int   `json:"speed"`
+}
+
+// PieceMap summarises the state of a torrent's pieces as runs of
+// consecutive pieces in the same state.
+type PieceMap struct {
+	NumPieces   int        `json:"numPieces"`
+	PieceLength int64      `json:"pieceLength"`
+	Complete    int        `json:"complete"`
+	Runs        []PieceRun `json:"runs"`
+}
+
+// PieceRun is Length consecutive pieces sharing a state.
+type PieceRun struct {
+	Length   int    `json:"length"`
+	Complete bool   `json:"complete"`
+	Partial  bool   `json:"partial"`
+	Checking bool   `json:"checking"`
+	Priority string `json:"priority"`
+}
+
+var priorityNames = map[torrent.PiecePriority]string{
+	torrent.PiecePriorityNone:      "none",
+	torrent.PiecePriorityNormal:    "normal",
+	torrent.PiecePriorityHigh:      "high",
+	torrent.PiecePriorityReadahead: "readahead",
+	torrent.PiecePriorityNext:      "next",
+	torrent.PiecePriorityNow:       "now",
+}
+
+func priorityName(p torrent.PiecePriority) string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprint(int(p))
+}
+
+// GetTorrentInfo reports a torrent's status and, once its metadata has
+// arrived, its files and matched subtitles. It doesn't wait for metadata.
+func (e *TorrentEngine) GetTorrentInfo(infoHash string) (TorrentDetail, error) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return TorrentDetail{}, ErrTorrentNotFound
+	}
+	detail := TorrentDetail{
+		Info:       e.infoLocked(infoHash, mt, time.Now()),
+		SeedPolicy: mt.policy,
+		Uploaded:   uploadedLocked(mt),
+		Storage:    StorageFile,
+	}
+	if mt.ephemeral {
+		detail.Storage = StorageMemory
+		detail.MemoryBytes = e.memory.Used(mt.t.InfoHash())
+	}
+	e.mu.Unlock()
+
+	t := mt.t
+	info := t.Info()
+	if info == nil {
+		return detail, nil
+	}
+	detail.HasMetadata = true
+	detail.TotalBytes = t.Length()
+	detail.BytesDone = t.BytesCompleted()
+	detail.BytesMissing = t.BytesMissing()
+	detail.NumPieces = t.NumPieces()
+	detail.PieceLength = info.PieceLength
+	detail.Seeding = t.Seeding()
+
+	files, err := e.GetFiles(infoHash)
+	if err != nil {
+		return TorrentDetail{}, err
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	detail.Files = files
+	detail.Subtitles = subtitles.Match(paths)
+	return detail, nil
+}
+
+// GetFiles describes the files of a torrent, in torrent order. It returns
+// no files until the metadata has arrived.
+func (e *TorrentEngine) GetFiles(infoHash string) ([]FileDetail, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return nil, ErrTorrentNotFound
+	}
+	if mt.t.Info() == nil {
+		return []FileDetail{}, nil
+	}
+
+	files := mt.t.Files()
+	details := make([]FileDetail, len(files))
+	for i, f := range files {
+		details[i] = fileDetail(mt, i, f)
+	}
+	return details, nil
+}
+
+// GetFile describes a single file of a torrent.
+func (e *TorrentEngine) GetFile(infoHash, filePath string) (FileDetail, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return FileDetail{}, ErrTorrentNotFound
+	}
+	if mt.t.Info() == nil {
+		return FileDetail{}, ErrFileNotFound
+	}
+	for i, f := range mt.t.Files() {
+		if f.Path() == filePath {
+			return fileDetail(mt, i, f), nil
+		}
+	}
+	return FileDetail{}, ErrFileNotFound
+}
+
+// fileDetail describes f, the i'th file of mt. The caller must hold e.mu.
+func fileDetail(mt *managedTorrent, i int, f *torrent.File) FileDetail {
+	d := FileDetail{
+		Index:     i,
+		Path:      f.Path(),
+		Length:    f.Length(),
+		Offset:    f.Offset(),
+		Completed: f.BytesCompleted(),
+		Priority:  priorityName(f.Priority()),
+		Selected:  f.Priority() != torrent.PiecePriorityNone,
+		Media:     mt.probes[f.Path()],
+	}
+	if d.Length > 0 {
+		d.Progress = float64(d.Completed) / float64(d.Length)
+	} else {
+		d.Progress = 1
+	}
+	return d
+}
+
+// GetTorrentStats reports a torrent's swarm and transfer counters.
+func (e *TorrentEngine) GetTorrentStats(infoHash string) (TorrentStats, error) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return TorrentStats{}, ErrTorrentNotFound
+	}
+	speed := e.infoLocked(infoHash, mt, time.Now()).Speed
+	e.mu.Unlock()
+
+	stats := mt.t.Stats()
+	return TorrentStats{
+		ActivePeers:      stats.ActivePeers,
+		TotalPeers:       stats.TotalPeers,
+		PendingPeers:     stats.PendingPeers,
+		HalfOpenPeers:    stats.HalfOpenPeers,
+		ConnectedSeeders: stats.ConnectedSeeders,
+		PiecesComplete:   stats.PiecesComplete,
+		BytesRead:        stats.BytesRead.Int64(),
+		BytesWritten:     stats.BytesWritten.Int64(),
+		BytesReadData:    stats.BytesReadData.Int64(),
+		BytesWrittenData: stats.BytesWrittenData.Int64(),
+		Speed:            speed,
+	}, nil
+}
+
+// GetPeers describes a torrent's connected peers, ordered by address.
+func (e *TorrentEngine) GetPeers(infoHash string) ([]PeerDetail, error) {
+	t := e.GetTorrent(infoHash)
+	if t == nil {
+		return nil, ErrTorrentNotFound
+	}
+
+	conns := t.PeerConns()
+	peers := make([]PeerDetail, 0, len(conns))
+	for _, pc := range conns {
+		stats := pc.Stats()
+		wire := e.wire.get(pc)
+		addr := pc.RemoteAddr.String()
+		p := PeerDetail{
+			Address:      addr,
+			Network:      pc.Network,
+			Transport:    peerTransport(pc.Network),
+			Encryption:   peerEncryption(pc),
+			Source:       string(pc.Discovery),
+			DownloadRate: stats.DownloadRate,
+			UploadRate:   stats.LastWriteUploadRate,
+			Pieces:       int(pc.PeerPieces().GetCardinality()),
+			Choked:       !wire.unchoked,
+			Interested:   wire.interested,
+			RoomMember:   e.roomMember(addr),
+		}
+		if name, ok := pc.PeerClientName.Load().(string); ok {
+			p.Client = name
+		}
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers, nil
+}
+
+// GetPieces summarises the state of a torrent's pieces. It is empty until
+// the metadata has arrived.
+func (e *TorrentEngine) GetPieces(infoHash string) (PieceMap, error) {
+	t := e.GetTorrent(infoHash)
+	if t == nil {
+		return PieceMap{}, ErrTorrentNotFound
+	}
+	pm := PieceMap{Runs: []PieceRun{}}
+	info := t.Info()
+	if info == nil {
+		return pm, nil
+	}
+	pm.NumPieces = t.NumPieces()
+	pm.PieceLength = info.PieceLength
+
+	for i := 0; i < pm.NumPieces; i++ {
+		ps := t.PieceState(i)
+		run := PieceRun{
+			Length:   1,
+			Complete: ps.Completion.Complete,
+			Partial:  ps.Partial,
+			Checking: ps.Checking,
+			Priority: priorityName(ps.Priority),
+		}
+		if run.Complete {
+			pm.Complete++
+		}
+		if n := len(pm.Runs); n > 0 {
+			last := &pm.Runs[n-1]
+			if last.Complete == run.Complete && last.Partial == run.Partial &&
+				last.Checking == run.Checking && last.Priority == run.Priority {
+				last.Length++
+				continue
+			}
+		}
+		pm.Runs = append(pm.Runs, run)
+	}
+	return pm, nil
+}
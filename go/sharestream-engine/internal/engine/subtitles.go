@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"sharestream-engine/internal/media"
+	"sharestream-engine/internal/subtitles"
+)
+
+// maxSubtitleSize bounds how much of a sidecar subtitle file is read.
+const maxSubtitleSize = 16 << 20
+
+// ReadSubtitle reads and parses a sidecar subtitle file. It is fetched
+// through ReadFile, so it downloads even if its file isn't selected.
+func (e *TorrentEngine) ReadSubtitle(ctx context.Context, infoHash, filePath string) ([]subtitles.Cue, error) {
+	format := subtitles.Format(filePath)
+	if format == "" {
+		return nil, fmt.Errorf("not a subtitle file")
+	}
+	r, err := e.ReadFile(ctx, infoHash, filePath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, maxSubtitleSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subtitle: %w", err)
+	}
+	return subtitles.Parse(data, format)
+}
+
+// ReadEmbeddedSubtitles passes the cues of a text subtitle track embedded in
+// a Matroska or MP4 file to fn, each as soon as its data has downloaded.
+// Only the pieces holding subtitle data are fetched where the container
+// indexes them; see media.ReadSubtitles.
+func (e *TorrentEngine) ReadEmbeddedSubtitles(ctx context.Context, infoHash, filePath string, trackID int, fn func(subtitles.Cue) error) error {
+	info, err := e.ProbeFile(ctx, infoHash, filePath)
+	if err != nil {
+		return err
+	}
+	var track *media.Track
+	for i := range info.Tracks {
+		if info.Tracks[i].ID == trackID && info.Tracks[i].Type == "subtitle" {
+			track = &info.Tracks[i]
+		}
+	}
+	if track == nil {
+		return fmt.Errorf("subtitle track %d not found", trackID)
+	}
+	if !subtitles.Embedded(track.CodecID) {
+		return fmt.Errorf("subtitle track %d is not text (%s)", trackID, track.Codec)
+	}
+
+	_, file, err := e.lookupFile(ctx, infoHash, filePath)
+	if err != nil {
+		return err
+	}
+	r := sparseReader(ctx, file)
+	defer r.Close()
+
+	return media.ReadSubtitles(r, file.Length(), trackID, func(s media.Sample) error {
+		return fn(subtitles.Cue{
+			Start: s.Start,
+			End:   s.End,
+			Text:  subtitles.SampleText(track.CodecID, s.Data),
+		})
+	})
+}
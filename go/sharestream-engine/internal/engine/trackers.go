@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultTrackers is the engine-wide announce list used when Config.Trackers
+// is nil.
+var DefaultTrackers = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"udp://tracker.openbittorrent.com:6969/announce",
+}
+
+// ParseTrackers splits a comma separated tracker list, dropping blanks.
+func ParseTrackers(s string) []string {
+	var trackers []string
+	for _, tr := range strings.Split(s, ",") {
+		if tr = strings.TrimSpace(tr); tr != "" {
+			trackers = append(trackers, tr)
+		}
+	}
+	return trackers
+}
+
+// validateTracker accepts HTTP(S), UDP and WebSocket announce URLs.
+func validateTracker(tr string) error {
+	u, err := url.Parse(tr)
+	if err != nil {
+		return fmt.Errorf("invalid tracker URL %q: %w", tr, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp", "ws", "wss":
+	default:
+		return fmt.Errorf("invalid tracker URL %q: unsupported scheme %q", tr, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid tracker URL %q: missing host", tr)
+	}
+	return nil
+}
+
+// mergeTrackers validates trackers and returns them ahead of the engine's
+// defaults, without duplicates.
+func (e *TorrentEngine) mergeTrackers(trackers []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, list := range [][]string{trackers, e.trackers} {
+		for _, tr := range list {
+			tr = strings.TrimSpace(tr)
+			if tr == "" || seen[tr] {
+				continue
+			}
+			if err := validateTracker(tr); err != nil {
+				return nil, err
+			}
+			seen[tr] = true
+			merged = append(merged, tr)
+		}
+	}
+	return merged, nil
+}
+
+// announceList puts each tracker in its own tier, so clients announce to
+// all of them rather than stopping at the first that answers.
+func announceList(trackers []string) [][]string {
+	tiers := make([][]string, len(trackers))
+	for i, tr := range trackers {
+		tiers[i] = []string{tr}
+	}
+	return tiers
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	_ "unsafe" // for go:linkname
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WebTorrentTrackers are WebSocket trackers used by browser WebTorrent
+// clients. They are added to DefaultTrackers when WebTorrent is on.
+var WebTorrentTrackers = []string{
+	"wss://tracker.openwebtorrent.com",
+	"wss://tracker.webtorrent.dev",
+}
+
+// DefaultICEServers are used for WebRTC peers when no others are
+// configured. STUN alone only gets through NATs that map ports
+// consistently; symmetric NATs need a TURN relay.
+var DefaultICEServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302", "stun:stun1.l.google.com:19302"}},
+}
+
+// maxICEServers is how many ICE servers the engine can use at once.
+const maxICEServers = 8
+
+// transportMu is the WebTorrent transport's lock, held while it creates a
+// peer connection, which is the only time it reads the ICE server list.
+// The torrent client copies the list's slice into each tracker client, and
+// has no way to replace it, so SetICEServers rewrites the list's entries
+// under this lock instead. Linking fails if a client upgrade removes it.
+//
+//go:linkname transportMu github.com/anacrolix/torrent/webtorrent.newPeerConnectionMu
+var transportMu sync.Mutex
+
+// SetICEServers replaces the STUN and TURN servers used by WebRTC
+// connections made from now on, such as to renew TURN credentials before
+// they expire. The client's list is maxICEServers long; entries past the
+// end of servers are left empty, which the transport skips.
+func (e *TorrentEngine) SetICEServers(servers []webrtc.ICEServer) error {
+	if e.iceServers == nil {
+		return fmt.Errorf("WebTorrent is off")
+	}
+	if len(servers) > maxICEServers {
+		return fmt.Errorf("%d ICE servers, at most %d are supported", len(servers), maxICEServers)
+	}
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	n := copy(e.iceServers, servers)
+	clear(e.iceServers[n:])
+	return nil
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSetICEServers(t *testing.T) {
+	stun := webrtc.ICEServer{URLs: []string{"stun:stun.example.com"}}
+	turn := func(user string) webrtc.ICEServer {
+		return webrtc.ICEServer{URLs: []string{"turn:turn.example.com"}, Username: user, Credential: "p"}
+	}
+	e := &TorrentEngine{iceServers: make([]webrtc.ICEServer, maxICEServers)}
+	list := e.iceServers
+
+	tests := []struct {
+		name    string
+		servers []webrtc.ICEServer
+		wantErr bool
+	}{
+		{"grow", []webrtc.ICEServer{stun, turn("a")}, false},
+		{"renew", []webrtc.ICEServer{stun, turn("b")}, false},
+		{"shrink", []webrtc.ICEServer{stun}, false},
+		{"too many", make([]webrtc.ICEServer, maxICEServers+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := e.SetICEServers(tt.servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if &e.iceServers[0] != &list[0] || len(e.iceServers) != maxICEServers {
+				t.Fatal("the client's list was replaced, not rewritten")
+			}
+			for i, s := range e.iceServers {
+				var want webrtc.ICEServer
+				if i < len(tt.servers) {
+					want = tt.servers[i]
+				}
+				if len(s.URLs) != len(want.URLs) || s.Username != want.Username {
+					t.Errorf("entry %d = %+v, want %+v", i, s, want)
+				}
+			}
+		})
+	}
+
+	off := &TorrentEngine{}
+	if err := off.SetICEServers([]webrtc.ICEServer{stun}); err == nil {
+		t.Fatal("SetICEServers with WebTorrent off succeeded")
+	}
+}
@@ -0,0 +1,191 @@
+// Package events carries the engine's JSON events. A Bus fans each event
+// out to every subscriber: the IPC writer on stdout and the HTTP event
+// stream both read from the same bus.
+package events
+
+import (
+	"sync"
+
+	"sharestream-engine/internal/media"
+	"sharestream-engine/internal/quota"
+	"sharestream-engine/internal/ratelimit"
+)
+
+// Event is one JSON event, as written to stdout by the IPC bridge.
+type Event struct {
+	Event      string  `json:"event"`
+	ServerURL  string  `json:"serverUrl,omitempty"`
+	MagnetURI  string  `json:"magnetURI,omitempty"`
+	Name       string  `json:"name,omitempty"`
+	Downloaded float64 `json:"downloaded,omitempty"`
+	Speed      int     `json:"speed,omitempty"`
+	Peers      int     `json:"peers,omitempty"`
+	Message    string  `json:"message,omitempty"`
+	InfoHash   string  `json:"infoHash,omitempty"`
+	Paused     bool    `json:"paused,omitempty"`
+	Complete   bool    `json:"complete,omitempty"`
+
+	// Set on "ready" events: the HTTP server's port and bearer tokens.
+	Port     int    `json:"port,omitempty"`
+	Token    string `json:"token,omitempty"`
+	LANToken string `json:"lanToken,omitempty"`
+
+	// Set on "progress" events during a verification pass.
+	Verifying bool    `json:"verifying,omitempty"`
+	Verified  float64 `json:"verified,omitempty"`
+
+	// Set on "hashing" events while a seed is being hashed.
+	FilePath string  `json:"filePath,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+	Total    int64   `json:"total,omitempty"`
+	ETA      float64 `json:"eta,omitempty"`
+
+	Torrents []TorrentStatus `json:"torrents,omitempty"`
+
+	// Set on "probe" events.
+	Duration float64     `json:"duration,omitempty"`
+	Media    *media.Info `json:"media,omitempty"`
+
+	// Set on "peer" events.
+	Address string `json:"address,omitempty"`
+	Network string `json:"network,omitempty"`
+
+	// Set on "pieces" events: the pieces completed since the last one.
+	Pieces []int `json:"pieces,omitempty"`
+
+	// Set on "stalled" events: seconds without payload data.
+	Stalled float64 `json:"stalled,omitempty"`
+
+	// Set on "seeding-finished" events: why seeding stopped (ratio, time
+	// or room) and the payload bytes uploaded.
+	Reason   string `json:"reason,omitempty"`
+	Uploaded int64  `json:"uploaded,omitempty"`
+
+	// Set on "limits" and "info" events.
+	Limits *ratelimit.Status `json:"limits,omitempty"`
+
+	// Set on "usage" events.
+	Usage *quota.Usage `json:"usage,omitempty"`
+
+	// Set on "metadata" events: the torrent's total size and files.
+	Size  int64  `json:"size,omitempty"`
+	Files []File `json:"files,omitempty"`
+
+	// Set on "peers" events: the torrent's connected peers.
+	PeerList []Peer `json:"peerList,omitempty"`
+
+	// Set on "self-addresses" events: ip:port endpoints other engines may
+	// connect to.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// File is one file of a "metadata" event.
+type File struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// Peer describes a connected peer. Choked and Interested are the peer's
+// side of the connection: whether it is choking us and whether it wants
+// our pieces.
+type Peer struct {
+	Address      string  `json:"address"`
+	Network      string  `json:"network"`
+	Transport    string  `json:"transport"`
+	Encryption   string  `json:"encryption"`
+	Client       string  `json:"client,omitempty"`
+	Source       string  `json:"source,omitempty"`
+	DownloadRate float64 `json:"downloadRate"`
+	UploadRate   float64 `json:"uploadRate"`
+	Pieces       int     `json:"pieces"`
+	Choked       bool    `json:"choked"`
+	Interested   bool    `json:"interested"`
+	RoomMember   bool    `json:"roomMember"`
+}
+
+// TorrentStatus is one entry of a "list" event.
+type TorrentStatus struct {
+	InfoHash   string  `json:"infoHash"`
+	Name       string  `json:"name,omitempty"`
+	ServerURL  string  `json:"serverUrl,omitempty"`
+	Downloaded float64 `json:"downloaded"`
+	Speed      int     `json:"speed"`
+	Peers      int     `json:"peers"`
+	Paused     bool    `json:"paused"`
+	Complete   bool    `json:"complete"`
+}
+
+// Bus delivers published events to its subscribers. Publish never blocks:
+// an event is dropped for a subscriber whose buffer is full, so a slow
+// reader can't hold up the engine. A nil *Bus discards everything.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives events from a Bus on C until it is closed.
+type Subscription struct {
+	C <-chan Event
+
+	bus     *Bus
+	c       chan Event
+	filter  func(Event) bool
+	dropped int
+}
+
+// Subscribe starts receiving events, buffering up to buffer of them. If
+// filter is non-nil only events it accepts are delivered.
+func (b *Bus) Subscribe(buffer int, filter func(Event) bool) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, bus: b, c: c, filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Close stops delivery and closes C.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// Dropped reports how many events were discarded because C was full.
+func (s *Subscription) Dropped() int {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.dropped
+}
+
+// Publish sends e to every subscriber that accepts it.
+func (b *Bus) Publish(e Event) {
+	b.PublishExcept(e, nil)
+}
+
+// PublishExcept sends e to every subscriber that accepts it but except, for
+// a publisher that delivers e to its own reader some other way.
+func (b *Bus) PublishExcept(e Event, except *Subscription) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s == except || (s.filter != nil && !s.filter(e)) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package events
+
+import "testing"
+
+func TestPublish(t *testing.T) {
+	bus := NewBus()
+	all := bus.Subscribe(1, nil)
+	stalls := bus.Subscribe(1, func(e Event) bool { return e.Event == "stall" })
+
+	bus.Publish(Event{Event: "progress"})
+	bus.Publish(Event{Event: "stall"})
+
+	if e := <-all.C; e.Event != "progress" {
+		t.Fatalf("first event = %q, want progress", e.Event)
+	}
+	if n := all.Dropped(); n != 1 {
+		t.Fatalf("full subscription dropped %d events, want 1", n)
+	}
+	if e := <-stalls.C; e.Event != "stall" {
+		t.Fatalf("filtered event = %q, want stall", e.Event)
+	}
+	if n := stalls.Dropped(); n != 0 {
+		t.Fatalf("filtered subscription dropped %d events, want 0", n)
+	}
+}
+
+func TestPublishExcept(t *testing.T) {
+	bus := NewBus()
+	self := bus.Subscribe(1, nil)
+	other := bus.Subscribe(1, nil)
+
+	bus.PublishExcept(Event{Event: "added"}, self)
+
+	if e := <-other.C; e.Event != "added" {
+		t.Fatalf("other subscriber got %q, want added", e.Event)
+	}
+	select {
+	case e := <-self.C:
+		t.Fatalf("excluded subscriber got %q", e.Event)
+	default:
+	}
+	if n := self.Dropped(); n != 0 {
+		t.Fatalf("excluded subscriber dropped %d events, want 0", n)
+	}
+}
+
+func TestClosedSubscription(t *testing.T) {
+	bus := NewBus()
+	s := bus.Subscribe(1, nil)
+	s.Close()
+	s.Close()
+	bus.Publish(Event{Event: "progress"})
+	if _, ok := <-s.C; ok {
+		t.Fatal("closed subscription received an event")
+	}
+
+	var nilBus *Bus
+	nilBus.Publish(Event{Event: "progress"})
+}
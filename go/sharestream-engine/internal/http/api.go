@@ -0,0 +1,429 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sharestream-engine/internal/auth"
+	"sharestream-engine/internal/control"
+	"sharestream-engine/internal/engine"
+	"sharestream-engine/internal/events"
+)
+
+const (
+	// maxTorrentUpload bounds an uploaded .torrent file.
+	maxTorrentUpload = 10 << 20
+
+	// eventStreamBuffer is how many events may queue for a slow event
+	// stream client before new ones are dropped.
+	eventStreamBuffer = 256
+
+	// keepAliveInterval is how often an idle event stream gets a comment,
+	// so proxies don't time it out.
+	keepAliveInterval = 15 * time.Second
+)
+
+// openAPISpec describes the /api/v1 routes.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// SetEvents enables /api/v1/events and publishes the API's own session
+// changes to bus, as the IPC commands do.
+func (s *Server) SetEvents(bus *events.Bus) {
+	s.events = bus
+}
+
+// registerAPI adds the versioned JSON API under /api/v1. Errors are JSON
+// objects with an "error" message. Changes to the session go through the
+// same control.Controller as the IPC commands.
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/openapi.yaml", s.handleOpenAPI)
+	mux.HandleFunc("GET /api/v1/events", s.handleAPIEvents)
+	mux.HandleFunc("GET /api/v1/usage", s.handleAPIUsage)
+	mux.HandleFunc("GET /api/v1/torrents", s.handleAPITorrents)
+	mux.HandleFunc("POST /api/v1/torrents", s.handleAPIAdd)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}", s.handleAPITorrent)
+	mux.HandleFunc("DELETE /api/v1/torrents/{infoHash}", s.handleAPIDelete)
+	mux.HandleFunc("POST /api/v1/torrents/{infoHash}/pause", s.handleAPIPause)
+	mux.HandleFunc("POST /api/v1/torrents/{infoHash}/resume", s.handleAPIResume)
+	mux.HandleFunc("PUT /api/v1/torrents/{infoHash}/policy", s.handleAPIPolicy)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/link", s.handleAPILink)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/files", s.handleAPIFiles)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/files/{path...}", s.handleAPIFile)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/stats", s.handleAPIStats)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/peers", s.handleAPIPeers)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}/pieces", s.handleAPIPieces)
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) handleAPIUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.engine.DiskUsage())
+}
+
+func (s *Server) handleAPITorrents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]engine.Info{"torrents": s.engine.ListInfo()})
+}
+
+// addRequest is the JSON body of POST /api/v1/torrents, with the fields of
+// the IPC seed and add commands. Exactly one of FilePath and MagnetURI is
+// set.
+type addRequest struct {
+	FilePath   string   `json:"filePath"`
+	MagnetURI  string   `json:"magnetURI"`
+	TrackerURL string   `json:"trackerUrl"`
+	Trackers   []string `json:"trackers"`
+
+	SeedPolicy *engine.SeedPolicy `json:"seedPolicy"`
+	Storage    string             `json:"storage"`
+}
+
+// handleAPIAdd seeds a local file or adds a magnet link, given as JSON, or
+// adds an uploaded .torrent file, sent either as the body with type
+// application/x-bittorrent or as the "torrent" field of a multipart form.
+// Uploads take extra trackers from "tracker" query or form values, and
+// their storage from "storage". Seeding answers once hashing is done, and a
+// client that disconnects first cancels it; only loopback clients may seed.
+func (s *Server) handleAPIAdd(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentUpload)
+
+	var added control.Added
+	var err error
+	event := "added"
+	switch mediaType {
+	case "application/json":
+		var req addRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		trackers := req.Trackers
+		if req.TrackerURL != "" {
+			trackers = append([]string{req.TrackerURL}, trackers...)
+		}
+		switch {
+		case (req.FilePath == "") == (req.MagnetURI == ""):
+			writeError(w, http.StatusBadRequest, errors.New("exactly one of filePath and magnetURI is required"))
+			return
+		case req.FilePath != "" && requestScope(r) != auth.Local:
+			// Only the machine's own user may share files from its disk.
+			writeError(w, http.StatusForbidden, errors.New("seeding a local file is only allowed from this machine"))
+			return
+		case req.FilePath != "":
+			event = "seeding"
+			added, err = s.seed(r.Context(), req.FilePath, trackers, req.SeedPolicy)
+			if errors.Is(err, context.Canceled) {
+				s.events.Publish(events.Event{Event: "cancelled", FilePath: req.FilePath})
+			}
+		default:
+			added, err = s.control.AddMagnet(req.MagnetURI, trackers, req.SeedPolicy, req.Storage)
+		}
+	case "application/x-bittorrent":
+		added, err = s.control.AddTorrent(r.Body, r.URL.Query()["tracker"], nil, r.URL.Query().Get("storage"))
+	case "multipart/form-data":
+		f, _, ferr := r.FormFile("torrent")
+		if ferr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("torrent file required: %w", ferr))
+			return
+		}
+		defer f.Close()
+		added, err = s.control.AddTorrent(f, r.Form["tracker"], nil, r.FormValue("storage"))
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType))
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.events.Publish(events.Event{
+		Event:     event,
+		MagnetURI: added.MagnetURI,
+		Name:      added.Name,
+		InfoHash:  added.InfoHash,
+	})
+	w.Header().Set("Location", "/api/v1/torrents/"+added.InfoHash)
+	writeJSON(w, http.StatusCreated, addResponse{
+		Added:     added,
+		StreamURL: s.signURL("/stream/"+added.InfoHash, requestScope(r), added.InfoHash, auth.DefaultTTL),
+	})
+}
+
+// addResponse is the reply to POST /api/v1/torrents. StreamURL serves the
+// torrent's largest file and is signed for the caller's scope.
+type addResponse struct {
+	control.Added
+	StreamURL string `json:"streamUrl"`
+}
+
+// handleAPILink returns a signed URL for streaming a torrent's file, which
+// can be handed to a player that can't send a bearer token. ?file= picks
+// the file, the largest by default, and ?ttl= the lifetime in seconds. A
+// loopback caller can ask for a link for a LAN client with ?lan=true.
+func (s *Server) handleAPILink(w http.ResponseWriter, r *http.Request) {
+	infoHash := r.PathValue("infoHash")
+	if s.engine.GetTorrent(infoHash) == nil {
+		writeEngineError(w, engine.ErrTorrentNotFound)
+		return
+	}
+
+	scope := requestScope(r)
+	if r.URL.Query().Get("lan") == "true" {
+		if s.auth != nil && !s.auth.LAN() {
+			writeError(w, http.StatusConflict, errors.New("LAN sharing is disabled"))
+			return
+		}
+		scope = auth.LAN
+	}
+	ttl := auth.DefaultTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid ttl"))
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+
+	path := "/stream/" + infoHash
+	if file := r.URL.Query().Get("file"); file != "" {
+		path += "/" + escapePath(file)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":     s.signURL(path, scope, infoHash, ttl),
+		"expires": time.Now().Add(ttl).Unix(),
+	})
+}
+
+// seed hashes and seeds filePath, cancelling hashing if ctx is done first.
+func (s *Server) seed(ctx context.Context, filePath string, trackers []string, policy *engine.SeedPolicy) (control.Added, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.engine.CancelHashing(filePath)
+		case <-done:
+		}
+	}()
+	return s.control.Seed(filePath, trackers, policy, func(p engine.HashProgress) {
+		s.events.Publish(events.Event{
+			Event:    "hashing",
+			FilePath: filePath,
+			Bytes:    p.Bytes,
+			Total:    p.Total,
+			ETA:      p.ETA.Seconds(),
+		})
+	})
+}
+
+func (s *Server) handleAPIDelete(w http.ResponseWriter, r *http.Request) {
+	infoHash := r.PathValue("infoHash")
+	if err := s.control.Stop(infoHash); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	s.events.Publish(events.Event{Event: "stopped", InfoHash: infoHash})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAPIPause(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r.PathValue("infoHash"), s.control.Pause, "paused")
+}
+
+func (s *Server) handleAPIResume(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r.PathValue("infoHash"), s.control.Resume, "resumed")
+}
+
+// setPaused applies pause or resume, publishes event and answers with the
+// torrent's status.
+func (s *Server) setPaused(w http.ResponseWriter, infoHash string, apply func(string) error, event string) {
+	if err := apply(infoHash); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	s.events.Publish(events.Event{Event: event, InfoHash: infoHash})
+	info, err := s.engine.GetInfo(infoHash)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleAPIPolicy replaces a torrent's seeding policy with the JSON body
+// and echoes it back.
+func (s *Server) handleAPIPolicy(w http.ResponseWriter, r *http.Request) {
+	infoHash := r.PathValue("infoHash")
+	var policy engine.SeedPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.control.SetSeedPolicy(infoHash, policy); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	s.events.Publish(events.Event{Event: "policy", InfoHash: infoHash})
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func (s *Server) handleAPITorrent(w http.ResponseWriter, r *http.Request) {
+	detail, err := s.engine.GetTorrentInfo(r.PathValue("infoHash"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func (s *Server) handleAPIFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := s.engine.GetFiles(r.PathValue("infoHash"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]engine.FileDetail{"files": files})
+}
+
+func (s *Server) handleAPIFile(w http.ResponseWriter, r *http.Request) {
+	file, err := s.engine.GetFile(r.PathValue("infoHash"), r.PathValue("path"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+func (s *Server) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.engine.GetTorrentStats(r.PathValue("infoHash"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) handleAPIPeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := s.engine.GetPeers(r.PathValue("infoHash"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]engine.PeerDetail{"peers": peers})
+}
+
+func (s *Server) handleAPIPieces(w http.ResponseWriter, r *http.Request) {
+	pieces, err := s.engine.GetPieces(r.PathValue("infoHash"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pieces)
+}
+
+// handleAPIEvents streams the event bus as Server-Sent Events, each with
+// the event's name as its type and its JSON as data. ?events= takes a comma
+// separated list of event names and ?infoHash= a torrent to stream events
+// for; events without an info hash always pass the latter. Events are
+// dropped for a client that falls too far behind.
+func (s *Server) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("events not available"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	var names map[string]bool
+	if v := r.URL.Query().Get("events"); v != "" {
+		names = make(map[string]bool)
+		for _, name := range strings.Split(v, ",") {
+			names[strings.TrimSpace(name)] = true
+		}
+	}
+	infoHash := r.URL.Query().Get("infoHash")
+	sub := s.events.Subscribe(eventStreamBuffer, func(e events.Event) bool {
+		return (names == nil || names[e.Event]) &&
+			(infoHash == "" || e.InfoHash == "" || e.InfoHash == infoHash)
+	})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-sub.C:
+			b, err := json.Marshal(e)
+			if err != nil {
+				s.logger.Error("failed to marshal event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeEngineError maps the engine's lookup errors to 404 and anything else
+// to 500.
+func writeEngineError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, engine.ErrTorrentNotFound), errors.Is(err, engine.ErrFileNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, engine.ErrMetadataTimeout):
+		status = http.StatusGatewayTimeout
+	}
+	writeError(w, status, err)
+}
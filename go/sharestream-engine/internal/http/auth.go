@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"sharestream-engine/internal/auth"
+)
+
+// signedRoutes are the routes whose first path element is an info hash, so
+// a signed URL for that torrent authorizes them.
+var signedRoutes = []string{"/stream/", "/hls/", "/subtitles/", "/probe/", "/torrent/"}
+
+// lanRoutes are the routes LAN clients may use, all read-only: streaming a
+// torrent's files and what a player needs alongside them. Everything else,
+// from adding and removing torrents to minting links, is for loopback
+// clients and admin credentials only.
+var lanRoutes = signedRoutes
+
+// credentialParams are the query parameters that carry credentials, passed
+// on to the segment URLs of an HLS playlist.
+var credentialParams = []string{"token", "exp", "sig"}
+
+// SetAuth requires every request to carry a bearer token, as an
+// Authorization header or a token query parameter, or a signed URL from
+// keys. Loopback clients may use the local credentials; other clients need
+// LAN credentials, and may only use lanRoutes, or the admin token, which
+// may use every route.
+func (s *Server) SetAuth(keys *auth.Keys) {
+	s.auth = keys
+}
+
+// authorize checks a request's credentials before passing it to next.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth != nil && s.auth.CheckToken(auth.Admin, bearerToken(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := requestScope(r)
+		if scope == auth.Local && s.lanCredentials(r) {
+			// LAN credentials only ever grant LAN access, even when they
+			// come from this machine.
+			scope = auth.LAN
+		}
+		if scope == auth.LAN && !lanRoute(r) {
+			denied(w, r, http.StatusForbidden, "not allowed from the LAN")
+			return
+		}
+		if s.auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.auth.CheckToken(scope, bearerToken(r)) ||
+			s.auth.CheckSignature(scope, signedInfoHash(r.URL.Path), r.URL.Query()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if scope == auth.LAN && !s.auth.LAN() {
+			denied(w, r, http.StatusForbidden, "LAN access is disabled")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sharestream"`)
+		denied(w, r, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+// lanCredentials reports whether r carries LAN credentials.
+func (s *Server) lanCredentials(r *http.Request) bool {
+	if s.auth == nil || !s.auth.LAN() {
+		return false
+	}
+	return s.auth.CheckToken(auth.LAN, bearerToken(r)) ||
+		s.auth.CheckSignature(auth.LAN, signedInfoHash(r.URL.Path), r.URL.Query())
+}
+
+// denied answers a request authorize turned away, as JSON for the API.
+func denied(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, status, errors.New(msg))
+	} else {
+		http.Error(w, msg, status)
+	}
+}
+
+// lanRoute reports whether r reads one of lanRoutes.
+func lanRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, prefix := range lanRoutes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScope is Local for loopback clients and LAN for everyone else.
+func requestScope(r *http.Request) auth.Scope {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return auth.Local
+	}
+	return auth.LAN
+}
+
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// signedInfoHash returns the info hash of a signedRoutes path, or "".
+func signedInfoHash(path string) string {
+	for _, prefix := range signedRoutes {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			infoHash, _, _ := strings.Cut(rest, "/")
+			return infoHash
+		}
+	}
+	return ""
+}
+
+// signURL appends a signature for infoHash to a URL without a query. It is
+// returned unchanged when auth is disabled.
+func (s *Server) signURL(rawURL string, scope auth.Scope, infoHash string, ttl time.Duration) string {
+	if s.auth == nil {
+		return rawURL
+	}
+	q := s.auth.Sign(scope, infoHash, ttl)
+	if q == nil {
+		return rawURL
+	}
+	return rawURL + "?" + q.Encode()
+}
+
+// requestCredentials returns the credential query parameters r was made
+// with.
+func requestCredentials(r *http.Request) url.Values {
+	q := url.Values{}
+	for _, name := range credentialParams {
+		if v := r.URL.Query().Get(name); v != "" {
+			q.Set(name, v)
+		}
+	}
+	return q
+}
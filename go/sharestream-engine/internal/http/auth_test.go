@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sharestream-engine/internal/auth"
+)
+
+const testInfoHash = "0123456789abcdef0123456789abcdef01234567"
+
+// authRoutes are the routes tested against every kind of client, and
+// whether they are for streaming, which LAN clients may use. Signed URLs
+// are only checked on routes that start with an info hash.
+var authRoutes = []struct {
+	method, path string
+	lan          bool
+}{
+	{"GET", "/stream/" + testInfoHash + "/video.mp4", true},
+	{"HEAD", "/stream/" + testInfoHash, true},
+	{"GET", "/hls/" + testInfoHash + "/video.mp4/index.m3u8", true},
+	{"GET", "/subtitles/" + testInfoHash + "/video.en.vtt", true},
+	{"GET", "/probe/" + testInfoHash + "/video.mp4", true},
+	{"GET", "/torrent/" + testInfoHash, true},
+	{"POST", "/stream/" + testInfoHash, false},
+	{"GET", "/torrents", false},
+	{"GET", "/api/v1/events", false},
+	{"GET", "/api/v1/usage", false},
+	{"GET", "/api/v1/torrents", false},
+	{"POST", "/api/v1/torrents", false},
+	{"GET", "/api/v1/torrents/" + testInfoHash, false},
+	{"DELETE", "/api/v1/torrents/" + testInfoHash, false},
+	{"POST", "/api/v1/torrents/" + testInfoHash + "/pause", false},
+	{"POST", "/api/v1/torrents/" + testInfoHash + "/resume", false},
+	{"PUT", "/api/v1/torrents/" + testInfoHash + "/policy", false},
+	{"GET", "/api/v1/torrents/" + testInfoHash + "/link", false},
+	{"GET", "/api/v1/torrents/" + testInfoHash + "/files", false},
+	{"GET", "/api/v1/torrents/" + testInfoHash + "/peers", false},
+}
+
+func TestAuthorize(t *testing.T) {
+	keys, err := auth.New(true, "lan-token", "admin-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localToken := keys.Token(auth.Local)
+	lanSig := keys.Sign(auth.LAN, testInfoHash, time.Hour).Encode()
+	localSig := keys.Sign(auth.Local, testInfoHash, time.Hour).Encode()
+
+	const (
+		loopback = "127.0.0.1:50000"
+		lan      = "192.168.1.20:50000"
+	)
+	tests := []struct {
+		name   string
+		remote string
+		token  string
+		query  string
+		// status for streaming routes, then for everything else; routes
+		// without an info hash ignore signatures, so answer as if there
+		// were no credentials
+		lan, local int
+	}{
+		{"loopback local token", loopback, localToken, "", 200, 200},
+		{"loopback local signature", loopback, "", localSig, 200, 200},
+		{"loopback no credentials", loopback, "", "", 401, 401},
+		{"loopback admin token", loopback, "admin-token", "", 200, 200},
+		{"loopback LAN token", loopback, "lan-token", "", 200, 403},
+		{"loopback LAN signature", loopback, "", lanSig, 200, 403},
+		{"LAN LAN token", lan, "lan-token", "", 200, 403},
+		{"LAN LAN signature", lan, "", lanSig, 200, 403},
+		{"LAN admin token", lan, "admin-token", "", 200, 200},
+		{"LAN local token", lan, localToken, "", 401, 403},
+		{"LAN local signature", lan, "", localSig, 401, 403},
+		{"LAN no credentials", lan, "", "", 401, 403},
+		{"LAN wrong token", lan, "wrong", "", 401, 403},
+	}
+
+	s := &Server{auth: keys}
+	h := s.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tt := range tests {
+		for _, route := range authRoutes {
+			want := tt.local
+			switch {
+			case route.lan:
+				want = tt.lan
+			case tt.query != "" && signedInfoHash(route.path) == "":
+				want = http.StatusUnauthorized
+				if tt.remote == lan {
+					want = http.StatusForbidden
+				}
+			}
+			path := route.path
+			if tt.query != "" {
+				path += "?" + tt.query
+			}
+			r := httptest.NewRequest(route.method, path, nil)
+			r.RemoteAddr = tt.remote
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != want {
+				t.Errorf("%s: %s %s = %d, want %d", tt.name, route.method, route.path, w.Code, want)
+			}
+			if w.Code != 200 && strings.HasPrefix(route.path, "/api/") &&
+				w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("%s: %s %s error is %q, want JSON", tt.name, route.method, route.path, w.Header().Get("Content-Type"))
+			}
+		}
+	}
+}
+
+func TestAuthorizeLANDisabled(t *testing.T) {
+	keys, err := auth.New(false, "", "admin-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{auth: keys}
+	h := s.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	// The admin token doesn't need LAN sharing.
+	tokens := []struct {
+		token string
+		want  int
+	}{
+		{keys.Token(auth.Local), http.StatusForbidden},
+		{"admin-token", http.StatusOK},
+	}
+	for _, tt := range tokens {
+		for _, route := range authRoutes {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			r.RemoteAddr = "192.168.1.20:50000"
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", route.method, route.path, w.Code, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewAdminToken(t *testing.T) {
+	if _, err := auth.New(true, "same-token", "same-token"); err == nil {
+		t.Error("New accepted an admin token equal to the LAN token")
+	}
+	keys, err := auth.New(true, "lan-token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Admin() || keys.CheckToken(auth.Admin, "") || keys.CheckToken(auth.Admin, "lan-token") {
+		t.Error("admin access enabled without an admin token")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"sharestream-engine/internal/auth"
+	"sharestream-engine/internal/transcode"
+)
+
+// hlsWaitTimeout bounds how long a request waits for ffmpeg to produce the
+// playlist or a segment.
+const hlsWaitTimeout = 2 * time.Minute
+
+// SetTranscoder enables the /hls/ routes.
+func (s *Server) SetTranscoder(m *transcode.Manager) {
+	s.hls = m
+}
+
+// handleHLS serves /hls/{infoHash}/{file}/index.m3u8 and the segments it
+// lists. The first request for a file starts ffmpeg, which reads the file
+// back from /stream/ so seeking and piece priorities work as for a player.
+func (s *Server) handleHLS(w http.ResponseWriter, r *http.Request) {
+	if s.hls == nil || !s.hls.Available() {
+		http.Error(w, "HLS not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/hls/")
+	infoHash, rest, ok := strings.Cut(path, "/")
+	slash := strings.LastIndex(rest, "/")
+	if !ok || slash <= 0 {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	filePath, name := rest[:slash], rest[slash+1:]
+
+	t := s.engine.GetTorrent(infoHash)
+	if t == nil {
+		http.Error(w, "torrent not found", http.StatusNotFound)
+		return
+	}
+	if !s.waitMetadata(w, r, infoHash) {
+		return
+	}
+
+	found := false
+	for _, f := range t.Files() {
+		if f.Path() == filePath {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), hlsWaitTimeout)
+	defer cancel()
+
+	key := infoHash + "/" + filePath
+	// Signed for as long as an idle session could be kept alive.
+	input := s.signURL(s.localURL("/stream/"+infoHash+"/"+escapePath(filePath)), auth.Local, infoHash, auth.DefaultTTL)
+
+	var file string
+	var err error
+	if name == transcode.PlaylistName {
+		file, err = s.hls.Playlist(ctx, key, input)
+	} else {
+		file, err = s.hls.Segment(ctx, key, input, name)
+	}
+	switch {
+	case errors.Is(err, transcode.ErrNotFound):
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "timed out waiting for ffmpeg", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		s.logger.Error("hls request failed", "infoHash", infoHash, "file", filePath, "name", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if name == transcode.PlaylistName {
+		s.servePlaylist(w, r, file)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, file)
+}
+
+// servePlaylist serves an HLS playlist. Players request segments relative
+// to the playlist without its query, so the credentials the playlist was
+// requested with are added to each segment URL.
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if q := requestCredentials(r); len(q) > 0 {
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines[i] = line + "?" + q.Encode()
+			}
+		}
+		data = []byte(strings.Join(lines, "\n"))
+	}
+
+	// The playlist grows while ffmpeg runs.
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// localURL returns an absolute loopback URL for path on this server.
+func (s *Server) localURL(path string) string {
+	var port string
+	if s.listener != nil {
+		_, port, _ = net.SplitHostPort(s.listener.Addr().String())
+	} else {
+		_, port, _ = net.SplitHostPort(s.http.Addr)
+	}
+	return fmt.Sprintf("http://127.0.0.1:%s%s", port, path)
+}
+
+// escapePath escapes each element of a torrent file path for use in a URL.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
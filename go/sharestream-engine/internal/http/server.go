@@ -1,39 +1,63 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/anacrolix/torrent"
+	"sharestream-engine/internal/auth"
+	"sharestream-engine/internal/control"
 	"sharestream-engine/internal/engine"
+	"sharestream-engine/internal/events"
+	"sharestream-engine/internal/media"
+	"sharestream-engine/internal/subtitles"
+	"sharestream-engine/internal/transcode"
 )
 
+// probeTimeout bounds a probe, which may wait for pieces from peers.
+const probeTimeout = time.Minute
+
 type Server struct {
 	engine   *engine.TorrentEngine
 	logger   *slog.Logger
 	http     *http.Server
 	listener net.Listener
+	hls      *transcode.Manager
+	control  *control.Controller
+	events   *events.Bus
+	auth     *auth.Keys
 }
 
 func New(eng *engine.TorrentEngine, addr string, logger *slog.Logger) *Server {
 	mux := http.NewServeMux()
 	s := &Server{
-		engine: eng,
-		logger: logger,
+		engine:  eng,
+		logger:  logger,
+		control: control.New(eng),
 	}
 
 	mux.HandleFunc("/stream/", s.handleStream)
 	mux.HandleFunc("/torrents", s.handleTorrents)
 	mux.HandleFunc("/torrent/", s.handleTorrentInfo)
+	mux.HandleFunc("/hls/", s.handleHLS)
+	mux.HandleFunc("/probe/", s.handleProbe)
+	mux.HandleFunc("/subtitles/", s.handleSubtitles)
+	s.registerAPI(mux)
 
 	s.http = &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: s.authorize(mux),
 	}
 
 	return s
@@ -45,44 +69,53 @@ func NewWithListener(eng *engine.TorrentEngine, listener net.Listener, logger *s
 		engine:   eng,
 		logger:   logger,
 		listener: listener,
+		control:  control.New(eng),
 	}
 
 	mux.HandleFunc("/stream/", s.handleStream)
 	mux.HandleFunc("/torrents", s.handleTorrents)
 	mux.HandleFunc("/torrent/", s.handleTorrentInfo)
+	mux.HandleFunc("/hls/", s.handleHLS)
+	mux.HandleFunc("/probe/", s.handleProbe)
+	mux.HandleFunc("/subtitles/", s.handleSubtitles)
+	s.registerAPI(mux)
 
 	s.http = &http.Server{
-		Handler: mux,
+		Handler: s.authorize(mux),
 	}
 
 	return s
 }
 
+// handleStream serves /stream/{infoHash}/{file} with http.ServeContent, so
+// single, suffix and multi-part ranges, HEAD, If-Range and the other
+// conditional headers behave as for a static file. The ETag is derived from
+// the info hash, which fixes the file's content. /stream/{infoHash} serves
+// the torrent's largest file, so it works for a magnet before its files
+// are known.
 func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/stream/")
-	parts := strings.SplitN(path, "/", 2)
-	if len(parts) < 2 {
+	infoHash, filePath, _ := strings.Cut(path, "/")
+	if infoHash == "" {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
 
-	infoHash := parts[0]
-	filePath := parts[1]
-
 	t := s.engine.GetTorrent(infoHash)
 	if t == nil {
 		http.Error(w, "torrent not found", http.StatusNotFound)
 		return
 	}
-
-	<-t.GotInfo()
+	if !s.waitMetadata(w, r, infoHash) {
+		return
+	}
 
 	files := t.Files()
 	var file *torrent.File
-	for _, f := range files {
-		if f.Path() == filePath {
-			file = f
-			break
+	index := 0
+	for i, f := range files {
+		if f.Path() == filePath || (filePath == "" && (file == nil || f.Length() > file.Length())) {
+			file, index = f, i
 		}
 	}
 
@@ -90,99 +123,204 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
+	filePath = file.Path()
 
-	reader, err := s.engine.ReadFile(infoHash, filePath, 0, 0)
+	reader, err := s.engine.ReadFile(r.Context(), infoHash, filePath, 0, 0)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer reader.Close()
 
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		s.handleRangeRequest(w, r, reader, file.Length(), filePath)
+	content, ok := reader.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "seeker not available", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(file.Length(), 10))
-	w.Header().Set("Accept-Ranges", "bytes")
-
-	io.Copy(w, reader)
+	// Set explicitly so ServeContent doesn't sniff, which would read the
+	// start of the file just to answer a range request elsewhere.
+	w.Header().Set("Content-Type", contentType(filePath))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, infoHash, index))
+	http.ServeContent(w, r, filePath, s.engine.ModTime(infoHash), content)
 }
 
-func (s *Server) handleRangeRequest(w http.ResponseWriter, r *http.Request, reader io.ReadCloser, totalSize int64, filePath string) {
-	rangeHeader := r.Header.Get("Range")
-	parts := strings.SplitN(rangeHeader, "=", 2)
-	if len(parts) != 2 {
-		http.Error(w, "invalid range", http.StatusBadRequest)
-		return
+// waitMetadata waits for a torrent's metadata before serving r. It answers
+// 504 if the metadata timeout passes first, or 404 if the torrent is
+// dropped, and reports whether to go on.
+func (s *Server) waitMetadata(w http.ResponseWriter, r *http.Request, infoHash string) bool {
+	err := s.engine.WaitMetadata(r.Context(), infoHash)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, engine.ErrMetadataTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, engine.ErrTorrentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
 	}
+	// Otherwise the client has gone.
+	return false
+}
 
-	rangeParts := strings.SplitN(parts[1], "-", 2)
-	start, _ := strconv.ParseInt(rangeParts[0], 10, 64)
-	var end int64
-	if rangeParts[1] == "" {
-		end = totalSize - 1
-	} else {
-		end, _ = strconv.ParseInt(rangeParts[1], 10, 64)
+// contentTypes covers media types Go's mime package doesn't know on every
+// platform.
+var contentTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mka":  "audio/x-matroska",
+	".webm": "video/webm",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".m4a":  "audio/mp4",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".flv":  "video/x-flv",
+	".wmv":  "video/x-ms-wmv",
+	".ogv":  "video/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".srt":  "application/x-subrip",
+	".vtt":  "text/vtt",
+	".ass":  "text/x-ssa",
+	".ssa":  "text/x-ssa",
+}
+
+func contentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ct, ok := contentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
 	}
+	return "application/octet-stream"
+}
 
-	if start >= totalSize {
-		http.Error(w, "range out of bounds", 416)
+// handleProbe serves /probe/{infoHash}/{file} as JSON media info.
+func (s *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/probe/")
+	infoHash, filePath, ok := strings.Cut(path, "/")
+	if !ok || filePath == "" {
+		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
-	if end >= totalSize {
-		end = totalSize - 1
-	}
 
-	length := end - start + 1
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
 
-	seeker, ok := reader.(io.Seeker)
-	if !ok {
-		http.Error(w, "seeker not available", http.StatusInternalServerError)
+	info, err := s.engine.ProbeFile(ctx, infoHash, filePath)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case s.engine.GetTorrent(infoHash) == nil:
+			status = http.StatusNotFound
+		case errors.Is(err, media.ErrUnsupported):
+			status = http.StatusUnsupportedMediaType
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, engine.ErrMetadataTimeout):
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	_, err := seeker.Seek(start, io.SeekStart)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleSubtitles serves /subtitles/{infoHash}/{file}.vtt, a sidecar
+// subtitle file converted to WebVTT, and
+// /subtitles/{infoHash}/{file}/{track}.vtt, a text subtitle track embedded
+// in a video. ?offset= shifts cues by that many seconds, which may be
+// negative.
+func (s *Server) handleSubtitles(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/subtitles/")
+	infoHash, filePath, ok := strings.Cut(path, "/")
+	filePath, isVTT := strings.CutSuffix(filePath, ".vtt")
+	if !ok || !isVTT || filePath == "" {
+		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize))
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.WriteHeader(http.StatusPartialContent)
+	var offset time.Duration
+	if v := r.URL.Query().Get("offset"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = time.Duration(secs * float64(time.Second))
+	}
 
-	limitedReader := &limitedReader{reader: reader, limit: length}
-	io.Copy(w, limitedReader)
-}
+	if s.engine.GetTorrent(infoHash) == nil {
+		http.Error(w, "torrent not found", http.StatusNotFound)
+		return
+	}
+	if i := strings.LastIndex(filePath, "/"); i > 0 && subtitles.Format(filePath) == "" {
+		if track, err := strconv.Atoi(filePath[i+1:]); err == nil {
+			s.serveEmbeddedSubtitles(w, r, infoHash, filePath[:i], track, offset)
+			return
+		}
+	}
+	cues, err := s.engine.ReadSubtitle(r.Context(), infoHash, filePath)
+	if errors.Is(err, engine.ErrMetadataTimeout) {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-type limitedReader struct {
-	reader io.Reader
-	limit  int64
-	read   int64
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	subtitles.WriteVTT(w, cues, offset)
 }
 
-func (lr *limitedReader) Read(p []byte) (n int, err error) {
-	if lr.read >= lr.limit {
-		return 0, io.EOF
-	}
-	remaining := lr.limit - lr.read
-	if int64(len(p)) > remaining {
-		p = p[:remaining]
+// subtitleFlushInterval is how often cues of an embedded track are flushed
+// to the client while they are being extracted.
+const subtitleFlushInterval = 500 * time.Millisecond
+
+// serveEmbeddedSubtitles streams an embedded subtitle track as WebVTT.
+// Cues are written as their data downloads, so a player can start with the
+// cues already available.
+func (s *Server) serveEmbeddedSubtitles(w http.ResponseWriter, r *http.Request, infoHash, filePath string, track int, offset time.Duration) {
+	vw := subtitles.NewWriter(w, offset)
+	flusher, _ := w.(http.Flusher)
+	var lastFlush time.Time
+	started := false
+
+	err := s.engine.ReadEmbeddedSubtitles(r.Context(), infoHash, filePath, track, func(c subtitles.Cue) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+			started = true
+		}
+		if err := vw.WriteCue(c); err != nil {
+			return err
+		}
+		if flusher != nil && time.Since(lastFlush) >= subtitleFlushInterval {
+			flusher.Flush()
+			lastFlush = time.Now()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		// Headers are gone; the client sees a truncated file.
+		s.logger.Warn("subtitle extraction stopped", "infoHash", infoHash, "file", filePath, "track", track, "error", err)
+	case !started:
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		vw.WriteHeader()
 	}
-	n, err = lr.reader.Read(p)
-	lr.read += int64(n)
-	return n, err
 }
 
 func (s *Server) handleTorrents(w http.ResponseWriter, r *http.Request) {
 	torrents := s.engine.ListTorrents()
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"torrents": %v}`, torrents)
+	json.NewEncoder(w).Encode(map[string][]string{"torrents": torrents})
 }
 
 func (s *Server) handleTorrentInfo(w http.ResponseWriter, r *http.Request) {
@@ -199,7 +337,7 @@ func (s *Server) handleTorrentInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, "%v", info)
+	json.NewEncoder(w).Encode(info)
 }
 
 func (s *Server) Start() error {
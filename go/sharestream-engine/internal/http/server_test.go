@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sharestream-engine/internal/engine"
+)
+
+// testContentSize spans several pieces, with a partial last one.
+const testContentSize = 3*256*1024 + 1000
+
+// newStreamServer seeds a synthetic file from a fresh engine and returns a
+// server for it, the torrent's info hash and the file's content.
+func newStreamServer(t *testing.T) (*Server, string, []byte) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	content := make([]byte, testContentSize)
+	rand.New(rand.NewSource(1)).Read(content)
+	file := filepath.Join(dir, "media", "video.mp4")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	eng, err := engine.New(engine.Config{
+		DataDir:  filepath.Join(dir, "data"),
+		Trackers: []string{},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { eng.Close() })
+
+	infoHash, _, err := eng.CreateTorrentFromFile(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(eng, "127.0.0.1:0", logger), infoHash, content
+}
+
+func TestHandleStream(t *testing.T) {
+	s, infoHash, content := newStreamServer(t)
+	size := len(content)
+	etag := fmt.Sprintf(`"%s-0"`, infoHash)
+	stream := "/stream/" + infoHash + "/video.mp4"
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       map[string]string
+		status       int
+		body         []byte // nil to skip the check
+		contentRange string
+	}{
+		{
+			name:   "whole file",
+			path:   stream,
+			status: http.StatusOK,
+			body:   content,
+		},
+		{
+			name:   "largest file without a path",
+			path:   "/stream/" + infoHash,
+			status: http.StatusOK,
+			body:   content,
+		},
+		{
+			name:         "range",
+			path:         stream,
+			header:       map[string]string{"Range": "bytes=100-199"},
+			status:       http.StatusPartialContent,
+			body:         content[100:200],
+			contentRange: fmt.Sprintf("bytes 100-199/%d", size),
+		},
+		{
+			name:         "range across pieces",
+			path:         stream,
+			header:       map[string]string{"Range": "bytes=262100-262199"},
+			status:       http.StatusPartialContent,
+			body:         content[262100:262200],
+			contentRange: fmt.Sprintf("bytes 262100-262199/%d", size),
+		},
+		{
+			name:         "open-ended range",
+			path:         stream,
+			header:       map[string]string{"Range": fmt.Sprintf("bytes=%d-", size-500)},
+			status:       http.StatusPartialContent,
+			body:         content[size-500:],
+			contentRange: fmt.Sprintf("bytes %d-%d/%d", size-500, size-1, size),
+		},
+		{
+			name:         "suffix range",
+			path:         stream,
+			header:       map[string]string{"Range": "bytes=-10"},
+			status:       http.StatusPartialContent,
+			body:         content[size-10:],
+			contentRange: fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size),
+		},
+		{
+			name:         "range past the end",
+			path:         stream,
+			header:       map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: fmt.Sprintf("bytes */%d", size),
+		},
+		{
+			name:   "head",
+			method: http.MethodHead,
+			path:   stream,
+			status: http.StatusOK,
+			body:   []byte{},
+		},
+		{
+			name:         "head with range",
+			method:       http.MethodHead,
+			path:         stream,
+			header:       map[string]string{"Range": "bytes=0-9"},
+			status:       http.StatusPartialContent,
+			body:         []byte{},
+			contentRange: fmt.Sprintf("bytes 0-9/%d", size),
+		},
+		{
+			name:         "if-range matching etag",
+			path:         stream,
+			header:       map[string]string{"Range": "bytes=0-9", "If-Range": etag},
+			status:       http.StatusPartialContent,
+			body:         content[:10],
+			contentRange: fmt.Sprintf("bytes 0-9/%d", size),
+		},
+		{
+			name:   "if-range stale etag",
+			path:   stream,
+			header: map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`},
+			status: http.StatusOK,
+			body:   content,
+		},
+		{
+			name:   "if-none-match",
+			path:   stream,
+			header: map[string]string{"If-None-Match": etag},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "unknown file",
+			path:   "/stream/" + infoHash + "/other.mkv",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "unknown torrent",
+			path:   "/stream/" + strings.Repeat("0", 40) + "/video.mp4",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "no info hash",
+			path:   "/stream/",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.http.Handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.body != nil && !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("body is %d bytes, want %d", w.Body.Len(), len(tt.body))
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.status == http.StatusOK || tt.status == http.StatusPartialContent {
+				if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+					t.Errorf("Content-Type = %q, want video/mp4", got)
+				}
+				if got := w.Header().Get("ETag"); got != etag {
+					t.Errorf("ETag = %q, want %q", got, etag)
+				}
+				if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+					t.Errorf("Accept-Ranges = %q, want bytes", got)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleStreamMultipartRange(t *testing.T) {
+	s, infoHash, content := newStreamServer(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/stream/"+infoHash+"/video.mp4", nil)
+	r.Header.Set("Range", "bytes=0-9,1000-1009")
+	w := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "multipart/byteranges") {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", ct)
+	}
+	body := w.Body.Bytes()
+	for _, part := range [][]byte{content[:10], content[1000:1010]} {
+		if !bytes.Contains(body, part) {
+			t.Errorf("multipart body lacks a requested range")
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package ice fetches the STUN and TURN servers WebRTC peers connect
+// through from the ShareStream signal server's /api/turn, so viewers
+// behind NATs that block direct connections can still be reached by relay,
+// and fetches them again before the TURN credentials expire.
+package ice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxResponse bounds the signal server's reply.
+	maxResponse = 64 << 10
+
+	// fetchTimeout bounds a fetch made by Refresh.
+	fetchTimeout = 10 * time.Second
+
+	// retryInterval is how soon Refresh tries again after a failed fetch.
+	retryInterval = time.Minute
+)
+
+// server is one entry of an iceServers list, as in RTCConfiguration:
+// urls may be a single URL or a list.
+type server struct {
+	URLs       urls   `json:"urls"`
+	Username   string `json:"username"`
+	Credential string `json:"credential"`
+}
+
+// response is an RTCConfiguration style {"iceServers":[...],"ttl":N} from
+// /api/turn, where ttl is how many seconds the TURN credentials are valid
+// for. Bare TURN credentials, {"username","password","ttl","urls"}, are
+// also accepted.
+type response struct {
+	ICEServers []server `json:"iceServers"`
+	TTL        int64    `json:"ttl"`
+
+	URLs     urls   `json:"urls"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type urls []string
+
+func (u *urls) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*u = urls{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*u = many
+	return nil
+}
+
+// Fetch asks the signal server at url for ICE servers and credentials. ttl
+// is how long the credentials are valid for, zero if they don't expire.
+func Fetch(ctx context.Context, url string) (servers []webrtc.ICEServer, ttl time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetch ICE servers: %s", resp.Status)
+	}
+
+	var r response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(&r); err != nil {
+		return nil, 0, fmt.Errorf("fetch ICE servers: %w", err)
+	}
+	entries := r.ICEServers
+	if len(r.URLs) > 0 {
+		entries = append(entries, server{URLs: r.URLs, Username: r.Username, Credential: r.Password})
+	}
+
+	for _, s := range entries {
+		if len(s.URLs) == 0 {
+			continue
+		}
+		is := webrtc.ICEServer{URLs: s.URLs, Username: s.Username}
+		if s.Credential != "" {
+			is.Credential = s.Credential
+			is.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		servers = append(servers, is)
+	}
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("fetch ICE servers: none in response")
+	}
+	return servers, time.Duration(max(r.TTL, 0)) * time.Second, nil
+}
+
+// Next returns how soon to fetch the ICE servers again after a fetch that
+// returned ttl and err: when four fifths of ttl have passed, a minute
+// after a failure, or never, zero, if the credentials don't expire.
+func Next(ttl time.Duration, err error) time.Duration {
+	if err != nil {
+		return retryInterval
+	}
+	return ttl * 4 / 5
+}
+
+// Refresh fetches the ICE servers from url after wait, and again as Next
+// says, passing each list fetched to set, until ctx is done or a reply has
+// no ttl. A failed set is retried like a failed fetch.
+func Refresh(ctx context.Context, url string, wait time.Duration, set func([]webrtc.ICEServer) error, logger *slog.Logger) {
+	for wait > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		fctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+		servers, ttl, err := Fetch(fctx, url)
+		cancel()
+		if err == nil {
+			err = set(servers)
+		}
+		if err != nil {
+			logger.Warn("failed to fetch ICE servers", "url", url, "error", err)
+		}
+		wait = Next(ttl, err)
+	}
+}
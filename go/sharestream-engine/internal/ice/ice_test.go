@@ -0,0 +1,149 @@
+package ice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  []webrtc.ICEServer
+		ttl   time.Duration
+	}{
+		{
+			name:  "ice servers",
+			reply: `{"iceServers":[{"urls":"stun:stun.example.com"},{"urls":["turn:turn.example.com"],"username":"1:u","credential":"p"}],"ttl":86400}`,
+			want: []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.com"}},
+				{URLs: []string{"turn:turn.example.com"}, Username: "1:u", Credential: "p", CredentialType: webrtc.ICECredentialTypePassword},
+			},
+			ttl: 24 * time.Hour,
+		},
+		{
+			name:  "no ttl",
+			reply: `{"iceServers":[{"urls":"stun:stun.example.com"}]}`,
+			want:  []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com"}}},
+		},
+		{
+			name:  "bare credentials",
+			reply: `{"username":"1:u","password":"p","ttl":60,"urls":["turn:turn.example.com"]}`,
+			want: []webrtc.ICEServer{
+				{URLs: []string{"turn:turn.example.com"}, Username: "1:u", Credential: "p", CredentialType: webrtc.ICECredentialTypePassword},
+			},
+			ttl: time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.reply)
+			}))
+			defer srv.Close()
+
+			servers, ttl, err := Fetch(context.Background(), srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl != tt.ttl {
+				t.Errorf("ttl = %v, want %v", ttl, tt.ttl)
+			}
+			if len(servers) != len(tt.want) {
+				t.Fatalf("got %d servers, want %d", len(servers), len(tt.want))
+			}
+			for i, s := range servers {
+				w := tt.want[i]
+				if len(s.URLs) != len(w.URLs) || s.URLs[0] != w.URLs[0] || s.Username != w.Username ||
+					s.Credential != w.Credential || s.CredentialType != w.CredentialType {
+					t.Errorf("server %d = %+v, want %+v", i, s, w)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchEmpty(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"iceServers":[]}`)
+	}))
+	defer srv.Close()
+	if _, _, err := Fetch(context.Background(), srv.URL); err == nil {
+		t.Fatal("Fetch of an empty list succeeded")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	// The first renewal hands out credentials that don't expire, which
+	// ends the refreshing.
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		io.WriteString(w, `{"iceServers":[{"urls":"turn:turn.example.com","username":"renewed","credential":"p"}]}`)
+	}))
+	defer srv.Close()
+
+	var got []webrtc.ICEServer
+	set := func(servers []webrtc.ICEServer) error {
+		got = servers
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		Refresh(context.Background(), srv.URL, 50*time.Millisecond, set, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refresh still running after a reply without a ttl")
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+	if len(got) != 1 || got[0].Username != "renewed" {
+		t.Fatalf("set %+v, want the renewed credentials", got)
+	}
+}
+
+func TestRefreshStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Refresh(ctx, "http://127.0.0.1:0", time.Hour, func([]webrtc.ICEServer) error { return nil }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Refresh still running after its context was cancelled")
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		err  error
+		want time.Duration
+	}{
+		{"expiring", 24 * time.Hour, nil, 24 * time.Hour * 4 / 5},
+		{"not expiring", 0, nil, 0},
+		{"failed", 0, errors.New("unreachable"), retryInterval},
+	}
+	for _, tt := range tests {
+		if got := Next(tt.ttl, tt.err); got != tt.want {
+			t.Errorf("%s: Next = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,56 +2,137 @@ package ipc
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"sync"
+	"time"
 
+	"sharestream-engine/internal/auth"
+	"sharestream-engine/internal/control"
 	"sharestream-engine/internal/engine"
+	"sharestream-engine/internal/events"
+	"sharestream-engine/internal/ratelimit"
+	"sharestream-engine/internal/transcode"
 )
 
 // Flutter-compatible protocol
 type Command struct {
-	Cmd        string `json:"cmd"`
-	FilePath   string `json:"filePath,omitempty"`
-	MagnetURI  string `json:"magnetURI,omitempty"`
-	TrackerURL string `json:"trackerUrl,omitempty"`
+	Cmd        string   `json:"cmd"`
+	FilePath   string   `json:"filePath,omitempty"`
+	MagnetURI  string   `json:"magnetURI,omitempty"`
+	TrackerURL string   `json:"trackerUrl,omitempty"`
+	InfoHash   string   `json:"infoHash,omitempty"`
+	Files      []string `json:"files,omitempty"`
+	Trackers   []string `json:"trackers,omitempty"`
+
+	// limits: rates in bytes per second, 0 for unlimited. Omitted fields
+	// are left unchanged.
+	Upload      *int64 `json:"upload,omitempty"`
+	Download    *int64 `json:"download,omitempty"`
+	AltUpload   *int64 `json:"altUpload,omitempty"`
+	AltDownload *int64 `json:"altDownload,omitempty"`
+	AltSpeed    string `json:"altSpeed,omitempty"`
+
+	// seed, add and policy: when the torrent stops seeding. room-ended:
+	// the room that ended. room-peers: the room and its members' addresses.
+	// add-peers: ip:port addresses to connect to.
+	Policy *engine.SeedPolicy `json:"policy,omitempty"`
+	Room   string             `json:"room,omitempty"`
+	Peers  []string           `json:"peers,omitempty"`
+
+	// add: "file" or "memory"; the engine's default if omitted.
+	Storage string `json:"storage,omitempty"`
 }
 
-type Event struct {
-	Event      string  `json:"event"`
-	ServerURL  string  `json:"serverUrl,omitempty"`
-	MagnetURI  string  `json:"magnetURI,omitempty"`
-	Name       string  `json:"name,omitempty"`
-	Downloaded float64 `json:"downloaded,omitempty"`
-	Speed      int     `json:"speed,omitempty"`
-	Peers      int     `json:"peers,omitempty"`
-	Message    string  `json:"message,omitempty"`
+// trackers returns the announce URLs given with a seed or add command:
+// trackerUrl first, then the trackers list.
+func (cmd Command) trackers() []string {
+	var trackers []string
+	if cmd.TrackerURL != "" {
+		trackers = append(trackers, cmd.TrackerURL)
+	}
+	return append(trackers, cmd.Trackers...)
 }
 
+// Event and TorrentStatus are the protocol's events, shared with the HTTP
+// event stream.
+type (
+	Event         = events.Event
+	TorrentStatus = events.TorrentStatus
+)
+
+// eventBuffer is how many events may queue for stdout before new ones are
+// dropped.
+const eventBuffer = 4096
+
+// probeTimeout bounds a probe, which may wait for pieces from peers.
+const probeTimeout = time.Minute
+
+// flushTimeout bounds how long quit waits for queued events to be written,
+// in case the parent has stopped reading stdout.
+const flushTimeout = 5 * time.Second
+
+// IPC reads commands from stdin and writes events to stdout. Events go
+// through the bus, so the HTTP event stream sees them too, and stdout has a
+// single writer. The engine's own events may be dropped if stdout falls
+// behind, but replies to commands never are: they reach stdout through
+// replies, which waits for the writer.
 type IPC struct {
 	engine   *engine.TorrentEngine
+	control  *control.Controller
+	events   *events.Bus
+	sub      *events.Subscription
+	replies  chan Event
+	flushed  chan struct{}
+	auth     *auth.Keys
+	hls      *transcode.Manager
 	logger   *slog.Logger
 	mu       sync.Mutex
 	httpPort int
 }
 
-func NewIPC(eng *engine.TorrentEngine, httpPort int, logger *slog.Logger) *IPC {
+// NewIPC subscribes to bus straight away, so no event published before Run
+// is lost. "pieces" events are left to HTTP subscribers.
+func NewIPC(eng *engine.TorrentEngine, bus *events.Bus, keys *auth.Keys, httpPort int, logger *slog.Logger) *IPC {
 	return &IPC{
-		engine:   eng,
+		engine:  eng,
+		control: control.New(eng),
+		events:  bus,
+		auth:    keys,
+		sub: bus.Subscribe(eventBuffer, func(e events.Event) bool {
+			return e.Event != "pieces"
+		}),
+		replies:  make(chan Event),
+		flushed:  make(chan struct{}),
 		logger:   logger,
 		httpPort: httpPort,
 	}
 }
 
+// SetTranscoder has quit stop m's ffmpeg processes, which would otherwise
+// outlive the engine.
+func (ipc *IPC) SetTranscoder(m *transcode.Manager) {
+	ipc.hls = m
+}
+
 func (ipc *IPC) Run() error {
 	reader := bufio.NewReader(os.Stdin)
-	writer := os.Stdout
+	go ipc.writeEvents(os.Stdout)
 
 	// Send ready event with port info
-	ipc.sendEvent(writer, Event{Event: "ready"})
+	ipc.sendEvent(Event{
+		Event:    "ready",
+		Port:     ipc.httpPort,
+		Token:    ipc.auth.Token(auth.Local),
+		LANToken: ipc.auth.Token(auth.LAN),
+	})
+	ipc.sendRestored()
+	ipc.sendSelfAddresses()
 
 	for {
 		line, err := reader.ReadBytes('\n')
@@ -65,107 +146,490 @@ func (ipc *IPC) Run() error {
 
 		var cmd Command
 		if err := json.Unmarshal(line, &cmd); err != nil {
-			ipc.sendEvent(writer, Event{
+			ipc.sendEvent(Event{
 				Event:   "error",
 				Message: fmt.Sprintf("invalid command: %v", err),
 			})
 			continue
 		}
 
-		go ipc.handleCommand(writer, cmd)
+		go ipc.handleCommand(cmd)
 	}
 }
 
-func (ipc *IPC) handleCommand(writer *os.File, cmd Command) {
+func (ipc *IPC) handleCommand(cmd Command) {
 	switch cmd.Cmd {
 	case "seed":
-		ipc.handleSeed(writer, cmd)
+		ipc.handleSeed(cmd)
 	case "add":
-		ipc.handleAdd(writer, cmd)
+		ipc.handleAdd(cmd)
 	case "stop":
-		ipc.handleStop(writer)
+		ipc.handleStop(cmd)
 	case "quit":
-		ipc.handleQuit(writer)
+		ipc.handleQuit()
 	case "info":
-		ipc.handleInfo(writer)
+		ipc.handleInfo(cmd)
+	case "list":
+		ipc.handleList()
+	case "pause":
+		ipc.handlePause(cmd)
+	case "resume":
+		ipc.handleResume(cmd)
+	case "select":
+		ipc.handleSelect(cmd)
+	case "verify":
+		ipc.handleVerify(cmd)
+	case "cancel":
+		ipc.handleCancel(cmd)
+	case "probe":
+		ipc.handleProbe(cmd)
+	case "limits":
+		ipc.handleLimits(cmd)
+	case "policy":
+		ipc.handlePolicy(cmd)
+	case "room-ended":
+		ipc.handleRoomEnded(cmd)
+	case "room-peers":
+		ipc.handleRoomPeers(cmd)
+	case "peers":
+		ipc.handlePeers(cmd)
+	case "add-peers":
+		ipc.handleAddPeers(cmd)
+	case "self-addresses":
+		ipc.sendSelfAddresses()
+	case "usage":
+		ipc.handleUsage()
 	default:
-		ipc.sendEvent(writer, Event{
+		ipc.sendEvent(Event{
 			Event:   "error",
 			Message: fmt.Sprintf("unknown command: %s", cmd.Cmd),
 		})
 	}
 }
 
-func (ipc *IPC) handleSeed(writer *os.File, cmd Command) {
-	infoHash, mi, err := ipc.engine.CreateTorrentFromFile(cmd.FilePath)
+func (ipc *IPC) handleSeed(cmd Command) {
+	added, err := ipc.control.Seed(cmd.FilePath, cmd.trackers(), cmd.Policy, func(p engine.HashProgress) {
+		ipc.sendEvent(Event{
+			Event:    "hashing",
+			FilePath: cmd.FilePath,
+			Bytes:    p.Bytes,
+			Total:    p.Total,
+			ETA:      p.ETA.Seconds(),
+		})
+	})
+	if errors.Is(err, context.Canceled) {
+		ipc.sendEvent(Event{Event: "cancelled", FilePath: cmd.FilePath})
+		return
+	}
 	if err != nil {
-		ipc.sendEvent(writer, Event{
+		ipc.sendEvent(Event{
 			Event:   "error",
 			Message: err.Error(),
 		})
 		return
 	}
 
-	magnetURI := ""
-	if mi != nil {
-		magnetURI = mi.Magnet(nil, nil).String()
-	}
-
-	serverURL := fmt.Sprintf("http://localhost:%d/%s", ipc.httpPort, infoHash)
-	name := ipc.engine.GetTorrentName(infoHash)
-
-	ipc.sendEvent(writer, Event{
+	ipc.sendEvent(Event{
 		Event:     "seeding",
-		ServerURL: serverURL,
-		MagnetURI: magnetURI,
-		Name:      name,
+		ServerURL: ipc.serverURL(added.InfoHash),
+		MagnetURI: added.MagnetURI,
+		Name:      added.Name,
+		InfoHash:  added.InfoHash,
 	})
 }
 
-func (ipc *IPC) handleAdd(writer *os.File, cmd Command) {
-	infoHash, err := ipc.engine.AddMagnet(cmd.MagnetURI)
+func (ipc *IPC) handleAdd(cmd Command) {
+	added, err := ipc.control.AddMagnet(cmd.MagnetURI, cmd.trackers(), cmd.Policy, cmd.Storage)
 	if err != nil {
-		ipc.sendEvent(writer, Event{
+		ipc.sendEvent(Event{
 			Event:   "error",
 			Message: err.Error(),
 		})
 		return
 	}
 
-	serverURL := fmt.Sprintf("http://localhost:%d/%s", ipc.httpPort, infoHash)
-	name := ipc.engine.GetTorrentName(infoHash)
-
-	ipc.sendEvent(writer, Event{
+	ipc.sendEvent(Event{
 		Event:     "added",
-		ServerURL: serverURL,
-		Name:      name,
+		ServerURL: ipc.serverURL(added.InfoHash),
+		Name:      added.Name,
+		InfoHash:  added.InfoHash,
 	})
 }
 
-func (ipc *IPC) handleStop(writer *os.File) {
-	ipc.engine.DropCurrentTorrent()
-	ipc.sendEvent(writer, Event{Event: "stopped"})
+// handleStop drops the torrent named by cmd.InfoHash. Without an info hash
+// it drops every torrent, which is what older clients expect.
+func (ipc *IPC) handleStop(cmd Command) {
+	if err := ipc.control.Stop(cmd.InfoHash); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "stopped", InfoHash: cmd.InfoHash})
 }
 
-func (ipc *IPC) handleQuit(writer *os.File) {
+// handleQuit stops the transcoder and the engine itself, as os.Exit skips
+// main's deferred cleanup. It writes the events still queued, then its own
+// straight to stdout, as the process exits before the bus would deliver it.
+func (ipc *IPC) handleQuit() {
+	if ipc.hls != nil {
+		ipc.hls.Close()
+	}
 	ipc.engine.Close()
-	ipc.sendEvent(writer, Event{Event: "stopped"})
+	ipc.flush()
+	ipc.write(os.Stdout, Event{Event: "stopped"})
 	os.Exit(0)
 }
 
-func (ipc *IPC) handleInfo(writer *os.File) {
-	info := ipc.engine.GetInfo()
-	ipc.sendEvent(writer, Event{
+// flush stops taking events from the bus and waits for those already queued
+// to be written.
+func (ipc *IPC) flush() {
+	ipc.sub.Close()
+	select {
+	case <-ipc.flushed:
+	case <-time.After(flushTimeout):
+		ipc.logger.Warn("timed out writing queued events")
+	}
+}
+
+// handleInfo reports a single torrent. Without an info hash it reports the
+// first torrent in the session, matching the single-torrent protocol.
+func (ipc *IPC) handleInfo(cmd Command) {
+	var info engine.Info
+	if cmd.InfoHash == "" {
+		infos := ipc.engine.ListInfo()
+		if len(infos) == 0 {
+			limits, _ := ipc.engine.Limits("")
+			ipc.sendEvent(Event{Event: "info", Limits: &limits})
+			return
+		}
+		info = infos[0]
+	} else {
+		var err error
+		info, err = ipc.engine.GetInfo(cmd.InfoHash)
+		if err != nil {
+			ipc.sendError(cmd.InfoHash, err)
+			return
+		}
+	}
+	limits, err := ipc.engine.Limits(info.InfoHash)
+	if err != nil {
+		ipc.sendError(info.InfoHash, err)
+		return
+	}
+
+	ipc.sendEvent(Event{
 		Event:      "info",
-		ServerURL:  info.ServerURL,
+		ServerURL:  ipc.serverURL(info.InfoHash),
 		Name:       info.Name,
 		Downloaded: info.Progress,
 		Peers:      info.Peers,
 		Speed:      info.Speed,
+		InfoHash:   info.InfoHash,
+		Paused:     info.Paused,
+		Complete:   info.Complete,
+		Limits:     &limits,
+	})
+}
+
+func (ipc *IPC) handleList() {
+	infos := ipc.engine.ListInfo()
+	torrents := make([]TorrentStatus, len(infos))
+	for i, info := range infos {
+		torrents[i] = TorrentStatus{
+			InfoHash:   info.InfoHash,
+			Name:       info.Name,
+			ServerURL:  ipc.serverURL(info.InfoHash),
+			Downloaded: info.Progress,
+			Speed:      info.Speed,
+			Peers:      info.Peers,
+			Paused:     info.Paused,
+			Complete:   info.Complete,
+		}
+	}
+	ipc.sendEvent(Event{Event: "list", Torrents: torrents})
+}
+
+func (ipc *IPC) handlePause(cmd Command) {
+	if err := ipc.control.Pause(cmd.InfoHash); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "paused", InfoHash: cmd.InfoHash})
+}
+
+func (ipc *IPC) handleResume(cmd Command) {
+	if err := ipc.control.Resume(cmd.InfoHash); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "resumed", InfoHash: cmd.InfoHash})
+}
+
+// handleSelect limits downloading to cmd.Files. An empty list selects every
+// file again.
+func (ipc *IPC) handleSelect(cmd Command) {
+	if cmd.InfoHash == "" {
+		ipc.sendError("", fmt.Errorf("select requires infoHash"))
+		return
+	}
+	if err := ipc.engine.SelectFiles(cmd.InfoHash, cmd.Files); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "selected", InfoHash: cmd.InfoHash})
+}
+
+// handleCancel aborts hashing a seed started with "seed" for the same path.
+func (ipc *IPC) handleCancel(cmd Command) {
+	if err := ipc.engine.CancelHashing(cmd.FilePath); err != nil {
+		ipc.sendEvent(Event{
+			Event:    "error",
+			Message:  err.Error(),
+			FilePath: cmd.FilePath,
+		})
+	}
+}
+
+// handleVerify starts a verification pass. Its progress is reported in the
+// periodic progress events.
+func (ipc *IPC) handleVerify(cmd Command) {
+	if cmd.InfoHash == "" {
+		ipc.sendError("", fmt.Errorf("verify requires infoHash"))
+		return
+	}
+	if err := ipc.engine.VerifyTorrent(cmd.InfoHash); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "verifying", InfoHash: cmd.InfoHash})
+}
+
+// handlePolicy replaces a torrent's seeding policy; an omitted policy
+// clears it.
+func (ipc *IPC) handlePolicy(cmd Command) {
+	var policy engine.SeedPolicy
+	if cmd.Policy != nil {
+		policy = *cmd.Policy
+	}
+	if err := ipc.control.SetSeedPolicy(cmd.InfoHash, policy); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "policy", InfoHash: cmd.InfoHash})
+}
+
+// handleRoomEnded removes the torrents tied to a room. Each is reported by
+// the engine with a "seeding-finished" event.
+func (ipc *IPC) handleRoomEnded(cmd Command) {
+	if _, err := ipc.control.RoomEnded(cmd.Room); err != nil {
+		ipc.sendError("", err)
+	}
+}
+
+// handleRoomPeers records a room's members so their connections are
+// marked in "peers" replies.
+func (ipc *IPC) handleRoomPeers(cmd Command) {
+	if err := ipc.control.SetRoomPeers(cmd.Room, cmd.Peers); err != nil {
+		ipc.sendError("", err)
+	}
+}
+
+// handlePeers replies with a torrent's connected peers.
+func (ipc *IPC) handlePeers(cmd Command) {
+	peers, err := ipc.engine.GetPeers(cmd.InfoHash)
+	if err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "peers", InfoHash: cmd.InfoHash, PeerList: peers})
+}
+
+// handleAddPeers connects a torrent to the given peers, typically the
+// engines of the room's other members, and replies with how many were new.
+func (ipc *IPC) handleAddPeers(cmd Command) {
+	added, err := ipc.control.AddPeers(cmd.InfoHash, cmd.Peers)
+	if err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "peers-added", InfoHash: cmd.InfoHash, Peers: added})
+}
+
+// sendSelfAddresses reports the endpoints other engines may connect to, for
+// the app to share with the room. The engine sends it again whenever they
+// change.
+func (ipc *IPC) sendSelfAddresses() {
+	ipc.sendEvent(Event{Event: "self-addresses", Addresses: ipc.engine.SelfAddresses()})
+}
+
+// handleUsage reports the data directory's usage against its quota.
+func (ipc *IPC) handleUsage() {
+	usage := ipc.engine.DiskUsage()
+	ipc.sendEvent(Event{Event: "usage", Usage: &usage})
+}
+
+// handleLimits changes bandwidth limits and replies with those in force.
+// With an info hash it sets that torrent's limits; otherwise the global and
+// alternative limits and the alternative-speed mode.
+func (ipc *IPC) handleLimits(cmd Command) {
+	if err := ipc.setLimits(cmd); err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	limits, err := ipc.engine.Limits(cmd.InfoHash)
+	if err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{Event: "limits", InfoHash: cmd.InfoHash, Limits: &limits})
+}
+
+func (ipc *IPC) setLimits(cmd Command) error {
+	if cmd.InfoHash != "" {
+		if cmd.AltUpload != nil || cmd.AltDownload != nil || cmd.AltSpeed != "" {
+			return fmt.Errorf("alternative limits are global")
+		}
+		if cmd.Upload == nil && cmd.Download == nil {
+			return nil
+		}
+		status, err := ipc.engine.Limits(cmd.InfoHash)
+		if err != nil {
+			return err
+		}
+		return ipc.engine.SetTorrentLimits(cmd.InfoHash, updateLimits(*status.Torrent, cmd.Upload, cmd.Download))
+	}
+
+	if cmd.AltSpeed != "" {
+		if err := ipc.engine.SetAltMode(cmd.AltSpeed); err != nil {
+			return err
+		}
+	}
+	status, _ := ipc.engine.Limits("")
+	if cmd.Upload != nil || cmd.Download != nil {
+		if err := ipc.engine.SetLimits(updateLimits(status.Global, cmd.Upload, cmd.Download)); err != nil {
+			return err
+		}
+	}
+	if cmd.AltUpload != nil || cmd.AltDownload != nil {
+		return ipc.engine.SetAltLimits(updateLimits(status.Alt, cmd.AltUpload, cmd.AltDownload))
+	}
+	return nil
+}
+
+// updateLimits returns l with the given rates replaced.
+func updateLimits(l ratelimit.Limits, upload, download *int64) ratelimit.Limits {
+	if upload != nil {
+		l.Upload = *upload
+	}
+	if download != nil {
+		l.Download = *download
+	}
+	return l
+}
+
+// handleProbe reports a file's media info. filePath is the file's path in
+// the torrent; without it the largest file is probed.
+func (ipc *IPC) handleProbe(cmd Command) {
+	if cmd.InfoHash == "" {
+		ipc.sendError("", fmt.Errorf("probe requires infoHash"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	info, err := ipc.engine.ProbeFile(ctx, cmd.InfoHash, cmd.FilePath)
+	if err != nil {
+		ipc.sendError(cmd.InfoHash, err)
+		return
+	}
+	ipc.sendEvent(Event{
+		Event:    "probe",
+		InfoHash: cmd.InfoHash,
+		FilePath: cmd.FilePath,
+		Duration: info.Duration,
+		Media:    info,
 	})
 }
 
-func (ipc *IPC) sendEvent(writer *os.File, event Event) {
+// sendRestored reports each torrent the engine restored from its previous
+// session, so the app can pick up where it left off.
+func (ipc *IPC) sendRestored() {
+	for _, infoHash := range ipc.engine.RestoredTorrents() {
+		info, err := ipc.engine.GetInfo(infoHash)
+		if err != nil {
+			continue
+		}
+		magnetURI, _ := ipc.engine.CreateMagnetLink(infoHash)
+		ipc.sendEvent(Event{
+			Event:      "restored",
+			ServerURL:  ipc.serverURL(infoHash),
+			MagnetURI:  magnetURI,
+			Name:       info.Name,
+			Downloaded: info.Progress,
+			InfoHash:   infoHash,
+			Paused:     info.Paused,
+			Complete:   info.Complete,
+		})
+	}
+}
+
+// serverURL returns a signed loopback URL streaming the torrent's largest
+// file; its query authorizes any of the torrent's HTTP routes.
+func (ipc *IPC) serverURL(infoHash string) string {
+	q := ipc.auth.Sign(auth.Local, infoHash, auth.DefaultTTL)
+	return fmt.Sprintf("http://127.0.0.1:%d/stream/%s?%s", ipc.httpPort, infoHash, q.Encode())
+}
+
+func (ipc *IPC) sendError(infoHash string, err error) {
+	ipc.sendEvent(Event{
+		Event:    "error",
+		Message:  err.Error(),
+		InfoHash: infoHash,
+	})
+}
+
+// sendEvent publishes a reply to a command. Other subscribers get it from
+// the bus as usual, but stdout gets it through replies, waiting for the
+// writer rather than being dropped when the bus's buffer is full.
+func (ipc *IPC) sendEvent(event Event) {
+	ipc.events.PublishExcept(event, ipc.sub)
+	select {
+	case ipc.replies <- event:
+	case <-ipc.flushed:
+	}
+}
+
+// writeEvents writes the events from the bus and the replies to commands to
+// w as JSON lines, until the subscription is closed and what it queued has
+// been written.
+func (ipc *IPC) writeEvents(w io.Writer) {
+	defer close(ipc.flushed)
+	for {
+		select {
+		case event, ok := <-ipc.sub.C:
+			if !ok {
+				ipc.drainReplies(w)
+				return
+			}
+			ipc.write(w, event)
+		case event := <-ipc.replies:
+			ipc.write(w, event)
+		}
+	}
+}
+
+// drainReplies writes the replies already waiting to be sent.
+func (ipc *IPC) drainReplies(w io.Writer) {
+	for {
+		select {
+		case event := <-ipc.replies:
+			ipc.write(w, event)
+		default:
+			return
+		}
+	}
+}
+
+func (ipc *IPC) write(w io.Writer, event Event) {
 	ipc.mu.Lock()
 	defer ipc.mu.Unlock()
 
@@ -174,10 +638,5 @@ func (ipc *IPC) sendEvent(writer *os.File, event Event) {
 		ipc.logger.Error("failed to marshal event", "error", err)
 		return
 	}
-	writer.Write(append(b, '\n'))
-}
-
-// StartProgressReporter sends periodic progress updates
-func (ipc *IPC) StartProgressReporter(writer *os.File) {
-	// This would need to be called from main.go with a ticker
+	w.Write(append(b, '\n'))
 }
@@ -0,0 +1,390 @@
+// Package lsd implements BEP 14 Local Service Discovery: torrents are
+// announced by multicast on the local network, and hosts announcing the
+// same torrents are handed to the engine to connect to. A host that hears
+// an announce for a torrent it has announces it back, so both sides find
+// each other within moments of a torrent being added.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// Interval is how often every torrent is announced.
+	Interval = 5 * time.Minute
+
+	// minInterval is the least time between two announces of a torrent,
+	// whether periodic, for a new torrent or in answer to another host.
+	minInterval = time.Minute
+
+	// maxPerPacket bounds the info hashes in one announce, keeping it
+	// within a single unfragmented datagram.
+	maxPerPacket = 20
+
+	// A group whose socket keeps failing to read is retried after a delay
+	// that doubles from minReadBackoff up to maxReadBackoff.
+	minReadBackoff = 100 * time.Millisecond
+	maxReadBackoff = 10 * time.Second
+)
+
+// The BEP 14 multicast groups.
+var (
+	Group4 = netip.MustParseAddrPort("239.192.152.143:6771")
+	Group6 = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+// Config is what a Service announces and where it reports peers.
+type Config struct {
+	// Port is the torrent client's listen port, announced to other hosts.
+	Port int
+
+	// Torrents returns the hex info hashes to announce periodically.
+	Torrents func() []string
+
+	// Peer is called for each info hash another host announces, with the
+	// address its torrent client listens on. It reports whether the
+	// torrent is one of ours, which is then announced back.
+	Peer func(infoHash string, addr netip.AddrPort) bool
+}
+
+// Service announces torrents to, and listens for announces from, the local
+// network.
+type Service struct {
+	cfg    Config
+	logger *slog.Logger
+	// cookie tells our own announces, looped back by the network stack,
+	// from other hosts'.
+	cookie string
+	groups []*group
+	closed chan struct{}
+	once   sync.Once
+
+	mu        sync.Mutex
+	announced map[string]time.Time
+}
+
+// group is one multicast group, joined on every multicast interface of the
+// group's address family. recv is bound to the group's port; send is an
+// ephemeral socket announces go out on, once through each interface.
+type group struct {
+	addr netip.AddrPort
+	recv *net.UDPConn
+	send *net.UDPConn
+	ifis []net.Interface // empty to leave the choice to the system
+
+	// mu serialises choosing send's interface and writing to it.
+	mu   sync.Mutex
+	opts multicastOpts
+}
+
+// New joins the IPv4 and IPv6 groups and starts announcing. It fails only
+// if neither group can be joined.
+func New(cfg Config, logger *slog.Logger) (*Service, error) {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid listen port %d", cfg.Port)
+	}
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	s := &Service{
+		cfg:       cfg,
+		logger:    logger,
+		cookie:    hex.EncodeToString(cookie),
+		closed:    make(chan struct{}),
+		announced: make(map[string]time.Time),
+	}
+
+	var errs []error
+	for _, addr := range []netip.AddrPort{Group4, Group6} {
+		g, err := join(addr, logger)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.groups = append(s.groups, g)
+	}
+	if len(s.groups) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		logger.Debug("local peer discovery group unavailable", "error", err)
+	}
+
+	for _, g := range s.groups {
+		go s.listen(g)
+	}
+	go s.run()
+	return s, nil
+}
+
+// multicastOpts are the multicast socket options of ipv4.PacketConn and
+// ipv6.PacketConn.
+type multicastOpts interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	SetMulticastInterface(ifi *net.Interface) error
+}
+
+func newMulticastOpts(c net.PacketConn, is6 bool) multicastOpts {
+	if is6 {
+		return ipv6.NewPacketConn(c)
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+func join(addr netip.AddrPort, logger *slog.Logger) (*group, error) {
+	is6 := addr.Addr().Is6()
+	network := "udp4"
+	if is6 {
+		network = "udp6"
+	}
+	ifis := multicastInterfaces(is6)
+	var first *net.Interface
+	if len(ifis) > 0 {
+		first = &ifis[0]
+	}
+	gaddr := net.UDPAddrFromAddrPort(addr)
+	recv, err := net.ListenMulticastUDP(network, first, gaddr)
+	if err != nil {
+		return nil, fmt.Errorf("join %s: %w", addr, err)
+	}
+	// ListenMulticastUDP only joins the group on one interface; join it on
+	// the rest so announces arrive from every network the host is on.
+	opts := newMulticastOpts(recv, is6)
+	for i := 1; i < len(ifis); i++ {
+		if err := opts.JoinGroup(&ifis[i], gaddr); err != nil {
+			logger.Debug("local peer discovery join failed", "group", addr, "interface", ifis[i].Name, "error", err)
+		}
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		recv.Close()
+		return nil, fmt.Errorf("join %s: %w", addr, err)
+	}
+	return &group{
+		addr: addr,
+		recv: recv,
+		send: send,
+		ifis: ifis,
+		opts: newMulticastOpts(send, is6),
+	}, nil
+}
+
+// multicastInterfaces returns the interfaces that are up, support
+// multicast and have an address of the family.
+func multicastInterfaces(is6 bool) []net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ifis []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && (ipnet.IP.To4() == nil) == is6 {
+				ifis = append(ifis, ifi)
+				break
+			}
+		}
+	}
+	return ifis
+}
+
+// write sends msg to the group through each of its interfaces.
+func (g *group) write(msg []byte) error {
+	if len(g.ifis) == 0 {
+		_, err := g.send.WriteToUDPAddrPort(msg, g.addr)
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errs []error
+	for i := range g.ifis {
+		if err := g.opts.SetMulticastInterface(&g.ifis[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", g.ifis[i].Name, err))
+			continue
+		}
+		if _, err := g.send.WriteToUDPAddrPort(msg, g.addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", g.ifis[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Announce announces infoHashes now, except those announced within the
+// last minute.
+func (s *Service) Announce(infoHashes ...string) {
+	due := s.due(infoHashes)
+	for len(due) > 0 {
+		n := min(len(due), maxPerPacket)
+		for _, g := range s.groups {
+			msg := announcement(g.addr, s.cfg.Port, s.cookie, due[:n])
+			if err := g.write(msg); err != nil {
+				s.logger.Debug("local peer discovery announce failed", "group", g.addr, "error", err)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+// due returns the info hashes not announced within minInterval and records
+// them as announced now.
+func (s *Service) due(infoHashes []string) []string {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ih, at := range s.announced {
+		if now.Sub(at) >= minInterval {
+			delete(s.announced, ih)
+		}
+	}
+	var due []string
+	for _, ih := range infoHashes {
+		if _, ok := s.announced[ih]; ok {
+			continue
+		}
+		s.announced[ih] = now
+		due = append(due, ih)
+	}
+	return due
+}
+
+// run announces every torrent each Interval until the service is closed.
+func (s *Service) run() {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		s.Announce(s.cfg.Torrents()...)
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// listen reads announces from g until the service is closed, backing off
+// while reads keep failing.
+func (s *Service) listen(g *group) {
+	buf := make([]byte, 2048)
+	var backoff time.Duration
+	for {
+		n, from, err := g.recv.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			backoff = min(max(2*backoff, minReadBackoff), maxReadBackoff)
+			s.logger.Debug("local peer discovery read failed", "group", g.addr, "error", err, "retry", backoff)
+			select {
+			case <-s.closed:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		a, ok := parse(buf[:n])
+		if !ok || a.cookie == s.cookie {
+			continue
+		}
+		addr := netip.AddrPortFrom(from.Addr().Unmap(), a.port)
+		var ours []string
+		for _, ih := range a.infoHashes {
+			if s.cfg.Peer(ih, addr) {
+				ours = append(ours, ih)
+			}
+		}
+		s.Announce(ours...)
+	}
+}
+
+// Close leaves the groups and stops announcing.
+func (s *Service) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		for _, g := range s.groups {
+			g.recv.Close()
+			g.send.Close()
+		}
+	})
+	return nil
+}
+
+// announcement is a BT-SEARCH message for infoHashes.
+func announcement(group netip.AddrPort, port int, cookie string, infoHashes []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", group)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, ih := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", ih)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// announce is a parsed BT-SEARCH message.
+type announce struct {
+	port       uint16
+	cookie     string
+	infoHashes []string
+}
+
+// parse reads a BT-SEARCH message, keeping the info hashes that are 40 hex
+// digits, lowercased.
+func parse(msg []byte) (announce, bool) {
+	var a announce
+	sc := bufio.NewScanner(bytes.NewReader(msg))
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return a, false
+	}
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return a, false
+			}
+			a.port = uint16(port)
+		case "infohash":
+			if len(value) != 40 {
+				continue
+			}
+			if _, err := hex.DecodeString(value); err != nil {
+				continue
+			}
+			a.infoHashes = append(a.infoHashes, strings.ToLower(value))
+		case "cookie":
+			a.cookie = value
+		}
+	}
+	return a, a.port != 0 && len(a.infoHashes) > 0
+}
@@ -0,0 +1,234 @@
+package lsd
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testInfoHash = "0123456789abcdef0123456789abcdef01234567"
+
+// peers records the hosts a Service listening on port was told about, and
+// closes found once it hears of other.
+type peers struct {
+	port, other uint16
+	found       chan struct{}
+	once        sync.Once
+
+	mu   sync.Mutex
+	self []netip.AddrPort
+}
+
+func newPeers(port, other uint16) *peers {
+	return &peers{port: port, other: other, found: make(chan struct{})}
+}
+
+func (p *peers) peer(infoHash string, addr netip.AddrPort) bool {
+	if infoHash != testInfoHash {
+		return false
+	}
+	switch addr.Port() {
+	case p.other:
+		p.once.Do(func() { close(p.found) })
+	case p.port:
+		p.mu.Lock()
+		p.self = append(p.self, addr)
+		p.mu.Unlock()
+	}
+	return true
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// TestDiscovery runs two services on this host, as two engines would, and
+// checks each hears the other's announce through multicast loopback.
+func TestDiscovery(t *testing.T) {
+	peersA, peersB := newPeers(1111, 2222), newPeers(2222, 1111)
+	none := func() []string { return nil }
+
+	a, err := New(Config{Port: 1111, Torrents: none, Peer: peersA.peer}, testLogger())
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer a.Close()
+	b, err := New(Config{Port: 2222, Torrents: none, Peer: peersB.peer}, testLogger())
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer b.Close()
+
+	// Both are listening before either announces, so neither announce is
+	// lost to the other joining late.
+	a.Announce(testInfoHash)
+	b.Announce(testInfoHash)
+
+	timeout := time.After(5 * time.Second)
+	for _, p := range []*peers{peersA, peersB} {
+		select {
+		case <-p.found:
+		case <-timeout:
+			t.Fatalf("service on port %d never heard the one on %d", p.port, p.other)
+		}
+	}
+	for _, p := range []*peers{peersA, peersB} {
+		p.mu.Lock()
+		if len(p.self) > 0 {
+			t.Errorf("service on port %d heard its own announce from %v", p.port, p.self)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func TestAnnounceRateLimited(t *testing.T) {
+	s := &Service{announced: make(map[string]time.Time)}
+	if due := s.due([]string{testInfoHash}); len(due) != 1 {
+		t.Fatalf("first announce: due %v", due)
+	}
+	if due := s.due([]string{testInfoHash}); len(due) != 0 {
+		t.Fatalf("announce within a minute: due %v", due)
+	}
+	s.announced[testInfoHash] = time.Now().Add(-minInterval)
+	if due := s.due([]string{testInfoHash}); len(due) != 1 {
+		t.Fatalf("announce after a minute: due %v", due)
+	}
+}
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	other := strings.Repeat("f", 40)
+	msg := announcement(Group4, 6881, "cookie", []string{testInfoHash, other})
+	a, ok := parse(msg)
+	if !ok {
+		t.Fatalf("parse(%q) failed", msg)
+	}
+	if a.port != 6881 || a.cookie != "cookie" {
+		t.Fatalf("parsed port %d, cookie %q", a.port, a.cookie)
+	}
+	if len(a.infoHashes) != 2 || a.infoHashes[0] != testInfoHash || a.infoHashes[1] != other {
+		t.Fatalf("parsed info hashes %v", a.infoHashes)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		ok   bool
+		want []string
+	}{
+		{
+			name: "uppercase info hash",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + strings.ToUpper(testInfoHash) + "\r\n\r\n",
+			ok:   true,
+			want: []string{testInfoHash},
+		},
+		{
+			name: "bad info hashes skipped",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abc\r\nInfohash: " + strings.Repeat("z", 40) + "\r\nInfohash: " + testInfoHash + "\r\n\r\n",
+			ok:   true,
+			want: []string{testInfoHash},
+		},
+		{
+			name: "wrong method",
+			msg:  "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + testInfoHash + "\r\n\r\n",
+		},
+		{
+			name: "no port",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nInfohash: " + testInfoHash + "\r\n\r\n",
+		},
+		{
+			name: "port zero",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + testInfoHash + "\r\n\r\n",
+		},
+		{
+			name: "no info hash",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, ok := parse([]byte(tt.msg))
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && strings.Join(a.infoHashes, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("info hashes %v, want %v", a.infoHashes, tt.want)
+			}
+		})
+	}
+}
+
+// countHandler counts the records logged with a message.
+type countHandler struct {
+	msg string
+	n   atomic.Int64
+}
+
+func (h *countHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *countHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *countHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *countHandler) Handle(_ context.Context, r slog.Record) error {
+	if r.Message == h.msg {
+		h.n.Add(1)
+	}
+	return nil
+}
+
+func TestListenBacksOff(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Every read now fails at once, and not because the socket is closed.
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+
+	h := &countHandler{msg: "local peer discovery read failed"}
+	s := &Service{logger: slog.New(h), closed: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.listen(&group{addr: Group4, recv: conn})
+		close(done)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	// Backing off from 100ms, reads fail at 0, 100, 300 and 700ms.
+	if n := h.n.Load(); n < 1 || n > 4 {
+		t.Errorf("%d failed reads in 500ms, want a few", n)
+	}
+
+	close(s.closed)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listen still running after the service closed")
+	}
+}
+
+func TestListenStopsWhenClosed(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{logger: testLogger(), closed: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.listen(&group{addr: Group4, recv: conn})
+		close(done)
+	}()
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listen still running after its socket closed")
+	}
+}
@@ -0,0 +1,485 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Sample is one sample of an embedded subtitle track, in the track's codec.
+type Sample struct {
+	Start, End time.Duration
+	Data       []byte
+}
+
+// defaultSampleDuration is used for Matroska subtitle blocks that carry no
+// duration of their own.
+const defaultSampleDuration = 4 * time.Second
+
+// ReadSubtitles calls fn with each sample of subtitle track trackID, in
+// presentation order, as soon as it has been read. Only the data holding
+// subtitle samples is read where the container indexes it: Matroska cues
+// pointing at subtitle blocks and MP4 sample tables. Otherwise Matroska
+// clusters are scanned in order.
+func ReadSubtitles(r io.ReadSeeker, size int64, trackID int, fn func(Sample) error) error {
+	src := &source{r: r, size: size}
+	head, err := src.readAt(0, 12)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(head, ebmlMagic):
+		f, err := openMatroska(src)
+		if err != nil {
+			return err
+		}
+		return f.readSubtitles(uint64(trackID), fn)
+	case isMP4(head):
+		return readMP4Subtitles(src, uint32(trackID), fn)
+	default:
+		return ErrUnsupported
+	}
+}
+
+// ── Matroska ─────────────────────────────────────────────────────────────────
+
+const (
+	idTimestamp     = 0xe7
+	idSimpleBlock   = 0xa3
+	idBlockGroup    = 0xa0
+	idBlock         = 0xa1
+	idBlockDuration = 0x9b
+
+	idCuePoint            = 0xbb
+	idCueTrackPositions   = 0xb7
+	idCueTrack            = 0xf7
+	idCueClusterPosition  = 0xf1
+	idCueRelativePosition = 0xf0
+)
+
+// cueRef points at a cluster, and at a block inside it if rel >= 0.
+type cueRef struct {
+	cluster int64
+	rel     int64
+}
+
+func (f *mkvFile) readSubtitles(track uint64, fn func(Sample) error) error {
+	refs, err := f.cueRefs(track)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return f.scanClusters(track, fn)
+	}
+
+	scanned := make(map[int64]bool)
+	for _, ref := range refs {
+		cluster, err := f.s.element(f.seg.data+ref.cluster, f.seg.end)
+		if err != nil || cluster.id != idCluster {
+			continue
+		}
+		if ref.rel < 0 {
+			// Without a block position the whole cluster is scanned, once.
+			if !scanned[cluster.off] {
+				scanned[cluster.off] = true
+				if _, err := f.scanCluster(cluster, track, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		ts, err := f.clusterTimestamp(cluster)
+		if err != nil {
+			return err
+		}
+		block, err := f.s.element(cluster.data+ref.rel, cluster.end)
+		if err != nil {
+			continue
+		}
+		if err := f.readBlock(block, ts, track, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cueRefs returns the cue entries for track in file order, without
+// duplicates.
+func (f *mkvFile) cueRefs(track uint64) ([]cueRef, error) {
+	if f.cues < 0 {
+		return nil, nil
+	}
+	cues, err := f.s.element(f.cues, f.seg.end)
+	if err != nil || cues.id != idCues {
+		return nil, nil
+	}
+	d, err := f.s.elementData(cues)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []cueRef
+	seen := make(map[cueRef]bool)
+	err = ebmlChildren(d, func(id uint32, d []byte) error {
+		if id != idCuePoint {
+			return nil
+		}
+		return ebmlChildren(d, func(id uint32, d []byte) error {
+			if id != idCueTrackPositions {
+				return nil
+			}
+			ref := cueRef{cluster: -1, rel: -1}
+			var t uint64
+			ebmlChildren(d, func(id uint32, d []byte) error {
+				switch id {
+				case idCueTrack:
+					t = readUint(d)
+				case idCueClusterPosition:
+					ref.cluster = int64(readUint(d))
+				case idCueRelativePosition:
+					ref.rel = int64(readUint(d))
+				}
+				return nil
+			})
+			if t == track && ref.cluster >= 0 && !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+			return nil
+		})
+	})
+	return refs, err
+}
+
+// scanClusters reads every cluster in order, for files whose cues don't
+// index the track.
+func (f *mkvFile) scanClusters(track uint64, fn func(Sample) error) error {
+	if f.firstCluster < 0 {
+		return nil
+	}
+	for off := f.firstCluster; off < f.seg.end; {
+		e, err := f.s.element(off, f.seg.end)
+		if err != nil {
+			return err
+		}
+		if e.id != idCluster {
+			off = e.end
+			continue
+		}
+		if off, err = f.scanCluster(e, track, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanCluster reads the blocks of track in a cluster. Only element headers
+// and the first bytes of other tracks' blocks are read. It returns the
+// offset following the cluster, which for a cluster of unknown size is the
+// next top-level element.
+func (f *mkvFile) scanCluster(cluster element, track uint64, fn func(Sample) error) (int64, error) {
+	var ts uint64
+	for off := cluster.data; off < cluster.end; {
+		e, err := f.s.element(off, cluster.end)
+		if err != nil {
+			return 0, err
+		}
+		if cluster.unsized && topLevelID(e.id) {
+			return off, nil
+		}
+		switch e.id {
+		case idTimestamp:
+			d, err := f.s.elementData(e)
+			if err != nil {
+				return 0, err
+			}
+			ts = readUint(d)
+		case idSimpleBlock, idBlockGroup:
+			if err := f.readBlock(e, ts, track, fn); err != nil {
+				return 0, err
+			}
+		}
+		off = e.end
+	}
+	return cluster.end, nil
+}
+
+func topLevelID(id uint32) bool {
+	switch id {
+	case idCluster, idCues, idTags, idAttachments, idSeekHead, idInfo, idTracks, idChapters:
+		return true
+	}
+	return false
+}
+
+// clusterTimestamp reads a cluster's Timestamp, which precedes its blocks.
+func (f *mkvFile) clusterTimestamp(cluster element) (uint64, error) {
+	for off := cluster.data; off < cluster.end; {
+		e, err := f.s.element(off, cluster.end)
+		if err != nil {
+			return 0, err
+		}
+		switch e.id {
+		case idTimestamp:
+			d, err := f.s.elementData(e)
+			if err != nil {
+				return 0, err
+			}
+			return readUint(d), nil
+		case idSimpleBlock, idBlockGroup:
+			return 0, fmt.Errorf("cluster has no timestamp")
+		}
+		off = e.end
+	}
+	return 0, fmt.Errorf("cluster has no timestamp")
+}
+
+// readBlock passes a SimpleBlock or BlockGroup of track to fn.
+func (f *mkvFile) readBlock(e element, clusterTS uint64, track uint64, fn func(Sample) error) error {
+	block := e
+	var duration int64 = -1
+	if e.id == idBlockGroup {
+		block.id = 0
+		for off := e.data; off < e.end; {
+			c, err := f.s.element(off, e.end)
+			if err != nil {
+				return err
+			}
+			switch c.id {
+			case idBlock:
+				block = c
+			case idBlockDuration:
+				d, err := f.s.elementData(c)
+				if err != nil {
+					return err
+				}
+				duration = int64(readUint(d))
+			}
+			off = c.end
+		}
+		if block.id != idBlock {
+			return nil
+		}
+	} else if e.id != idSimpleBlock {
+		return nil
+	}
+
+	// Check the track number before reading the rest of the block.
+	head, err := f.s.readAt(block.data, min(block.end-block.data, 8))
+	if err != nil {
+		return err
+	}
+	t, n, err := ebmlSize(head)
+	if err != nil || uint64(t) != track || len(head) < n+3 {
+		return nil
+	}
+	// Laced blocks aren't used for subtitles.
+	if head[n+2]&0x06 != 0 {
+		return nil
+	}
+	d, err := f.s.elementData(block)
+	if err != nil {
+		return err
+	}
+	rel := int64(int16(binary.BigEndian.Uint16(d[n : n+2])))
+
+	tick := time.Duration(f.scale)
+	start := time.Duration(int64(clusterTS)+rel) * tick
+	end := start + defaultSampleDuration
+	if duration >= 0 {
+		end = start + time.Duration(duration)*tick
+	}
+	return fn(Sample{Start: start, End: end, Data: d[n+3:]})
+}
+
+// ── MP4 ──────────────────────────────────────────────────────────────────────
+
+// readMP4Subtitles reads the samples of a track through its sample tables,
+// so only the samples themselves are read. Fragmented files aren't
+// supported.
+func readMP4Subtitles(s *source, trackID uint32, fn func(Sample) error) error {
+	var stbl, mdhd box
+	err := s.mp4Boxes(0, s.size, func(b box) error {
+		if b.typ != "moov" {
+			return nil
+		}
+		return s.mp4Boxes(b.data, b.end, func(trak box) error {
+			if trak.typ != "trak" || stbl.typ != "" {
+				return nil
+			}
+			var id uint32
+			var tm, ts box
+			err := s.mp4Boxes(trak.data, trak.end, func(b box) error {
+				switch b.typ {
+				case "tkhd":
+					d, err := s.boxData(b)
+					if err != nil {
+						return err
+					}
+					var t Track
+					parseTkhd(d, &t)
+					id = uint32(t.ID)
+				case "mdia":
+					return s.mp4Boxes(b.data, b.end, func(b box) error {
+						switch b.typ {
+						case "mdhd":
+							tm = b
+						case "minf":
+							return s.mp4Boxes(b.data, b.end, func(b box) error {
+								if b.typ == "stbl" {
+									ts = b
+								}
+								return nil
+							})
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err == nil && id == trackID {
+				stbl, mdhd = ts, tm
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if stbl.typ == "" || mdhd.typ == "" {
+		return fmt.Errorf("track %d not found", trackID)
+	}
+
+	d, err := s.boxData(mdhd)
+	if err != nil {
+		return err
+	}
+	timescale, _ := fullBoxTimes(d)
+	if timescale == 0 {
+		return fmt.Errorf("track %d has no timescale", trackID)
+	}
+
+	tables := make(map[string][]byte)
+	err = s.mp4Boxes(stbl.data, stbl.end, func(b box) error {
+		switch b.typ {
+		case "stts", "stsc", "stsz", "stco", "co64":
+			d, err := s.boxData(b)
+			if err != nil {
+				return err
+			}
+			tables[b.typ] = d
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	samples, err := mp4Samples(tables, s.size)
+	if err != nil {
+		return err
+	}
+	for _, smp := range samples {
+		data, err := s.readAt(smp.offset, smp.size)
+		if err != nil {
+			return err
+		}
+		err = fn(Sample{
+			Start: time.Duration(smp.time) * time.Second / time.Duration(timescale),
+			End:   time.Duration(smp.time+smp.duration) * time.Second / time.Duration(timescale),
+			Data:  data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type mp4Sample struct {
+	offset, size   int64
+	time, duration uint64
+}
+
+// mp4Samples resolves the offset, size and timing of every sample from an
+// stbl's stts, stsc, stsz and stco/co64 tables. The tables come from the
+// file, so counts and indexes in them are checked against the tables' own
+// sizes and fileSize before they are trusted.
+func mp4Samples(tables map[string][]byte, fileSize int64) ([]mp4Sample, error) {
+	stsz, stsc, stts := tables["stsz"], tables["stsc"], tables["stts"]
+	if len(stsz) < 12 || len(stsc) < 8 || len(stts) < 8 {
+		return nil, fmt.Errorf("missing sample tables")
+	}
+
+	var chunks []int64
+	if co, ok := tables["stco"]; ok && len(co) >= 8 {
+		for i := 8; i+4 <= len(co); i += 4 {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(co[i:])))
+		}
+	} else if co, ok := tables["co64"]; ok && len(co) >= 8 {
+		for i := 8; i+8 <= len(co); i += 8 {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(co[i:])))
+		}
+	} else {
+		return nil, fmt.Errorf("missing chunk offsets")
+	}
+
+	fixedSize := int64(binary.BigEndian.Uint32(stsz[4:8]))
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+	switch {
+	case fixedSize == 0 && (len(stsz)-12)/4 < count:
+		return nil, fmt.Errorf("truncated stsz")
+	case fixedSize != 0 && int64(count) > fileSize/fixedSize:
+		return nil, fmt.Errorf("stsz has more samples than fit in the file")
+	}
+	samples := make([]mp4Sample, 0, count)
+	sizeOf := func(i int) int64 {
+		if fixedSize != 0 {
+			return fixedSize
+		}
+		return int64(binary.BigEndian.Uint32(stsz[12+4*i:]))
+	}
+
+	// stsc runs: first_chunk (1-based), samples_per_chunk, description index.
+	type run struct{ first, perChunk int }
+	var runs []run
+	for i := 8; i+12 <= len(stsc); i += 12 {
+		runs = append(runs, run{
+			first:    int(binary.BigEndian.Uint32(stsc[i:])),
+			perChunk: int(binary.BigEndian.Uint32(stsc[i+4:])),
+		})
+	}
+	for r, ru := range runs {
+		if ru.first < 1 || ru.first > len(chunks) {
+			return nil, fmt.Errorf("stsc first chunk %d out of range", ru.first)
+		}
+		last := len(chunks)
+		if r+1 < len(runs) {
+			last = runs[r+1].first - 1
+		}
+		for c := ru.first; c <= last && c-1 < len(chunks); c++ {
+			off := chunks[c-1]
+			for k := 0; k < ru.perChunk && len(samples) < count; k++ {
+				size := sizeOf(len(samples))
+				samples = append(samples, mp4Sample{offset: off, size: size})
+				off += size
+			}
+		}
+	}
+
+	// stts runs: sample_count, sample_delta.
+	var t uint64
+	i := 0
+	for j := 8; j+8 <= len(stts); j += 8 {
+		n := int(binary.BigEndian.Uint32(stts[j:]))
+		delta := uint64(binary.BigEndian.Uint32(stts[j+4:]))
+		for k := 0; k < n && i < len(samples); k++ {
+			samples[i].time, samples[i].duration = t, delta
+			t += delta
+			i++
+		}
+	}
+	return samples, nil
+}
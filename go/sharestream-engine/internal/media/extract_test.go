@@ -0,0 +1,74 @@
+package media
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fullBox is the body of a full box: version and flags, then fields.
+func fullBox(fields ...uint32) []byte {
+	b := make([]byte, 4, 4+4*len(fields))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint32(b, f)
+	}
+	return b
+}
+
+func TestMP4Samples(t *testing.T) {
+	tables := map[string][]byte{
+		// Three samples of 10, 20 and 30 bytes.
+		"stsz": fullBox(0, 3, 10, 20, 30),
+		// Chunk 1 holds two samples, chunk 2 one.
+		"stsc": fullBox(2, 1, 2, 1, 2, 1, 1),
+		"stco": fullBox(2, 100, 500),
+		// Every sample lasts 1000 ticks.
+		"stts": fullBox(1, 3, 1000),
+	}
+	got, err := mp4Samples(tables, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mp4Sample{
+		{offset: 100, size: 10, time: 0, duration: 1000},
+		{offset: 110, size: 20, time: 1000, duration: 1000},
+		{offset: 500, size: 30, time: 2000, duration: 1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mp4Samples =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestMP4SamplesInvalid(t *testing.T) {
+	valid := func() map[string][]byte {
+		return map[string][]byte{
+			"stsz": fullBox(0, 2, 10, 20),
+			"stsc": fullBox(1, 1, 2, 1),
+			"stco": fullBox(1, 100),
+			"stts": fullBox(1, 2, 1000),
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(map[string][]byte)
+		want   string
+	}{
+		{"zero first chunk", func(tb map[string][]byte) { tb["stsc"] = fullBox(1, 0, 2, 1) }, "out of range"},
+		{"first chunk past chunk table", func(tb map[string][]byte) { tb["stsc"] = fullBox(1, 2, 2, 1) }, "out of range"},
+		{"sample count past stsz", func(tb map[string][]byte) { tb["stsz"] = fullBox(0, 0xffffffff, 10) }, "truncated stsz"},
+		{"fixed size count past file", func(tb map[string][]byte) { tb["stsz"] = fullBox(16, 0xffffffff) }, "more samples than fit"},
+		{"no chunk offsets", func(tb map[string][]byte) { delete(tb, "stco") }, "missing chunk offsets"},
+		{"no sample sizes", func(tb map[string][]byte) { delete(tb, "stsz") }, "missing sample tables"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables := valid()
+			tt.modify(tables)
+			_, err := mp4Samples(tables, 1000)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
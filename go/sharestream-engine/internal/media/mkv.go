@@ -0,0 +1,434 @@
+package media
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+var ebmlMagic = []byte{0x1a, 0x45, 0xdf, 0xa3}
+
+// Matroska element IDs.
+const (
+	idEBML    = 0x1a45dfa3
+	idDocType = 0x4282
+
+	idSegment      = 0x18538067
+	idSeekHead     = 0x114d9b74
+	idSeek         = 0x4dbb
+	idSeekID       = 0x53ab
+	idSeekPosition = 0x53ac
+	idCluster      = 0x1f43b675
+	idCues         = 0x1c53bb6b
+	idTags         = 0x1254c367
+	idAttachments  = 0x1941a469
+
+	idInfo           = 0x1549a966
+	idTimestampScale = 0x2ad7b1
+	idDuration       = 0x4489
+	idTitle          = 0x7ba9
+
+	idTracks            = 0x1654ae6b
+	idTrackEntry        = 0xae
+	idTrackNumber       = 0xd7
+	idTrackType         = 0x83
+	idCodecID           = 0x86
+	idLanguage          = 0x22b59c
+	idLanguageBCP47     = 0x22b59d
+	idName              = 0x536e
+	idFlagDefault       = 0x88
+	idFlagForced        = 0x55aa
+	idVideo             = 0xe0
+	idPixelWidth        = 0xb0
+	idPixelHeight       = 0xba
+	idAudio             = 0xe1
+	idSamplingFrequency = 0xb5
+	idChannels          = 0x9f
+
+	idChapters          = 0x1043a770
+	idEditionEntry      = 0x45b9
+	idChapterAtom       = 0xb6
+	idChapterTimeStart  = 0x91
+	idChapterFlagHidden = 0x98
+	idChapterDisplay    = 0x80
+	idChapString        = 0x85
+)
+
+const unknownSize = -1
+
+// element is an EBML element header: the payload spans [data, end).
+type element struct {
+	id        uint32
+	off       int64
+	data, end int64
+	unsized   bool
+}
+
+// element reads the header of the element at off, which must end by limit.
+// Elements of unknown size extend to limit.
+func (s *source) element(off, limit int64) (element, error) {
+	h, err := s.readAt(off, 12)
+	if err != nil {
+		return element{}, err
+	}
+	id, n, err := ebmlID(h)
+	if err != nil {
+		return element{}, err
+	}
+	size, m, err := ebmlSize(h[n:])
+	if err != nil {
+		return element{}, err
+	}
+	e := element{id: id, off: off, data: off + int64(n+m)}
+	if size == unknownSize {
+		e.end = limit
+		e.unsized = true
+	} else {
+		e.end = e.data + size
+	}
+	if e.end > limit {
+		return element{}, fmt.Errorf("element %x overruns its parent", id)
+	}
+	return e, nil
+}
+
+func (s *source) elementData(e element) ([]byte, error) {
+	return s.readAt(e.data, e.end-e.data)
+}
+
+// ebmlID reads an element ID, keeping its length marker as Matroska IDs
+// are written.
+func ebmlID(b []byte) (uint32, int, error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, fmt.Errorf("invalid EBML ID")
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if n > 4 || len(b) < n {
+		return 0, 0, fmt.Errorf("invalid EBML ID")
+	}
+	return uint32(readUint(b[:n])), n, nil
+}
+
+// ebmlSize reads an element data size; all value bits set means unknown.
+func ebmlSize(b []byte) (int64, int, error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, fmt.Errorf("invalid EBML size")
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, fmt.Errorf("invalid EBML size")
+	}
+	v := readUint(b[:n]) &^ (1 << (7 * n))
+	if v == 1<<(7*n)-1 {
+		return unknownSize, n, nil
+	}
+	return int64(v), n, nil
+}
+
+// ebmlChildren calls fn for each child element of an in-memory master
+// element. A truncated or unknown-size last child gets the remaining bytes.
+func ebmlChildren(b []byte, fn func(id uint32, data []byte) error) error {
+	for len(b) > 0 {
+		id, n, err := ebmlID(b)
+		if err != nil {
+			return err
+		}
+		size, m, err := ebmlSize(b[n:])
+		if err != nil {
+			return err
+		}
+		b = b[n+m:]
+		if size == unknownSize || size > int64(len(b)) {
+			size = int64(len(b))
+		}
+		if err := fn(id, b[:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func probeMatroska(s *source) (*Info, error) {
+	f, err := openMatroska(s)
+	if err != nil {
+		return nil, err
+	}
+	return f.info, nil
+}
+
+// openMatroska reads a Matroska file's metadata and locates its clusters.
+func openMatroska(s *source) (*mkvFile, error) {
+	header, err := s.element(0, s.size)
+	if err != nil {
+		return nil, err
+	}
+	hb, err := s.elementData(header)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{Container: "matroska", Tracks: []Track{}}
+	ebmlChildren(hb, func(id uint32, d []byte) error {
+		if id == idDocType && readString(d) == "webm" {
+			info.Container = "webm"
+		}
+		return nil
+	})
+
+	seg, err := s.element(header.end, s.size)
+	if err != nil {
+		return nil, err
+	}
+	if seg.id != idSegment {
+		return nil, fmt.Errorf("no matroska segment")
+	}
+
+	p := &mkvFile{
+		s:            s,
+		seg:          seg,
+		info:         info,
+		scale:        1000000,
+		firstCluster: -1,
+		cues:         -1,
+		positions:    make(map[uint32]int64),
+		visited:      make(map[int64]bool),
+		found:        make(map[uint32]bool),
+	}
+
+	// Metadata normally precedes the first cluster. Anything written after
+	// the clusters is reached through the seek head instead of walking the
+	// media data.
+	for off := seg.data; off < seg.end; {
+		e, err := s.element(off, seg.end)
+		if err != nil {
+			return nil, err
+		}
+		if e.id == idCluster {
+			p.firstCluster = e.off
+			break
+		}
+		if e.id == idCues {
+			p.cues = e.off
+		}
+		if err := p.topLevel(e); err != nil {
+			return nil, err
+		}
+		off = e.end
+	}
+	for _, id := range []uint32{idSeekHead, idInfo, idTracks, idChapters} {
+		pos, ok := p.positions[id]
+		if !ok || (id != idSeekHead && p.found[id]) || p.visited[seg.data+pos] {
+			continue
+		}
+		e, err := s.element(seg.data+pos, seg.end)
+		if err != nil || e.id != id {
+			continue
+		}
+		if err := p.topLevel(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.found[idTracks] {
+		return nil, fmt.Errorf("no matroska tracks")
+	}
+	if pos, ok := p.positions[idCues]; ok && p.cues < 0 {
+		p.cues = seg.data + pos
+	}
+	return p, nil
+}
+
+type mkvFile struct {
+	s     *source
+	seg   element
+	info  *Info
+	scale uint64 // nanoseconds per timestamp tick
+
+	// Offsets of the first cluster and of the cues, or -1 if not found.
+	firstCluster int64
+	cues         int64
+
+	positions map[uint32]int64 // from seek heads, relative to the segment
+	visited   map[int64]bool
+	found     map[uint32]bool
+}
+
+func (p *mkvFile) topLevel(e element) error {
+	switch e.id {
+	case idSeekHead, idInfo, idTracks, idChapters:
+	default:
+		return nil
+	}
+	p.visited[e.off] = true
+	p.found[e.id] = true
+
+	d, err := p.s.elementData(e)
+	if err != nil {
+		return err
+	}
+	switch e.id {
+	case idSeekHead:
+		return parseSeekHead(d, p.positions)
+	case idInfo:
+		return parseSegmentInfo(d, p.info, &p.scale)
+	case idTracks:
+		return ebmlChildren(d, func(id uint32, d []byte) error {
+			if id != idTrackEntry {
+				return nil
+			}
+			t, err := parseTrackEntry(d)
+			if err != nil {
+				return err
+			}
+			p.info.Tracks = append(p.info.Tracks, t)
+			return nil
+		})
+	case idChapters:
+		return parseChapters(d, p.info)
+	}
+	return nil
+}
+
+func parseSeekHead(d []byte, positions map[uint32]int64) error {
+	return ebmlChildren(d, func(id uint32, d []byte) error {
+		if id != idSeek {
+			return nil
+		}
+		var target uint32
+		var pos int64 = -1
+		err := ebmlChildren(d, func(id uint32, d []byte) error {
+			switch id {
+			case idSeekID:
+				target = uint32(readUint(d))
+			case idSeekPosition:
+				pos = int64(readUint(d))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := positions[target]; !ok && target != 0 && pos >= 0 {
+			positions[target] = pos
+		}
+		return nil
+	})
+}
+
+func parseSegmentInfo(d []byte, info *Info, scale *uint64) error {
+	var duration float64
+	err := ebmlChildren(d, func(id uint32, d []byte) error {
+		switch id {
+		case idTimestampScale:
+			*scale = readUint(d)
+		case idDuration:
+			duration = readFloat(d)
+		case idTitle:
+			info.Title = readString(d)
+		}
+		return nil
+	})
+	info.Duration = duration * float64(*scale) / 1e9
+	return err
+}
+
+func parseTrackEntry(d []byte) (Track, error) {
+	t := Track{Type: "other", Default: true}
+	lang, bcp47 := "eng", ""
+	err := ebmlChildren(d, func(id uint32, d []byte) error {
+		switch id {
+		case idTrackNumber:
+			t.ID = int(readUint(d))
+		case idTrackType:
+			switch readUint(d) {
+			case 1:
+				t.Type = "video"
+			case 2:
+				t.Type = "audio"
+			case 17:
+				t.Type = "subtitle"
+			}
+		case idCodecID:
+			t.CodecID = readString(d)
+			t.Codec = codecName(t.CodecID)
+		case idLanguage:
+			lang = readString(d)
+		case idLanguageBCP47:
+			bcp47 = readString(d)
+		case idName:
+			t.Name = readString(d)
+		case idFlagDefault:
+			t.Default = readUint(d) != 0
+		case idFlagForced:
+			t.Forced = readUint(d) != 0
+		case idVideo:
+			return ebmlChildren(d, func(id uint32, d []byte) error {
+				switch id {
+				case idPixelWidth:
+					t.Width = int(readUint(d))
+				case idPixelHeight:
+					t.Height = int(readUint(d))
+				}
+				return nil
+			})
+		case idAudio:
+			t.Channels, t.SampleRate = 1, 8000
+			return ebmlChildren(d, func(id uint32, d []byte) error {
+				switch id {
+				case idChannels:
+					t.Channels = int(readUint(d))
+				case idSamplingFrequency:
+					t.SampleRate = readFloat(d)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if bcp47 != "" {
+		lang = bcp47
+	}
+	if lang != "und" {
+		t.Language = lang
+	}
+	return t, err
+}
+
+// parseChapters reads the top-level chapters of the first edition.
+func parseChapters(d []byte, info *Info) error {
+	return ebmlChildren(d, func(id uint32, d []byte) error {
+		if id != idEditionEntry || info.Chapters != nil {
+			return nil
+		}
+		info.Chapters = []Chapter{}
+		return ebmlChildren(d, func(id uint32, d []byte) error {
+			if id != idChapterAtom {
+				return nil
+			}
+			var c Chapter
+			hidden := false
+			err := ebmlChildren(d, func(id uint32, d []byte) error {
+				switch id {
+				case idChapterTimeStart:
+					c.Start = float64(readUint(d)) / 1e9
+				case idChapterFlagHidden:
+					hidden = readUint(d) != 0
+				case idChapterDisplay:
+					if c.Title != "" {
+						return nil
+					}
+					return ebmlChildren(d, func(id uint32, d []byte) error {
+						if id == idChapString {
+							c.Title = readString(d)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err == nil && !hidden {
+				info.Chapters = append(info.Chapters, c)
+			}
+			return err
+		})
+	})
+}
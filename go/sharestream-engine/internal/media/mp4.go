@@ -0,0 +1,350 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// isMP4 recognizes the top-level boxes an MP4/MOV file starts with.
+func isMP4(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	switch string(head[4:8]) {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide":
+		return true
+	}
+	return false
+}
+
+// box is an MP4 box header: the payload spans [data, end).
+type box struct {
+	typ       string
+	data, end int64
+}
+
+// mp4Boxes calls fn for each box in [start, end), reading only box headers.
+func (s *source) mp4Boxes(start, end int64, fn func(b box) error) error {
+	for off := start; off+8 <= end; {
+		h, err := s.readAt(off, 16)
+		if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(h[0:4]))
+		b := box{typ: string(h[4:8]), data: off + 8}
+		switch size {
+		case 0: // extends to the end of its parent
+			b.end = end
+		case 1: // 64-bit size follows the type
+			if len(h) < 16 {
+				return fmt.Errorf("truncated %q box", b.typ)
+			}
+			size = int64(binary.BigEndian.Uint64(h[8:16]))
+			b.data += 8
+			b.end = off + size
+		default:
+			b.end = off + size
+		}
+		if b.end < b.data || b.end > end {
+			return fmt.Errorf("invalid %q box size", b.typ)
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+		off = b.end
+	}
+	return nil
+}
+
+func (s *source) boxData(b box) ([]byte, error) {
+	return s.readAt(b.data, b.end-b.data)
+}
+
+func probeMP4(s *source) (*Info, error) {
+	info := &Info{Container: "mp4", Tracks: []Track{}}
+	foundMoov := false
+	err := s.mp4Boxes(0, s.size, func(b box) error {
+		switch b.typ {
+		case "ftyp":
+			d, err := s.readAt(b.data, 4)
+			if err != nil {
+				return err
+			}
+			if string(d) == "qt  " {
+				info.Container = "mov"
+			}
+		case "moov":
+			foundMoov = true
+			return s.parseMoov(b, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundMoov {
+		return nil, fmt.Errorf("no moov box")
+	}
+	return info, nil
+}
+
+func (s *source) parseMoov(moov box, info *Info) error {
+	var trackDuration float64
+	err := s.mp4Boxes(moov.data, moov.end, func(b box) error {
+		switch b.typ {
+		case "mvhd":
+			d, err := s.boxData(b)
+			if err != nil {
+				return err
+			}
+			timescale, duration := fullBoxTimes(d)
+			if timescale > 0 {
+				info.Duration = float64(duration) / float64(timescale)
+			}
+		case "trak":
+			t, duration, err := s.parseTrak(b)
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				info.Tracks = append(info.Tracks, *t)
+			}
+			trackDuration = max(trackDuration, duration)
+		case "udta":
+			return s.mp4Boxes(b.data, b.end, func(b box) error {
+				if b.typ != "chpl" {
+					return nil
+				}
+				d, err := s.boxData(b)
+				if err != nil {
+					return err
+				}
+				info.Chapters = parseChpl(d)
+				return nil
+			})
+		}
+		return nil
+	})
+	// Fragmented files leave mvhd's duration unset.
+	if info.Duration == 0 {
+		info.Duration = trackDuration
+	}
+	return err
+}
+
+// fullBoxTimes reads the timescale and duration shared by the mvhd and mdhd
+// layouts.
+func fullBoxTimes(d []byte) (timescale uint32, duration uint64) {
+	if len(d) < 4 {
+		return 0, 0
+	}
+	if d[0] == 1 {
+		if len(d) < 32 {
+			return 0, 0
+		}
+		return binary.BigEndian.Uint32(d[20:24]), binary.BigEndian.Uint64(d[24:32])
+	}
+	if len(d) < 20 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(d[12:16]), uint64(binary.BigEndian.Uint32(d[16:20]))
+}
+
+// parseTrak returns the track described by a trak box and its duration in
+// seconds. Tracks of unknown handler types are skipped.
+func (s *source) parseTrak(trak box) (*Track, float64, error) {
+	t := &Track{Type: "other"}
+	var duration float64
+	var stsd box
+	var mdia box
+
+	err := s.mp4Boxes(trak.data, trak.end, func(b box) error {
+		switch b.typ {
+		case "tkhd":
+			d, err := s.boxData(b)
+			if err != nil {
+				return err
+			}
+			parseTkhd(d, t)
+		case "mdia":
+			mdia = b
+		}
+		return nil
+	})
+	if err != nil || mdia.typ == "" {
+		return nil, 0, err
+	}
+
+	err = s.mp4Boxes(mdia.data, mdia.end, func(b box) error {
+		switch b.typ {
+		case "mdhd":
+			d, err := s.boxData(b)
+			if err != nil {
+				return err
+			}
+			timescale, dur := fullBoxTimes(d)
+			if timescale > 0 {
+				duration = float64(dur) / float64(timescale)
+			}
+			t.Language = mdhdLanguage(d)
+		case "hdlr":
+			d, err := s.boxData(b)
+			if err != nil {
+				return err
+			}
+			if len(d) >= 12 {
+				t.Type = handlerType(string(d[8:12]))
+			}
+			if len(d) > 24 {
+				t.Name = readString(d[24:])
+			}
+		case "minf":
+			return s.mp4Boxes(b.data, b.end, func(b box) error {
+				if b.typ != "stbl" {
+					return nil
+				}
+				return s.mp4Boxes(b.data, b.end, func(b box) error {
+					if b.typ == "stsd" {
+						stsd = b
+					}
+					return nil
+				})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if stsd.typ != "" {
+		// Only the first sample entry's header is needed, not the whole
+		// stsd, which can carry large codec private data.
+		d, err := s.readAt(stsd.data, min(stsd.end-stsd.data, 64))
+		if err != nil {
+			return nil, 0, err
+		}
+		parseSampleEntry(d, t)
+	}
+	if t.Type == "other" && t.CodecID == "" {
+		return nil, duration, nil
+	}
+	return t, duration, nil
+}
+
+func parseTkhd(d []byte, t *Track) {
+	// version(1) flags(3), then times whose width depends on the version.
+	idOff, sizeOff := 12, 76
+	if len(d) > 0 && d[0] == 1 {
+		idOff, sizeOff = 20, 88
+	}
+	if len(d) >= idOff+4 {
+		t.ID = int(binary.BigEndian.Uint32(d[idOff : idOff+4]))
+	}
+	if len(d) >= sizeOff+8 {
+		// 16.16 fixed point
+		t.Width = int(binary.BigEndian.Uint32(d[sizeOff:sizeOff+4]) >> 16)
+		t.Height = int(binary.BigEndian.Uint32(d[sizeOff+4:sizeOff+8]) >> 16)
+	}
+	// The enabled flag is the closest MP4 has to a default track.
+	if len(d) >= 4 {
+		t.Default = d[3]&1 != 0
+	}
+}
+
+// mdhdLanguage unpacks the ISO 639-2 code stored as three 5-bit letters.
+func mdhdLanguage(d []byte) string {
+	off := 20
+	if len(d) > 0 && d[0] == 1 {
+		off = 32
+	}
+	if len(d) < off+2 {
+		return ""
+	}
+	v := binary.BigEndian.Uint16(d[off : off+2])
+	// Smaller values are QuickTime's Macintosh language codes.
+	if v < 0x400 {
+		return ""
+	}
+	lang := string([]byte{
+		byte(v>>10&0x1f) + 0x60,
+		byte(v>>5&0x1f) + 0x60,
+		byte(v&0x1f) + 0x60,
+	})
+	if lang == "und" {
+		return ""
+	}
+	return lang
+}
+
+func handlerType(h string) string {
+	switch h {
+	case "vide":
+		return "video"
+	case "soun":
+		return "audio"
+	case "sbtl", "subt", "text":
+		return "subtitle"
+	}
+	return "other"
+}
+
+// parseSampleEntry reads the codec and basic parameters from the start of
+// an stsd box.
+func parseSampleEntry(d []byte, t *Track) {
+	// version(1) flags(3) entry_count(4), then the first entry's size and
+	// type, reserved(6) and data_reference_index(2).
+	if len(d) < 24 {
+		return
+	}
+	t.CodecID = string(d[12:16])
+	t.Codec = codecName(t.CodecID)
+	e := d[24:]
+	switch t.Type {
+	case "video":
+		// pre_defined/reserved(16), width(2), height(2)
+		if len(e) >= 20 && t.Width == 0 {
+			t.Width = int(binary.BigEndian.Uint16(e[16:18]))
+			t.Height = int(binary.BigEndian.Uint16(e[18:20]))
+		}
+	case "audio":
+		// reserved(8), channelcount(2), samplesize(2), pre_defined(2),
+		// reserved(2), samplerate(4, 16.16)
+		if len(e) >= 20 {
+			t.Channels = int(binary.BigEndian.Uint16(e[8:10]))
+			t.SampleRate = float64(binary.BigEndian.Uint32(e[16:20]) >> 16)
+		}
+	}
+}
+
+// parseChpl reads Nero chapters, whose start times are in 100ns units.
+func parseChpl(d []byte) []Chapter {
+	if len(d) < 5 {
+		return nil
+	}
+	off := 4
+	if d[0] == 1 {
+		off += 4
+	}
+	if len(d) <= off {
+		return nil
+	}
+	count := int(d[off])
+	off++
+
+	var chapters []Chapter
+	for i := 0; i < count && off+9 <= len(d); i++ {
+		start := binary.BigEndian.Uint64(d[off : off+8])
+		n := int(d[off+8])
+		off += 9
+		if off+n > len(d) {
+			break
+		}
+		chapters = append(chapters, Chapter{
+			Start: float64(start) / 1e7,
+			Title: string(d[off : off+n]),
+		})
+		off += n
+	}
+	return chapters
+}
@@ -0,0 +1,171 @@
+// Package media reads container metadata (MP4/MOV and Matroska/WebM) in pure
+// Go. Parsers seek past media data and only read the headers they need, so
+// probing a torrent file fetches as few pieces as possible.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrUnsupported = errors.New("unsupported container")
+
+// Info describes a media file.
+type Info struct {
+	Container string    `json:"container"`
+	Duration  float64   `json:"duration"` // seconds, 0 if unknown
+	Title     string    `json:"title,omitempty"`
+	Tracks    []Track   `json:"tracks"`
+	Chapters  []Chapter `json:"chapters,omitempty"`
+}
+
+// Track is one video, audio or subtitle track.
+type Track struct {
+	ID       int    `json:"id"`   // Matroska TrackNumber or MP4 track_ID
+	Type     string `json:"type"` // "video", "audio", "subtitle" or "other"
+	Codec    string `json:"codec"`
+	CodecID  string `json:"codecId"` // as stored in the container
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	Channels   int     `json:"channels,omitempty"`
+	SampleRate float64 `json:"sampleRate,omitempty"`
+}
+
+// Chapter is a chapter start in seconds.
+type Chapter struct {
+	Start float64 `json:"start"`
+	Title string  `json:"title,omitempty"`
+}
+
+// Probe reads the metadata of a size byte file from r.
+func Probe(r io.ReadSeeker, size int64) (*Info, error) {
+	src := &source{r: r, size: size}
+	head, err := src.readAt(0, 12)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, ebmlMagic):
+		return probeMatroska(src)
+	case isMP4(head):
+		return probeMP4(src)
+	default:
+		return nil, ErrUnsupported
+	}
+}
+
+// source reads byte ranges of a file by seeking, so skipped regions are
+// never read.
+type source struct {
+	r    io.ReadSeeker
+	size int64
+}
+
+// maxRead bounds any single metadata read, guarding against corrupt sizes.
+const maxRead = 16 << 20
+
+// readAt reads up to n bytes at off; it only returns fewer at end of file.
+func (s *source) readAt(off, n int64) ([]byte, error) {
+	if off >= s.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if off+n > s.size {
+		n = s.size - off
+	}
+	if n > maxRead {
+		return nil, fmt.Errorf("element too large (%d bytes)", n)
+	}
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func readFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func readString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// codecNames maps container codec IDs to short, player-friendly names.
+var codecNames = map[string]string{
+	// Matroska
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+	"V_VP8":            "vp8",
+	"V_VP9":            "vp9",
+	"V_AV1":            "av1",
+	"V_MPEG2":          "mpeg2video",
+	"A_AAC":            "aac",
+	"A_AC3":            "ac3",
+	"A_EAC3":           "eac3",
+	"A_DTS":            "dts",
+	"A_MPEG/L3":        "mp3",
+	"A_OPUS":           "opus",
+	"A_VORBIS":         "vorbis",
+	"A_FLAC":           "flac",
+	"A_TRUEHD":         "truehd",
+	"S_TEXT/UTF8":      "subrip",
+	"S_TEXT/ASS":       "ass",
+	"S_TEXT/SSA":       "ssa",
+	"S_TEXT/WEBVTT":    "webvtt",
+	"S_HDMV/PGS":       "pgs",
+	"S_VOBSUB":         "dvdsub",
+
+	// MP4 sample entries
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"vp09": "vp9",
+	"av01": "av1",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"Opus": "opus",
+	"fLaC": "flac",
+	".mp3": "mp3",
+	"tx3g": "mov_text",
+	"wvtt": "webvtt",
+	"stpp": "ttml",
+}
+
+func codecName(id string) string {
+	if name, ok := codecNames[id]; ok {
+		return name
+	}
+	return id
+}
@@ -0,0 +1,282 @@
+// Package memstore is torrent storage that holds pieces in a bounded pool
+// of memory instead of on disk, for viewers who only stream. When the pool
+// is full, the piece least worth keeping is discarded: pinned pieces (the
+// ones around a playhead) are kept, and of the rest the one read least
+// recently and least often, by the player or by peers, goes first. The
+// client downloads a discarded piece again if it is needed.
+package memstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// DefaultCapacity is the pool size used when none is configured.
+const DefaultCapacity = 256 << 20
+
+const (
+	// hitHalfLife is how long it takes a piece's read count to halve.
+	hitHalfLife = time.Minute
+
+	// writeGrace is how long an incomplete piece being written is kept
+	// from eviction, so a slow download isn't thrown away midway.
+	writeGrace = 30 * time.Second
+)
+
+var errEvicted = errors.New("piece not in memory")
+
+// Client is a pool of memory shared by the torrents opened with it.
+type Client struct {
+	capacity int64
+	// capacityFn is shared by every torrent, which tells the client they
+	// share one pool.
+	capacityFn func() (int64, bool)
+
+	mu       sync.Mutex
+	used     int64
+	torrents map[metainfo.Hash]*torrentPieces
+}
+
+type torrentPieces struct {
+	pieces map[int]*slot
+	pinned map[int]bool
+}
+
+// slot holds one piece. hits counts reads, decaying with hitHalfLife since
+// read.
+type slot struct {
+	data     []byte
+	complete bool
+	hits     float64
+	read     time.Time
+	written  time.Time
+}
+
+// New returns a pool of capacity bytes, or DefaultCapacity if capacity is
+// not positive.
+func New(capacity int64) *Client {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	c := &Client{
+		capacity: capacity,
+		torrents: make(map[metainfo.Hash]*torrentPieces),
+	}
+	c.capacityFn = func() (int64, bool) { return c.capacity, true }
+	return c
+}
+
+func (c *Client) OpenTorrent(ctx context.Context, info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	c.mu.Lock()
+	if _, ok := c.torrents[infoHash]; !ok {
+		c.torrents[infoHash] = &torrentPieces{
+			pieces: make(map[int]*slot),
+			pinned: make(map[int]bool),
+		}
+	}
+	c.mu.Unlock()
+
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return &piece{c: c, ih: infoHash, index: p.Index(), length: p.Length()}
+		},
+		Close: func() error {
+			c.release(infoHash)
+			return nil
+		},
+		Capacity: &c.capacityFn,
+	}, nil
+}
+
+// Close frees every piece.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.torrents = make(map[metainfo.Hash]*torrentPieces)
+	c.used = 0
+	return nil
+}
+
+// Capacity returns the pool's size in bytes.
+func (c *Client) Capacity() int64 {
+	return c.capacity
+}
+
+// Used returns the bytes held for infoHash.
+func (c *Client) Used(infoHash metainfo.Hash) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	if tp, ok := c.torrents[infoHash]; ok {
+		for _, s := range tp.pieces {
+			n += int64(len(s.data))
+		}
+	}
+	return n
+}
+
+// Pin replaces the pieces of a torrent that must not be evicted.
+func (c *Client) Pin(infoHash metainfo.Hash, pieces []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tp, ok := c.torrents[infoHash]
+	if !ok {
+		return
+	}
+	tp.pinned = make(map[int]bool, len(pieces))
+	for _, i := range pieces {
+		tp.pinned[i] = true
+	}
+}
+
+func (c *Client) release(infoHash metainfo.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tp, ok := c.torrents[infoHash]
+	if !ok {
+		return
+	}
+	for _, s := range tp.pieces {
+		c.used -= int64(len(s.data))
+	}
+	delete(c.torrents, infoHash)
+}
+
+// slotLocked returns a piece's slot, allocating it if create is set.
+func (c *Client) slotLocked(p *piece, create bool, now time.Time) *slot {
+	tp, ok := c.torrents[p.ih]
+	if !ok {
+		return nil
+	}
+	s := tp.pieces[p.index]
+	if s != nil || !create {
+		return s
+	}
+	c.makeRoomLocked(p.length, now)
+	s = &slot{data: make([]byte, p.length), read: now}
+	tp.pieces[p.index] = s
+	c.used += p.length
+	return s
+}
+
+// makeRoomLocked evicts pieces until n more bytes fit. If everything left
+// is pinned or being written, the pool is allowed to grow past its
+// capacity until something can be evicted.
+func (c *Client) makeRoomLocked(n int64, now time.Time) {
+	for c.used+n > c.capacity {
+		var victim *slot
+		var victimPieces *torrentPieces
+		victimIndex := -1
+		for _, tp := range c.torrents {
+			for i, s := range tp.pieces {
+				if tp.pinned[i] || (!s.complete && now.Sub(s.written) < writeGrace) {
+					continue
+				}
+				if victim == nil || less(s, victim, now) {
+					victim, victimPieces, victimIndex = s, tp, i
+				}
+			}
+		}
+		if victim == nil {
+			return
+		}
+		delete(victimPieces.pieces, victimIndex)
+		c.used -= int64(len(victim.data))
+	}
+}
+
+// less reports whether a is less worth keeping than b.
+func less(a, b *slot, now time.Time) bool {
+	ha, hb := a.hitsAt(now), b.hitsAt(now)
+	if ha != hb {
+		return ha < hb
+	}
+	return a.read.Before(b.read)
+}
+
+func (s *slot) hitsAt(now time.Time) float64 {
+	return s.hits * math.Exp2(-now.Sub(s.read).Seconds()/hitHalfLife.Seconds())
+}
+
+type piece struct {
+	c      *Client
+	ih     metainfo.Hash
+	index  int
+	length int64
+}
+
+func (p *piece) ReadAt(b []byte, off int64) (int, error) {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	now := time.Now()
+	s := p.c.slotLocked(p, false, now)
+	if s == nil {
+		return 0, errEvicted
+	}
+	// Hashing reads incomplete pieces; only count reads of finished ones.
+	if s.complete {
+		s.hits = s.hitsAt(now) + 1
+		s.read = now
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *piece) WriteAt(b []byte, off int64) (int, error) {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	now := time.Now()
+	s := p.c.slotLocked(p, true, now)
+	if s == nil {
+		return 0, errEvicted
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.ErrShortWrite
+	}
+	s.written = now
+	n := copy(s.data[off:], b)
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (p *piece) MarkComplete() error {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	s := p.c.slotLocked(p, false, time.Now())
+	if s == nil {
+		return errEvicted
+	}
+	s.complete = true
+	return nil
+}
+
+func (p *piece) MarkNotComplete() error {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	if s := p.c.slotLocked(p, false, time.Now()); s != nil {
+		s.complete = false
+	}
+	return nil
+}
+
+func (p *piece) Completion() storage.Completion {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	s := p.c.slotLocked(p, false, time.Now())
+	return storage.Completion{Complete: s != nil && s.complete, Ok: true}
+}
@@ -0,0 +1,58 @@
+// Package quota decides which downloads to evict when the engine's data
+// directory grows past its quota: completed, idle torrents, least recently
+// watched first.
+package quota
+
+import (
+	"sort"
+	"time"
+)
+
+// Torrent is one download's share of the data directory.
+type Torrent struct {
+	InfoHash   string    `json:"infoHash"`
+	Name       string    `json:"name"`
+	Bytes      int64     `json:"bytes"`
+	LastAccess time.Time `json:"lastAccess"`
+	// Evictable is false while a torrent is downloading, streaming,
+	// verifying or connected to peers, and while a room shares it.
+	Evictable bool `json:"evictable"`
+	// Dropped is set for the data of a torrent no longer in the session,
+	// which is always evictable.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// Usage reports the data directory's usage against its quota, in bytes.
+// A zero Quota means unlimited.
+type Usage struct {
+	Quota    int64     `json:"quota"`
+	Used     int64     `json:"used"`
+	Torrents []Torrent `json:"torrents"`
+}
+
+// Victims returns the torrents to evict to bring Used within Quota, least
+// recently accessed first. If evicting every evictable torrent isn't
+// enough, they are all returned.
+func (u Usage) Victims() []Torrent {
+	if u.Quota <= 0 || u.Used <= u.Quota {
+		return nil
+	}
+	var candidates []Torrent
+	for _, t := range u.Torrents {
+		if t.Evictable {
+			candidates = append(candidates, t)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
+
+	used := u.Used
+	for i, t := range candidates {
+		if used <= u.Quota {
+			return candidates[:i]
+		}
+		used -= t.Bytes
+	}
+	return candidates
+}
@@ -0,0 +1,210 @@
+// Package ratelimit describes the engine's bandwidth limits: global and
+// per-torrent upload and download rates, and alternative limits that can be
+// switched on by hand or by a weekly schedule.
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits are transfer rates in bytes per second. Zero means unlimited.
+type Limits struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Alternative-speed modes. AltSchedule follows the schedule, which with no
+// windows means off.
+const (
+	AltOff      = "off"
+	AltOn       = "on"
+	AltSchedule = "schedule"
+)
+
+// Status reports the limits in force.
+type Status struct {
+	Global  Limits  `json:"global"`
+	Alt     Limits  `json:"alt"`
+	AltMode string  `json:"altMode"`
+	AltOn   bool    `json:"altOn"`
+	Torrent *Limits `json:"torrent,omitempty"`
+}
+
+// Effective returns the global limits in force.
+func (s Status) Effective() Limits {
+	if s.AltOn {
+		return s.Alt
+	}
+	return s.Global
+}
+
+// minBurst is the smallest burst a limiter allows. The torrent client
+// reserves whole 16 KiB chunks, which a smaller burst would never admit.
+const minBurst = 256 << 10
+
+// NewLimiter returns a limiter for the torrent client allowing bps bytes per
+// second.
+func NewLimiter(bps int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	Apply(l, bps)
+	return l
+}
+
+// Apply changes l to allow bps bytes per second, or any rate if bps is
+// zero.
+func Apply(l *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		l.SetLimit(rate.Inf)
+		l.SetBurst(0)
+		return
+	}
+	l.SetBurst(int(max(bps, minBurst)))
+	l.SetLimit(rate.Limit(bps))
+}
+
+// Meter enforces a limit on a transfer the caller can only start and
+// stop, from samples of its cumulative byte count. Up to a second's worth
+// of unused allowance is carried forward.
+type Meter struct {
+	last   int64
+	at     time.Time
+	credit float64
+}
+
+// Over takes a sample of total bytes transferred and reports whether the
+// transfer is over limit and should stop until a later sample says
+// otherwise. A limit of zero is never exceeded.
+func (m *Meter) Over(limit, total int64, now time.Time) bool {
+	if limit <= 0 || m.at.IsZero() {
+		*m = Meter{last: total, at: now}
+		return false
+	}
+	m.credit += float64(limit)*now.Sub(m.at).Seconds() - float64(total-m.last)
+	m.credit = min(m.credit, float64(limit))
+	m.last, m.at = total, now
+	return m.credit < 0
+}
+
+// Window is a weekly period: from Start to End (minutes after midnight) on
+// each of Days, or every day if Days is empty. An End before Start runs
+// past midnight into the next day, and an End equal to Start makes a
+// 24-hour window.
+type Window struct {
+	Days       []time.Weekday
+	Start, End int
+}
+
+// Schedule is a set of windows in which alternative limits apply.
+type Schedule []Window
+
+// Active reports whether t falls in any window of s.
+func (s Schedule) Active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	prev := (day + 6) % 7
+	for _, w := range s {
+		if w.Start < w.End {
+			if w.onDay(day) && m >= w.Start && m < w.End {
+				return true
+			}
+			continue
+		}
+		if (w.onDay(day) && m >= w.Start) || (w.onDay(prev) && m < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, wd := range w.Days {
+		if wd == d {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses windows separated by semicolons, each an optional
+// list of days followed by a time range: "mon-fri 09:00-17:30; sat,sun
+// 22:00-02:00; 12:00-13:00". Days are three-letter names, comma separated,
+// with ranges.
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		var w Window
+		if len(fields) == 2 {
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			w.Days = days
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid schedule window %q", strings.TrimSpace(part))
+		}
+		start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range %q", fields[len(fields)-1])
+		}
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		sched = append(sched, w)
+	}
+	return sched, nil
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+		a, b := weekday(from), weekday(to)
+		if a < 0 || b < 0 {
+			return nil, fmt.Errorf("invalid days %q", item)
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			days = append(days, time.Weekday(d))
+			if d == b {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func weekday(s string) int {
+	for i, name := range weekdays {
+		if s == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
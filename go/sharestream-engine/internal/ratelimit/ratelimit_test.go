@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// at returns clock ("15:04") on day of the week starting Sunday 4 January
+// 2026.
+func at(t *testing.T, day time.Weekday, clock string) time.Time {
+	t.Helper()
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return time.Date(2026, 1, 4+int(day), c.Hour(), c.Minute(), 0, 0, time.UTC)
+}
+
+func TestParseSchedule(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	tests := []struct {
+		in   string
+		want Schedule
+	}{
+		{"", nil},
+		{" ; ", nil},
+		{"mon-fri 09:00-17:30", Schedule{{Days: weekdays, Start: 9 * 60, End: 17*60 + 30}}},
+		{"fri-mon 22:00-02:00", Schedule{{Days: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, Start: 22 * 60, End: 2 * 60}}},
+		{"sat,sun 00:00-08:00; 12:00-13:00", Schedule{
+			{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: 0, End: 8 * 60},
+			{Start: 12 * 60, End: 13 * 60},
+		}},
+		{"Mon,wed-thu 10:00-10:00", Schedule{{Days: []time.Weekday{time.Monday, time.Wednesday, time.Thursday}, Start: 10 * 60, End: 10 * 60}}},
+		{"sun-sun 23:59-00:00", Schedule{{Days: []time.Weekday{time.Sunday}, Start: 23*60 + 59, End: 0}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchedule(tt.in)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b Window) bool {
+			return slices.Equal(a.Days, b.Days) && a.Start == b.Start && a.End == b.End
+		}) {
+			t.Errorf("ParseSchedule(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, in := range []string{
+		"mon-fri",
+		"09:00",
+		"mon-fri 09:00",
+		"09:00-",
+		"9-17",
+		"24:00-01:00",
+		"09:60-10:00",
+		"funday 09:00-10:00",
+		"mon-xyz 09:00-10:00",
+		"mon, 09:00-10:00",
+		"mon tue 09:00-10:00",
+		"mon-fri 09:00-17:00; sat",
+	} {
+		if s, err := ParseSchedule(in); err == nil {
+			t.Errorf("ParseSchedule(%q) = %+v, want an error", in, s)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		schedule string
+		day      time.Weekday
+		clock    string
+		want     bool
+	}{
+		{"mon-fri 09:00-17:00", time.Monday, "09:00", true},
+		{"mon-fri 09:00-17:00", time.Monday, "08:59", false},
+		{"mon-fri 09:00-17:00", time.Friday, "16:59", true},
+		{"mon-fri 09:00-17:00", time.Friday, "17:00", false},
+		{"mon-fri 09:00-17:00", time.Saturday, "10:00", false},
+
+		// Past midnight: the early hours belong to the day before.
+		{"fri-mon 22:00-02:00", time.Friday, "22:00", true},
+		{"fri-mon 22:00-02:00", time.Friday, "21:59", false},
+		{"fri-mon 22:00-02:00", time.Friday, "01:00", false},
+		{"fri-mon 22:00-02:00", time.Saturday, "01:59", true},
+		{"fri-mon 22:00-02:00", time.Sunday, "23:00", true},
+		{"fri-mon 22:00-02:00", time.Tuesday, "01:00", true},
+		{"fri-mon 22:00-02:00", time.Tuesday, "02:00", false},
+		{"fri-mon 22:00-02:00", time.Tuesday, "22:00", false},
+		{"sat 23:00-01:00", time.Sunday, "00:30", true},
+		{"sat 23:00-01:00", time.Saturday, "00:30", false},
+
+		{"12:00-12:00", time.Wednesday, "00:00", true},
+		{"12:00-12:00", time.Wednesday, "11:59", true},
+		{"wed 12:00-12:00", time.Thursday, "11:59", true},
+		{"wed 12:00-12:00", time.Thursday, "12:00", false},
+		{"mon 09:00-10:00; 12:00-13:00", time.Tuesday, "12:30", true},
+		{"mon 09:00-10:00; 12:00-13:00", time.Tuesday, "09:30", false},
+		{"", time.Monday, "12:00", false},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q) failed: %v", tt.schedule, err)
+		}
+		if got := s.Active(at(t, tt.day, tt.clock)); got != tt.want {
+			t.Errorf("%q.Active(%s %s) = %v, want %v", tt.schedule, tt.day, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestMeterOver(t *testing.T) {
+	type sample struct {
+		limit int64
+		after time.Duration
+		total int64
+		over  bool
+	}
+	tests := []struct {
+		name    string
+		samples []sample
+	}{
+		{"at the limit", []sample{
+			{100, 0, 0, false},
+			{100, time.Second, 100, false},
+			{100, 2 * time.Second, 200, false},
+		}},
+		{"a byte over", []sample{
+			{100, 0, 0, false},
+			{100, time.Second, 101, true},
+			{100, 2 * time.Second, 200, false},
+		}},
+		{"over until caught up", []sample{
+			{100, 0, 0, false},
+			{100, time.Second, 300, true},
+			{100, 2 * time.Second, 300, true},
+			{100, 3 * time.Second, 300, false},
+		}},
+		{"idle credit capped at a second", []sample{
+			{100, 0, 0, false},
+			{100, 10 * time.Second, 0, false},
+			{100, 11 * time.Second, 200, false},
+			{100, 12 * time.Second, 350, true},
+		}},
+		{"unlimited", []sample{
+			{0, 0, 0, false},
+			{0, time.Second, 1 << 30, false},
+		}},
+		{"limit set later starts afresh", []sample{
+			{0, 0, 0, false},
+			{0, time.Second, 1000, false},
+			{100, 2 * time.Second, 1050, false},
+			{100, 3 * time.Second, 1300, true},
+		}},
+	}
+	start := at(t, time.Monday, "12:00")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Meter
+			for i, s := range tt.samples {
+				if got := m.Over(s.limit, s.total, start.Add(s.after)); got != s.over {
+					t.Fatalf("sample %d: Over(%d, %d) = %v, want %v", i, s.limit, s.total, got, s.over)
+				}
+			}
+		})
+	}
+}
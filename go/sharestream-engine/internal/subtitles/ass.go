@@ -0,0 +1,124 @@
+package subtitles
+
+import (
+	"strings"
+	"time"
+)
+
+// assDefaultFormat is the [Events] field order used when a script has no
+// Format line.
+var assDefaultFormat = []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+
+// parseASS reads the Dialogue lines of an ASS or SSA script's [Events]
+// section. Styling and positioning are dropped.
+func parseASS(text string) []Cue {
+	var cues []Cue
+	inEvents := false
+	format := assDefaultFormat
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			format = nil
+			for _, f := range strings.Split(value, ",") {
+				format = append(format, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "Dialogue":
+			// Text is the last field and may itself contain commas.
+			fields := strings.SplitN(strings.TrimSpace(value), ",", len(format))
+			if len(fields) != len(format) {
+				continue
+			}
+			var c Cue
+			var err error
+			for i, name := range format {
+				switch name {
+				case "start":
+					c.Start, err = parseASSTime(fields[i])
+				case "end":
+					c.End, err = parseASSTime(fields[i])
+				case "text":
+					c.Text = ASSText(fields[i])
+				}
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				cues = append(cues, c)
+			}
+		}
+	}
+	return cues
+}
+
+// ASSText converts the text field of an ASS event to WebVTT cue text.
+// Italic, bold and underline overrides become tags; other overrides and
+// drawings are dropped.
+func ASSText(text string) string {
+	var b strings.Builder
+	open := map[string]bool{}
+	drawing := false
+
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '{')
+		if i < 0 {
+			i = len(text)
+		}
+		if !drawing {
+			b.WriteString(assEscapes.Replace(text[:i]))
+		}
+		text = text[i:]
+		if text == "" {
+			break
+		}
+		j := strings.IndexByte(text, '}')
+		if j < 0 {
+			break
+		}
+		for _, tag := range strings.Split(text[1:j], `\`) {
+			switch {
+			case tag == "i1" || tag == "b1" || tag == "u1":
+				name := tag[:1]
+				if !open[name] {
+					b.WriteString("<" + name + ">")
+					open[name] = true
+				}
+			case tag == "i0" || tag == "b0" || tag == "u0":
+				name := tag[:1]
+				if open[name] {
+					b.WriteString("</" + name + ">")
+					open[name] = false
+				}
+			case strings.HasPrefix(tag, "p") && len(tag) > 1 && tag[1] >= '0' && tag[1] <= '9':
+				drawing = tag != "p0"
+			}
+		}
+		text = text[j+1:]
+	}
+	for _, name := range []string{"u", "b", "i"} {
+		if open[name] {
+			b.WriteString("</" + name + ">")
+		}
+	}
+	return sanitize(b.String())
+}
+
+var assEscapes = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ")
+
+// parseASSTime parses h:mm:ss.cc.
+func parseASSTime(s string) (time.Duration, error) {
+	return parseTimestamp(strings.TrimSpace(s))
+}
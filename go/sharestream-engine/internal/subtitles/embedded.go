@@ -0,0 +1,73 @@
+package subtitles
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Embedded reports whether SampleText can convert samples of an embedded
+// track with the given container codec ID.
+func Embedded(codecID string) bool {
+	switch codecID {
+	case "S_TEXT/UTF8", "S_TEXT/ASS", "S_TEXT/SSA", "S_TEXT/WEBVTT", "tx3g", "wvtt":
+		return true
+	}
+	return false
+}
+
+// SampleText converts one sample of an embedded subtitle track to WebVTT
+// cue text. codecID is the Matroska codec ID or MP4 sample entry type.
+func SampleText(codecID string, data []byte) string {
+	switch codecID {
+	case "S_TEXT/UTF8", "S_TEXT/WEBVTT":
+		return sanitize(assOverride.ReplaceAllString(decode(data), ""))
+	case "S_TEXT/ASS", "S_TEXT/SSA":
+		// ReadOrder, Layer, Style, Name, MarginL, MarginR, MarginV, Effect,
+		// Text; SSA has Marked in place of Layer.
+		fields := strings.SplitN(decode(data), ",", 9)
+		if len(fields) < 9 {
+			return ""
+		}
+		return ASSText(fields[8])
+	case "tx3g":
+		// A 16-bit text length, the text, then optional style boxes.
+		if len(data) < 2 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if 2+n > len(data) {
+			return ""
+		}
+		return sanitize(decode(data[2 : 2+n]))
+	case "wvtt":
+		return sanitize(wvttPayload(data))
+	}
+	return ""
+}
+
+// wvttPayload returns the cue text of the vttc boxes in an MP4 WebVTT
+// sample. Empty cues are vtte boxes, which have none.
+func wvttPayload(data []byte) string {
+	var texts []string
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == "vttc" {
+			inner := data[8:size]
+			for len(inner) >= 8 {
+				n := int(binary.BigEndian.Uint32(inner))
+				if n < 8 || n > len(inner) {
+					break
+				}
+				if string(inner[4:8]) == "payl" {
+					texts = append(texts, string(inner[8:n]))
+				}
+				inner = inner[n:]
+			}
+		}
+		data = data[size:]
+	}
+	return strings.Join(texts, "\n")
+}
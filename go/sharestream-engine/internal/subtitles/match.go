@@ -0,0 +1,134 @@
+package subtitles
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+var videoExts = map[string]bool{
+	".mkv": true, ".mp4": true, ".m4v": true, ".mov": true, ".avi": true,
+	".webm": true, ".ts": true, ".m2ts": true, ".wmv": true, ".flv": true,
+}
+
+// Format returns the subtitle format of a file from its extension, or ""
+// if it isn't a subtitle file.
+func Format(file string) string {
+	switch strings.ToLower(path.Ext(file)) {
+	case ".srt":
+		return "srt"
+	case ".ass":
+		return "ass"
+	case ".ssa":
+		return "ssa"
+	case ".vtt":
+		return "vtt"
+	}
+	return ""
+}
+
+// IsVideo reports whether a file has a video extension.
+func IsVideo(file string) bool {
+	return videoExts[strings.ToLower(path.Ext(file))]
+}
+
+// Sidecar is a subtitle file shipped next to a video.
+type Sidecar struct {
+	Path     string `json:"path"`
+	Video    string `json:"video,omitempty"` // empty if no video matched
+	Language string `json:"language,omitempty"`
+	Format   string `json:"format"`
+}
+
+// Match finds the subtitle files among files, which are slash separated
+// torrent paths, and matches each to a video. A subtitle matches the video
+// whose name its own name starts with ("Movie.en.srt" for "Movie.mkv"), or
+// the video named by its directory ("Subs/Movie/English.srt"); if a
+// torrent has a single video, every subtitle belongs to it. The language is
+// taken from the rest of the subtitle's name.
+func Match(files []string) []Sidecar {
+	var videos []string
+	for _, f := range files {
+		if IsVideo(f) {
+			videos = append(videos, f)
+		}
+	}
+
+	var sidecars []Sidecar
+	for _, f := range files {
+		format := Format(f)
+		if format == "" {
+			continue
+		}
+		s := Sidecar{Path: f, Format: format}
+		name := stem(f)
+
+		best := -1
+		for _, v := range videos {
+			vname := stem(v)
+			switch {
+			case hasNamePrefix(name, vname) && len(vname) > best:
+				s.Video, best = v, len(vname)
+				s.Language = trimSeparators(name[len(vname):])
+			case best < 0 && dirNamed(f, vname):
+				s.Video, best = v, 0
+				s.Language = languageOf(name)
+			}
+		}
+		if s.Video == "" && len(videos) == 1 {
+			s.Video = videos[0]
+			s.Language = languageOf(name)
+		}
+		sidecars = append(sidecars, s)
+	}
+
+	sort.Slice(sidecars, func(i, j int) bool {
+		if sidecars[i].Video != sidecars[j].Video {
+			return sidecars[i].Video < sidecars[j].Video
+		}
+		return sidecars[i].Path < sidecars[j].Path
+	})
+	return sidecars
+}
+
+func stem(file string) string {
+	base := path.Base(file)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// hasNamePrefix reports whether name starts with prefix, ignoring case,
+// followed by a separator or nothing, so "Movie.en" starts with "Movie" but
+// not with "Mov".
+func hasNamePrefix(name, prefix string) bool {
+	if len(name) < len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+		return false
+	}
+	return len(name) == len(prefix) || strings.IndexByte(separators, name[len(prefix)]) >= 0
+}
+
+// dirNamed reports whether any directory of file is named name.
+func dirNamed(file, name string) bool {
+	for _, dir := range strings.Split(path.Dir(file), "/") {
+		if strings.EqualFold(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// languageOf guesses the language part of a subtitle name that doesn't
+// start with its video's name: the last dotted element ("Show.S01E01.en"),
+// or the whole name without a track number ("2_English").
+func languageOf(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return trimSeparators(name[i+1:])
+	}
+	return trimSeparators(strings.TrimLeft(name, "0123456789"))
+}
+
+// separators are what split the parts of a subtitle's name.
+const separators = "._- "
+
+func trimSeparators(s string) string {
+	return strings.Trim(s, separators)
+}
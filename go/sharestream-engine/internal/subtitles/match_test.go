@@ -0,0 +1,93 @@
+package subtitles
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []Sidecar
+	}{
+		{
+			name:  "language after video name",
+			files: []string{"Movie.mkv", "Movie.en.srt", "Movie_fr.ass"},
+			want: []Sidecar{
+				{Path: "Movie.en.srt", Video: "Movie.mkv", Language: "en", Format: "srt"},
+				{Path: "Movie_fr.ass", Video: "Movie.mkv", Language: "fr", Format: "ass"},
+			},
+		},
+		{
+			name:  "same name",
+			files: []string{"Movie.mkv", "Other.mp4", "Movie.srt"},
+			want: []Sidecar{
+				{Path: "Movie.srt", Video: "Movie.mkv", Format: "srt"},
+			},
+		},
+		{
+			name:  "longest video name wins",
+			files: []string{"Show.mkv", "Show.Extras.mkv", "Show.Extras.de.vtt"},
+			want: []Sidecar{
+				{Path: "Show.Extras.de.vtt", Video: "Show.Extras.mkv", Language: "de", Format: "vtt"},
+			},
+		},
+		{
+			name:  "video name is a prefix of a word",
+			files: []string{"Mov.mkv", "Movie.mkv", "Movie.en.srt"},
+			want: []Sidecar{
+				{Path: "Movie.en.srt", Video: "Movie.mkv", Language: "en", Format: "srt"},
+			},
+		},
+		{
+			name:  "partial word does not match",
+			files: []string{"Mov.mkv", "Extra.mp4", "Movie.en.srt"},
+			want: []Sidecar{
+				{Path: "Movie.en.srt", Format: "srt"},
+			},
+		},
+		{
+			name:  "single video takes every subtitle",
+			files: []string{"Mov.mkv", "Movie.en.srt"},
+			want: []Sidecar{
+				{Path: "Movie.en.srt", Video: "Mov.mkv", Language: "en", Format: "srt"},
+			},
+		},
+		{
+			name:  "directory named after video",
+			files: []string{"Movie.mkv", "Other.mkv", "Subs/Movie/2_English.srt"},
+			want: []Sidecar{
+				{Path: "Subs/Movie/2_English.srt", Video: "Movie.mkv", Language: "English", Format: "srt"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Match(%q) =\n%+v\nwant\n%+v", tt.files, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasNamePrefix(t *testing.T) {
+	tests := []struct {
+		name, prefix string
+		want         bool
+	}{
+		{"Movie", "Movie", true},
+		{"movie.EN", "Movie", true},
+		{"Movie_en", "Movie", true},
+		{"Movie-en", "Movie", true},
+		{"Movie en", "Movie", true},
+		{"Movie.en", "Mov", false},
+		{"Moviefr", "Movie", false},
+		{"Mov", "Movie", false},
+	}
+	for _, tt := range tests {
+		if got := hasNamePrefix(tt.name, tt.prefix); got != tt.want {
+			t.Errorf("hasNamePrefix(%q, %q) = %v, want %v", tt.name, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package subtitles
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timingPattern matches SubRip and WebVTT cue timings. Hours are optional
+// and either separator is accepted before the milliseconds.
+var timingPattern = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})`)
+
+// assOverride matches override blocks such as {\an8}, which some SubRip
+// files carry over from ASS.
+var assOverride = regexp.MustCompile(`\{\\[^}]*\}`)
+
+// parseSRT reads SubRip cues. It also reads WebVTT, whose header, NOTE and
+// STYLE blocks have no timing line and are skipped.
+func parseSRT(text string) []Cue {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var cues []Cue
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// The timing line follows an optional cue number or identifier.
+		for i, line := range lines {
+			m := timingPattern.FindStringSubmatch(line)
+			if m == nil {
+				if i >= 1 {
+					break
+				}
+				continue
+			}
+			start, err1 := parseTimestamp(m[1])
+			end, err2 := parseTimestamp(m[2])
+			if err1 != nil || err2 != nil {
+				break
+			}
+			body := assOverride.ReplaceAllString(strings.Join(lines[i+1:], "\n"), "")
+			cues = append(cues, Cue{Start: start, End: end, Text: sanitize(body)})
+			break
+		}
+	}
+	return cues
+}
+
+// parseTimestamp parses [hh:]mm:ss,mmm or [hh:]mm:ss.mmm.
+func parseTimestamp(s string) (time.Duration, error) {
+	s = strings.Replace(s, ",", ".", 1)
+	secPart := s
+	var hours, minutes int
+	parts := strings.Split(s, ":")
+	var err error
+	switch len(parts) {
+	case 3:
+		if hours, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, err
+		}
+		parts = parts[1:]
+		fallthrough
+	case 2:
+		if minutes, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, err
+		}
+		secPart = parts[1]
+	}
+	seconds, err := strconv.ParseFloat(secPart, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)+0.5), nil
+}
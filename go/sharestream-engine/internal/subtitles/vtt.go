@@ -0,0 +1,144 @@
+// Package subtitles converts SubRip, ASS/SSA and WebVTT subtitles to WebVTT
+// and matches sidecar subtitle files to the videos they belong to.
+package subtitles
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Cue is a single subtitle. Text may contain WebVTT <i>, <b> and <u> tags.
+type Cue struct {
+	Start, End time.Duration
+	Text       string
+}
+
+// Parse reads subtitles in format ("srt", "ass", "ssa" or "vtt"). Cues are
+// returned in start time order.
+func Parse(data []byte, format string) ([]Cue, error) {
+	text := decode(data)
+	var cues []Cue
+	switch format {
+	case "srt", "vtt":
+		cues = parseSRT(text)
+	case "ass", "ssa":
+		cues = parseASS(text)
+	default:
+		return nil, fmt.Errorf("unsupported subtitle format %q", format)
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// decode returns data as UTF-8 without a byte order mark. Files that aren't
+// valid UTF-8 are assumed to be Latin-1, which most legacy .srt files are
+// close enough to.
+func decode(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Writer writes cues as WebVTT, shifted by an offset. Cues that end before
+// zero after shifting are dropped.
+type Writer struct {
+	w       io.Writer
+	offset  time.Duration
+	started bool
+}
+
+func NewWriter(w io.Writer, offset time.Duration) *Writer {
+	return &Writer{w: w, offset: offset}
+}
+
+// WriteHeader writes the WEBVTT header if it hasn't been written yet.
+func (vw *Writer) WriteHeader() error {
+	if vw.started {
+		return nil
+	}
+	vw.started = true
+	_, err := io.WriteString(vw.w, "WEBVTT\n\n")
+	return err
+}
+
+func (vw *Writer) WriteCue(c Cue) error {
+	if err := vw.WriteHeader(); err != nil {
+		return err
+	}
+	start, end := c.Start+vw.offset, c.End+vw.offset
+	if end <= 0 || strings.TrimSpace(c.Text) == "" {
+		return nil
+	}
+	if start < 0 {
+		start = 0
+	}
+	_, err := fmt.Fprintf(vw.w, "%s --> %s\n%s\n\n", timestamp(start), timestamp(end), c.Text)
+	return err
+}
+
+// WriteVTT writes cues as a complete WebVTT file.
+func WriteVTT(w io.Writer, cues []Cue, offset time.Duration) error {
+	vw := NewWriter(w, offset)
+	if err := vw.WriteHeader(); err != nil {
+		return err
+	}
+	for _, c := range cues {
+		if err := vw.WriteCue(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var tagPattern = regexp.MustCompile(`<(/?)([a-zA-Z]+)[^<>]*>`)
+
+// sanitize escapes text for a WebVTT cue, keeping only the <i>, <b> and <u>
+// tags. Blank lines would end the cue, so they are dropped.
+func sanitize(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range tagPattern.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(escape(text[last:m[0]]))
+		name := strings.ToLower(text[m[4]:m[5]])
+		if name == "i" || name == "b" || name == "u" {
+			b.WriteString("<" + text[m[2]:m[3]] + name + ">")
+		}
+		last = m[1]
+	}
+	b.WriteString(escape(text[last:]))
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// escape escapes text, first unescaping any entities WebVTT input already
+// had so they aren't escaped twice.
+func escape(s string) string {
+	s = html.UnescapeString(s)
+	s = strings.ReplaceAll(s, "&", "&amp;")
+	s = strings.ReplaceAll(s, "<", "&lt;")
+	return strings.ReplaceAll(s, ">", "&gt;")
+}
@@ -0,0 +1,303 @@
+// Package transcode segments media into HLS with an external ffmpeg process,
+// so players that can't handle a torrent's container or codecs can still
+// play it.
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PlaylistName = "index.m3u8"
+
+	segmentSeconds = 6
+	pollInterval   = 250 * time.Millisecond
+	idleTimeout    = 5 * time.Minute
+)
+
+var (
+	ErrUnavailable = errors.New("ffmpeg not available")
+	ErrNotFound    = errors.New("segment not found")
+
+	segmentName = regexp.MustCompile(`^seg\d{5}\.ts$`)
+)
+
+type Config struct {
+	// FFmpeg is the ffmpeg binary, looked up in PATH if it has no directory.
+	FFmpeg string
+	// WorkDir holds one directory of segments per session.
+	WorkDir string
+}
+
+// Manager runs one ffmpeg session per torrent file on demand and stops
+// sessions nobody has requested for a while.
+type Manager struct {
+	ffmpeg  string
+	workDir string
+	logger  *slog.Logger
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func New(cfg Config, logger *slog.Logger) (*Manager, error) {
+	ffmpeg, err := exec.LookPath(cfg.FFmpeg)
+	if err != nil {
+		logger.Warn("ffmpeg not found, HLS disabled", "ffmpeg", cfg.FFmpeg, "error", err)
+		ffmpeg = ""
+	}
+	// Segments from a previous run are never reused.
+	if err := os.RemoveAll(cfg.WorkDir); err != nil {
+		return nil, fmt.Errorf("failed to clear HLS dir: %w", err)
+	}
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create HLS dir: %w", err)
+	}
+
+	m := &Manager{
+		ffmpeg:   ffmpeg,
+		workDir:  cfg.WorkDir,
+		logger:   logger,
+		sessions: make(map[string]*session),
+		done:     make(chan struct{}),
+	}
+	go m.reapIdle()
+	return m, nil
+}
+
+// Available reports whether an ffmpeg binary was found.
+func (m *Manager) Available() bool {
+	return m.ffmpeg != ""
+}
+
+type session struct {
+	dir      string
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	err      error // set before exited is closed
+	lastUsed time.Time
+}
+
+// session returns the running session for key, starting ffmpeg on input if
+// there is none.
+func (m *Manager) session(key, input string) (*session, error) {
+	if m.ffmpeg == "" {
+		return nil, ErrUnavailable
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[key]; ok {
+		s.lastUsed = time.Now()
+		return s, nil
+	}
+
+	// Each session gets a directory of its own, so one that replaces a
+	// failed or stopped session never sees, or loses, the other's files.
+	sum := sha1.Sum([]byte(key))
+	dir, err := os.MkdirTemp(m.workDir, hex.EncodeToString(sum[:])+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(m.ffmpeg,
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-i", input,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-ac", "2",
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(segmentSeconds),
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", "seg%05d.ts",
+		PlaylistName,
+	)
+	// Run in the session directory so the playlist lists segments by their
+	// relative names.
+	cmd.Dir = dir
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	s := &session{dir: dir, cmd: cmd, exited: make(chan struct{}), lastUsed: time.Now()}
+	m.sessions[key] = s
+	m.logger.Info("hls session started", "key", key, "dir", dir)
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			m.logger.Debug("ffmpeg", "key", key, "line", scanner.Text())
+		}
+		s.err = cmd.Wait()
+		close(s.exited)
+		m.logger.Info("hls session ffmpeg exited", "key", key, "error", s.err)
+		if s.err != nil {
+			m.drop(key, s)
+		}
+	}()
+	return s, nil
+}
+
+// drop forgets a session whose ffmpeg failed, so the next request for key
+// starts a new one. A session that finished keeps serving its segments until
+// it goes idle.
+func (m *Manager) drop(key string, s *session) {
+	m.mu.Lock()
+	current := m.sessions[key] == s
+	if current {
+		delete(m.sessions, key)
+	}
+	m.mu.Unlock()
+	if current {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// Playlist returns the path of key's playlist once ffmpeg has written its
+// first segment, starting a session that reads input if needed.
+func (m *Manager) Playlist(ctx context.Context, key, input string) (string, error) {
+	s, err := m.session(key, input)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, PlaylistName)
+	err = s.wait(ctx, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	return path, err
+}
+
+// Segment returns the path of a segment once ffmpeg has finished writing
+// it, which is when it appears in the playlist.
+func (m *Manager) Segment(ctx context.Context, key, input, name string) (string, error) {
+	if !segmentName.MatchString(name) {
+		return "", ErrNotFound
+	}
+	s, err := m.session(key, input)
+	if err != nil {
+		return "", err
+	}
+	playlist := filepath.Join(s.dir, PlaylistName)
+	err = s.wait(ctx, func() bool {
+		b, err := os.ReadFile(playlist)
+		return err == nil && playlistHas(string(b), name)
+	})
+	return filepath.Join(s.dir, name), err
+}
+
+// wait polls ready until it is true, ffmpeg exits or ctx is done.
+func (s *session) wait(ctx context.Context, ready func() bool) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if ready() {
+			return nil
+		}
+		select {
+		case <-s.exited:
+			// ffmpeg may have finished the file just before exiting.
+			if ready() {
+				return nil
+			}
+			if s.err != nil {
+				return fmt.Errorf("ffmpeg failed: %w", s.err)
+			}
+			return ErrNotFound
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func playlistHas(playlist, name string) bool {
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.TrimSpace(line) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop ends key's session, if any, and removes its segments.
+func (m *Manager) Stop(key string) {
+	m.mu.Lock()
+	s, ok := m.sessions[key]
+	delete(m.sessions, key)
+	m.mu.Unlock()
+	if ok {
+		s.stop()
+	}
+}
+
+func (s *session) stop() {
+	s.cmd.Process.Kill()
+	<-s.exited
+	os.RemoveAll(s.dir)
+}
+
+func (m *Manager) reapIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+
+		var idle []*session
+		m.mu.Lock()
+		for key, s := range m.sessions {
+			if time.Since(s.lastUsed) > idleTimeout {
+				m.logger.Info("hls session idle, stopping", "key", key)
+				idle = append(idle, s)
+				delete(m.sessions, key)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, s := range idle {
+			s.stop()
+		}
+	}
+}
+
+// Close stops every session. Later calls do nothing.
+func (m *Manager) Close() {
+	m.closeOnce.Do(m.close)
+}
+
+func (m *Manager) close() {
+	close(m.done)
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*session)
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.stop()
+	}
+}
@@ -0,0 +1,182 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubPlaylist is what the stub ffmpeg writes: one finished segment.
+const stubPlaylist = "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg00000.ts\n#EXT-X-ENDLIST\n"
+
+// stubFFmpeg writes a shell script standing in for ffmpeg, which runs body
+// in the session directory, and returns its path.
+func stubFFmpeg(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\n" + body + "\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeSegments is a stub body that writes a segment and then the playlist
+// listing it, as ffmpeg does.
+const writeSegments = "printf 'ts' > seg00000.ts\nprintf '" + `#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg00000.ts\n#EXT-X-ENDLIST\n` + "' > index.m3u8"
+
+func newTestManager(t *testing.T, ffmpeg string) *Manager {
+	t.Helper()
+	m, err := New(Config{FFmpeg: ffmpeg, WorkDir: filepath.Join(t.TempDir(), "hls")}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUnavailable(t *testing.T) {
+	m := newTestManager(t, filepath.Join(t.TempDir(), "no-such-ffmpeg"))
+	if m.Available() {
+		t.Fatal("Available with a missing ffmpeg")
+	}
+	if _, err := m.Playlist(testContext(t), "key", "input"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Playlist: err = %v, want %v", err, ErrUnavailable)
+	}
+}
+
+func TestPlaylistAndSegment(t *testing.T) {
+	m := newTestManager(t, stubFFmpeg(t, writeSegments))
+	ctx := testContext(t)
+
+	path, err := m.Playlist(ctx, "key", "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != stubPlaylist {
+		t.Fatalf("playlist = %q, want %q", b, stubPlaylist)
+	}
+
+	seg, err := m.Segment(ctx, "key", "input", "seg00000.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(seg) != filepath.Dir(path) {
+		t.Fatalf("segment %s not in the playlist's session directory", seg)
+	}
+
+	// ffmpeg has finished, so a segment it never wrote won't appear.
+	if _, err := m.Segment(ctx, "key", "input", "seg00001.ts"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing segment: err = %v, want %v", err, ErrNotFound)
+	}
+	for _, name := range []string{"../index.m3u8", "index.m3u8", "seg1.ts"} {
+		if _, err := m.Segment(ctx, "key", "input", name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("segment %q: err = %v, want %v", name, err, ErrNotFound)
+		}
+	}
+
+	// A finished session keeps serving its segments.
+	again, err := m.Playlist(ctx, "key", "input")
+	if err != nil || again != path {
+		t.Fatalf("second Playlist = %s, %v, want %s", again, err, path)
+	}
+}
+
+func TestFailedSessionRestarts(t *testing.T) {
+	// The stub fails the first time it runs and works after that.
+	state := filepath.Join(t.TempDir(), "ran")
+	m := newTestManager(t, stubFFmpeg(t, "if [ ! -e '"+state+"' ]; then touch '"+state+"'; echo broken >&2; exit 1; fi\n"+writeSegments))
+	ctx := testContext(t)
+
+	_, err := m.Playlist(ctx, "key", "input")
+	if err == nil || !strings.Contains(err.Error(), "ffmpeg failed") {
+		t.Fatalf("first Playlist: err = %v, want ffmpeg failure", err)
+	}
+
+	// The failed session is dropped once ffmpeg's exit has been seen.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		_, ok := m.sessions["key"]
+		m.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := m.Playlist(ctx, "key", "input"); err != nil {
+		t.Fatalf("Playlist after failure: %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	m := newTestManager(t, stubFFmpeg(t, writeSegments+"\nexec sleep 60"))
+	path, err := m.Playlist(testContext(t), "key", "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Stop("key")
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Fatalf("session directory left after Stop: %v", err)
+	}
+	m.mu.Lock()
+	n := len(m.sessions)
+	m.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions after Stop", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	// newTestManager closes m again when the test ends, as quit and main
+	// both do.
+	m := newTestManager(t, stubFFmpeg(t, writeSegments+"\nexec sleep 60"))
+	path, err := m.Playlist(testContext(t), "key", "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Fatalf("session directory left after Close: %v", err)
+	}
+}
+
+func TestPlaylistHas(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"seg00000.ts", true},
+		{"seg00001.ts", false},
+		{"seg0000", false},
+	}
+	for _, tt := range tests {
+		if got := playlistHas(stubPlaylist, tt.name); got != tt.want {
+			t.Errorf("playlistHas(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
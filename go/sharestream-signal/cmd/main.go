@@ -2,13 +2,20 @@ package main
 
 import (
 	"bufio"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -20,6 +27,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/biswa/sharestream-signal/internal/tracker"
+	"github.com/biswa/sharestream-signal/internal/turn"
 	"github.com/gorilla/mux"
 	"github.com/zishang520/engine.io/v2/types"
 	"github.com/zishang520/socket.io/v2/socket"
@@ -29,6 +38,16 @@ var (
 	port     = flag.Int("port", 3001, "Server port")
 	noTunnel = flag.Bool("no-tunnel", false, "Disable automatic tunnel creation")
 
+	trackerUDPPort = flag.Int("tracker-udp-port", 0, "UDP tracker port (0 = same as -port, -1 = disabled)")
+	publicURL      = flag.String("public-url", "", "Public base URL of this server, used for the tracker announce URL (defaults to the tunnel URL)")
+	trustedProxies = flag.String("trusted-proxies", "127.0.0.1/32,::1/128", "Comma-separated CIDRs of reverse proxies whose CF-Connecting-IP and X-Forwarded-For headers the tracker trusts")
+
+	turnURL        = flag.String("turn-url", "", "TURN server handed out by /api/turn, e.g. turn:turn.example.com:3478 (default $TURN_URL)")
+	turnUsername   = flag.String("turn-username", "", "Static TURN username (default $TURN_USERNAME)")
+	turnCredential = flag.String("turn-credential", "", "Static TURN password (default $TURN_CREDENTIAL)")
+	turnSecret     = flag.String("turn-secret", "", "TURN REST API shared secret; when set, /api/turn issues credentials valid for -turn-ttl instead of the static ones (default $TURN_SECRET)")
+	turnTTL        = flag.Duration("turn-ttl", time.Hour, "How long TURN credentials from /api/turn are valid for; clients fetch new ones before then")
+
 	io_       *socket.Server
 	tunnelURL string
 	tunnelMu  sync.RWMutex
@@ -89,13 +108,101 @@ func (rm *RoomManager) DeleteRoom(code string) {
 	delete(rm.rooms, code)
 }
 
+// HostedBy returns the codes of the rooms hostID is hosting.
+func (rm *RoomManager) HostedBy(hostID string) []string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	var codes []string
+	for code, room := range rm.rooms {
+		if room.Host == hostID {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
 var roomManager = NewRoomManager()
 
+// roomTracker only accepts announces for info hashes shared via torrent-magnet.
+var roomTracker = tracker.New(2 * time.Minute)
+
+// turnGen issues the TURN credentials /api/turn hands out; it is only
+// used when -turn-url is set.
+var turnGen = turn.New()
+
+// iceKey signs the tokens room members fetch /api/turn with; see iceToken.
+var iceKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		log.Fatalf("Failed to generate ICE token key: %v", err)
+	}
+	return key
+}()
+
+// iceToken is the token member of room code fetches /api/turn with. It is
+// only honoured while member is the room's host or an approved viewer, so
+// it stops working when they leave or the room ends.
+func iceToken(code, member string) string {
+	mac := hmac.New(sha256.New, iceKey)
+	mac.Write([]byte(code + "\x00" + member))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// iceURL is the /api/turn URL member of room code fetches ICE servers from,
+// on the public base URL if one is known and relative to this server if
+// not.
+func iceURL(code, member string) string {
+	q := url.Values{"room": {code}, "member": {member}, "token": {iceToken(code, member)}}
+	return strings.TrimSuffix(publicBaseURL(), "/") + "/api/turn?" + q.Encode()
+}
+
+// roomMember reports whether member is the host or an approved viewer of
+// room code.
+func roomMember(code, member string) bool {
+	room := roomManager.GetRoom(code)
+	if room == nil {
+		return false
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.Host == member || room.Approved[member]
+}
+
+// endRoom deletes a room once its host has gone, along with the swarms of
+// the torrents shared in it.
+func endRoom(code string) {
+	roomManager.DeleteRoom(code)
+	roomTracker.RevokeRoom(code)
+	log.Printf("Room %s ended", code)
+}
+
 // ── Main ─────────────────────────────────────────────────────────────────────
 
 func main() {
 	flag.Parse()
 
+	envDefault(turnURL, "TURN_URL")
+	envDefault(turnUsername, "TURN_USERNAME")
+	envDefault(turnCredential, "TURN_CREDENTIAL")
+	envDefault(turnSecret, "TURN_SECRET")
+	turnGen.SetTTL(*turnTTL)
+	if *turnSecret != "" {
+		turnGen.SetStaticTURN(*turnURL, "", *turnSecret)
+	} else {
+		turnGen.SetStaticTURN(*turnURL, *turnUsername, *turnCredential)
+	}
+
+	for _, cidr := range strings.Split(*trustedProxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("Invalid -trusted-proxies entry %q: %v", cidr, err)
+		}
+		roomTracker.TrustProxies(prefix)
+	}
+
 	// Start cloudflared tunnel in background (if not disabled)
 	if !*noTunnel {
 		go startCloudflaredTunnel(*port)
@@ -135,6 +242,10 @@ func main() {
 			if participantID != "" {
 				log.Printf("[JOIN] Cleaned up mapping for participant %s", participantID)
 			}
+
+			for _, code := range roomManager.HostedBy(string(client.Id())) {
+				endRoom(code)
+			}
 		})
 	})
 
@@ -152,6 +263,10 @@ func main() {
 	router.HandleFunc("/join/{code}", handleJoinPage).Methods("GET")
 	router.HandleFunc("/api/room/{code}/ready", handleGetReadyCount).Methods("GET")
 
+	// BitTorrent tracker for room swarms
+	router.HandleFunc("/announce", roomTracker.HandleAnnounce).Methods("GET")
+	router.HandleFunc("/scrape", roomTracker.HandleScrape).Methods("GET")
+
 	// Start HTTP server
 	addr := fmt.Sprintf(":%d", *port)
 	log.Printf("ShareStream Signal Server starting on %s", addr)
@@ -163,6 +278,25 @@ func main() {
 		}
 	}()
 
+	if *trackerUDPPort >= 0 {
+		udpPort := *trackerUDPPort
+		if udpPort == 0 {
+			udpPort = *port
+		}
+		udpConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", udpPort))
+		if err != nil {
+			log.Printf("[tracker] UDP tracker disabled: %v", err)
+		} else {
+			defer udpConn.Close()
+			log.Printf("[tracker] UDP tracker listening on :%d", udpPort)
+			go func() {
+				if err := roomTracker.ServeUDP(udpConn); err != nil {
+					log.Printf("[tracker] UDP tracker error: %v", err)
+				}
+			}()
+		}
+	}
+
 	// Wait for tunnel (if enabled)
 	if !*noTunnel {
 		select {
@@ -231,6 +365,7 @@ func registerEventHandlers(client *socket.Socket) {
 	})
 	client.On("torrent-magnet", func(args ...any) {
 		data := parseData(args)
+		allowTorrentMagnet(client, data)
 		handleBroadcastToRooms(client, "torrent-magnet", data)
 	})
 	client.On("movie-loaded", func(args ...any) {
@@ -387,9 +522,11 @@ func handleCreateRoom(s *socket.Socket, data map[string]interface{}) {
 	s.Emit("room-created", map[string]interface{}{
 		"success": true,
 		"room": map[string]interface{}{
-			"code":   code,
-			"role":   "host",
-			"tunnel": tURL,
+			"code":    code,
+			"role":    "host",
+			"tunnel":  tURL,
+			"tracker": trackerAnnounceURL(),
+			"ice":     iceURL(code, string(s.Id())),
 		},
 	})
 }
@@ -439,6 +576,7 @@ func handleJoinRoom(s *socket.Socket, data map[string]interface{}) {
 		"room": map[string]interface{}{
 			"code": code,
 			"role": "viewer",
+			"ice":  iceURL(code, participantID),
 		},
 	})
 	io_.To(socket.Room(code)).Emit("participant-joined", map[string]interface{}{
@@ -457,6 +595,9 @@ func handleLeaveRoom(s *socket.Socket, data map[string]interface{}) {
 	io_.To(socket.Room(code)).Emit("participant-left", map[string]interface{}{
 		"id": string(s.Id()),
 	})
+	if room := roomManager.GetRoom(code); room != nil && room.Host == string(s.Id()) {
+		endRoom(code)
+	}
 }
 
 func handleJoinRequest(s *socket.Socket, data map[string]interface{}) {
@@ -542,6 +683,7 @@ func handleJoinApprove(s *socket.Socket, data map[string]interface{}) {
 	// Notify the approved participant using socket room
 	io_.To(socket.Room(participantID)).Emit("join-approved", map[string]interface{}{
 		"code": code,
+		"ice":  iceURL(code, participantID),
 	})
 
 	room.mu.RLock()
@@ -682,6 +824,47 @@ func handleTargetedEmit(s *socket.Socket, event string, data map[string]interfac
 	io_.To(socket.Room(targetID)).Emit(event, data)
 }
 
+// ── Tracker ──────────────────────────────────────────────────────────────────
+
+// allowTorrentMagnet registers the info hash of a shared magnet with the
+// tracker for every room the sender is in.
+func allowTorrentMagnet(s *socket.Socket, data map[string]interface{}) {
+	magnetURI, _ := data["magnetURI"].(string)
+	ih, err := tracker.ParseMagnet(magnetURI)
+	if err != nil {
+		log.Printf("[tracker] Ignoring torrent-magnet from %s: %v", s.Id(), err)
+		return
+	}
+	for _, room := range s.Rooms().Keys() {
+		if roomManager.GetRoom(string(room)) == nil {
+			continue
+		}
+		roomTracker.Allow(string(room), ih)
+		log.Printf("[tracker] Allowed %s for room %s", ih, room)
+	}
+}
+
+// trackerAnnounceURL is the HTTP announce URL of the embedded tracker, or ""
+// if this server's public address isn't known yet.
+func trackerAnnounceURL() string {
+	base := publicBaseURL()
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/announce"
+}
+
+// publicBaseURL is -public-url, falling back to the tunnel URL; empty when
+// neither is known.
+func publicBaseURL() string {
+	if *publicURL != "" {
+		return *publicURL
+	}
+	tunnelMu.RLock()
+	defer tunnelMu.RUnlock()
+	return tunnelURL
+}
+
 // ── Playback / Sync Handlers ─────────────────────────────────────────────────
 
 func handleReadyToStart(s *socket.Socket, data map[string]interface{}) {
@@ -846,9 +1029,52 @@ func handleTunnelURL(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// iceServer is one entry of an RTCConfiguration iceServers list.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// handleTurnServers returns the ICE servers WebRTC peers connect through:
+// public STUN servers and, with -turn-url, the TURN server and credentials
+// for it. ttl is how many seconds the credentials are valid for; clients
+// fetch them again before then. Only room members may ask, with the room,
+// member and token query parameters of their iceURL, so the TURN server
+// can't be used by anyone who finds this server.
 func handleTurnServers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code, member := q.Get("room"), q.Get("member")
+	if code == "" || member == "" ||
+		!hmac.Equal([]byte(q.Get("token")), []byte(iceToken(code, member))) || !roomMember(code, member) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error":"not a member of the room"}`)
+		return
+	}
+
+	reply := struct {
+		ICEServers []iceServer `json:"iceServers"`
+		TTL        int64       `json:"ttl,omitempty"`
+	}{
+		ICEServers: []iceServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}
+	if *turnURL != "" {
+		var creds turn.Credentials
+		if *turnSecret != "" {
+			creds = turnGen.GenerateCloudflareCredentials(code)
+		} else {
+			creds = turnGen.GenerateCredentials("", "")
+		}
+		reply.ICEServers = append(reply.ICEServers, iceServer{URLs: creds.URLs, Username: creds.Username, Credential: creds.Password})
+		reply.TTL = creds.TTL
+	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"iceServers":[{"urls":"stun:stun.l.google.com:19302"},{"urls":"stun:stun1.l.google.com:19302"}]}`)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(reply)
 }
 
 func handleGetRoom(w http.ResponseWriter, r *http.Request) {
@@ -1042,3 +1268,11 @@ func generateRoomCode() string {
 	}
 	return string(result)
 }
+
+// envDefault sets an unset string flag from the environment variable key,
+// so secrets can be passed without showing in the command line.
+func envDefault(value *string, key string) {
+	if *value == "" {
+		*value = os.Getenv(key)
+	}
+}
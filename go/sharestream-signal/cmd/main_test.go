@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleTurnServers(t *testing.T) {
+	*turnURL = "turn:turn.example.com:3478"
+	*turnSecret = "secret"
+	turnGen.SetStaticTURN(*turnURL, "", *turnSecret)
+	turnGen.SetTTL(time.Hour)
+	t.Cleanup(func() { *turnURL, *turnSecret = "", "" })
+
+	room := roomManager.CreateRoom("TURN01", "host-socket")
+	room.Approved["viewer"] = true
+	room.Pending["waiting"] = "Waiting"
+	t.Cleanup(func() { roomManager.DeleteRoom("TURN01") })
+
+	query := func(code, member, token string) string {
+		return url.Values{"room": {code}, "member": {member}, "token": {token}}.Encode()
+	}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"host", query("TURN01", "host-socket", iceToken("TURN01", "host-socket")), http.StatusOK},
+		{"approved viewer", query("TURN01", "viewer", iceToken("TURN01", "viewer")), http.StatusOK},
+		{"no token", "", http.StatusForbidden},
+		{"wrong token", query("TURN01", "viewer", iceToken("TURN01", "host-socket")), http.StatusForbidden},
+		{"pending viewer", query("TURN01", "waiting", iceToken("TURN01", "waiting")), http.StatusForbidden},
+		{"no such room", query("GONE01", "viewer", iceToken("GONE01", "viewer")), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleTurnServers(w, httptest.NewRequest("GET", "/api/turn?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				if strings.Contains(w.Body.String(), "turn:") {
+					t.Fatalf("refused reply has TURN servers: %s", w.Body.String())
+				}
+				return
+			}
+			var reply struct {
+				ICEServers []iceServer `json:"iceServers"`
+				TTL        int64       `json:"ttl"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.TTL != 3600 {
+				t.Errorf("ttl = %d, want 3600", reply.TTL)
+			}
+			last := reply.ICEServers[len(reply.ICEServers)-1]
+			if last.URLs[0] != *turnURL || !strings.HasSuffix(last.Username, ":TURN01") || last.Credential == "" {
+				t.Errorf("TURN server = %+v", last)
+			}
+		})
+	}
+
+	// Leaving the room revokes the token.
+	room.mu.Lock()
+	delete(room.Approved, "viewer")
+	room.mu.Unlock()
+	w := httptest.NewRecorder()
+	handleTurnServers(w, httptest.NewRequest("GET", "/api/turn?"+query("TURN01", "viewer", iceToken("TURN01", "viewer")), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status after leaving = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestIceURL(t *testing.T) {
+	*publicURL = "https://signal.example.com/"
+	t.Cleanup(func() { *publicURL = "" })
+	u, err := url.Parse(iceURL("ROOM01", "member"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "https" || u.Host != "signal.example.com" || u.Path != "/api/turn" {
+		t.Fatalf("iceURL = %s", u)
+	}
+	q := u.Query()
+	if q.Get("room") != "ROOM01" || q.Get("member") != "member" || q.Get("token") != iceToken("ROOM01", "member") {
+		t.Fatalf("iceURL query = %v", q)
+	}
+}
@@ -0,0 +1,428 @@
+// Package tracker is a small BitTorrent tracker (BEP 3 HTTP announces with
+// BEP 23 compact peers, and BEP 15 UDP announces) that only serves info
+// hashes which have been shared in a room.
+package tracker
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfoHash is a 20-byte BitTorrent v1 info hash.
+type InfoHash [20]byte
+
+func (ih InfoHash) String() string {
+	return hex.EncodeToString(ih[:])
+}
+
+// ParseMagnet returns the info hash of a magnet URI's xt=urn:btih: field,
+// which may be hex or base32 encoded.
+func ParseMagnet(magnetURI string) (InfoHash, error) {
+	var ih InfoHash
+	u, err := url.Parse(magnetURI)
+	if err != nil || u.Scheme != "magnet" {
+		return ih, fmt.Errorf("invalid magnet URI")
+	}
+	for _, xt := range u.Query()["xt"] {
+		enc, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var b []byte
+		switch len(enc) {
+		case 40:
+			b, err = hex.DecodeString(enc)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(enc))
+		default:
+			err = fmt.Errorf("bad info hash length %d", len(enc))
+		}
+		if err != nil {
+			return ih, fmt.Errorf("invalid magnet info hash: %w", err)
+		}
+		copy(ih[:], b)
+		return ih, nil
+	}
+	return ih, fmt.Errorf("magnet URI has no btih info hash")
+}
+
+type peer struct {
+	id       string
+	ip       net.IP
+	port     uint16
+	left     int64
+	lastSeen time.Time
+}
+
+func (p *peer) seeder() bool { return p.left == 0 }
+
+type swarm struct {
+	peers     map[string]*peer
+	completed int
+}
+
+// Tracker tracks the swarms of info hashes shared in rooms.
+type Tracker struct {
+	interval time.Duration
+	proxies  []netip.Prefix
+
+	mu      sync.Mutex
+	allowed map[InfoHash]map[string]bool // info hash -> room codes
+	swarms  map[InfoHash]*swarm
+}
+
+// New returns a tracker that asks clients to announce every interval.
+func New(interval time.Duration) *Tracker {
+	return &Tracker{
+		interval: interval,
+		allowed:  make(map[InfoHash]map[string]bool),
+		swarms:   make(map[InfoHash]*swarm),
+	}
+}
+
+// TrustProxies makes the tracker take the client address of requests that
+// come from one of prefixes from the CF-Connecting-IP and X-Forwarded-For
+// headers. Headers on other requests are ignored, so clients can't announce
+// someone else's address. It must be called before serving.
+func (t *Tracker) TrustProxies(prefixes ...netip.Prefix) {
+	t.proxies = append(t.proxies, prefixes...)
+}
+
+// Allow lets clients announce ih, which was shared in room.
+func (t *Tracker) Allow(room string, ih InfoHash) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.allowed[ih] == nil {
+		t.allowed[ih] = make(map[string]bool)
+	}
+	t.allowed[ih][room] = true
+}
+
+// RevokeRoom forgets every info hash shared in room. Swarms no other room
+// shares are dropped.
+func (t *Tracker) RevokeRoom(room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ih, rooms := range t.allowed {
+		delete(rooms, room)
+		if len(rooms) == 0 {
+			delete(t.allowed, ih)
+			delete(t.swarms, ih)
+		}
+	}
+}
+
+type announce struct {
+	infoHash InfoHash
+	peerID   string
+	ip       net.IP
+	port     uint16
+	left     int64
+	event    string
+	numWant  int
+}
+
+type announceResult struct {
+	peers     []*peer
+	seeders   int
+	leechers  int
+	completed int
+}
+
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+var errNotAllowed = fmt.Errorf("info hash not shared in any room")
+
+func (t *Tracker) announce(a announce) (announceResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.allowed[a.infoHash] == nil {
+		return announceResult{}, errNotAllowed
+	}
+
+	s := t.swarms[a.infoHash]
+	if s == nil {
+		s = &swarm{peers: make(map[string]*peer)}
+		t.swarms[a.infoHash] = s
+	}
+
+	now := time.Now()
+	for id, p := range s.peers {
+		if now.Sub(p.lastSeen) > 2*t.interval {
+			delete(s.peers, id)
+		}
+	}
+
+	if a.event == "stopped" {
+		delete(s.peers, a.peerID)
+	} else {
+		if a.event == "completed" {
+			s.completed++
+		}
+		s.peers[a.peerID] = &peer{
+			id:       a.peerID,
+			ip:       a.ip,
+			port:     a.port,
+			left:     a.left,
+			lastSeen: now,
+		}
+	}
+
+	numWant := a.numWant
+	if numWant <= 0 {
+		numWant = defaultNumWant
+	}
+	if numWant > maxNumWant {
+		numWant = maxNumWant
+	}
+
+	res := announceResult{completed: s.completed}
+	for id, p := range s.peers {
+		if p.seeder() {
+			res.seeders++
+		} else {
+			res.leechers++
+		}
+		if id == a.peerID || len(res.peers) >= numWant {
+			continue
+		}
+		// Seeders have nothing to gain from other seeders.
+		if a.left == 0 && p.seeder() {
+			continue
+		}
+		res.peers = append(res.peers, p)
+	}
+	return res, nil
+}
+
+type scrapeResult struct {
+	seeders   int
+	leechers  int
+	completed int
+}
+
+func (t *Tracker) scrape(ih InfoHash) (scrapeResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.allowed[ih] == nil {
+		return scrapeResult{}, false
+	}
+	var res scrapeResult
+	if s := t.swarms[ih]; s != nil {
+		res.completed = s.completed
+		for _, p := range s.peers {
+			if p.seeder() {
+				res.seeders++
+			} else {
+				res.leechers++
+			}
+		}
+	}
+	return res, true
+}
+
+// ── HTTP ─────────────────────────────────────────────────────────────────────
+
+// HandleAnnounce serves BEP 3 announce requests.
+func (t *Tracker) HandleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	infoHash := q.Get("info_hash")
+	peerID := q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		writeFailure(w, "invalid info_hash or peer_id")
+		return
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeFailure(w, "invalid port")
+		return
+	}
+	left, _ := strconv.ParseInt(q.Get("left"), 10, 64)
+	numWant, _ := strconv.Atoi(q.Get("numwant"))
+
+	ip := t.clientIP(r)
+	if ip == nil {
+		writeFailure(w, "unable to determine client address")
+		return
+	}
+
+	a := announce{
+		peerID:  peerID,
+		ip:      ip,
+		port:    uint16(port),
+		left:    left,
+		event:   q.Get("event"),
+		numWant: numWant,
+	}
+	copy(a.infoHash[:], infoHash)
+
+	res, err := t.announce(a)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	d := map[string]interface{}{
+		"interval":   int64(t.interval / time.Second),
+		"complete":   int64(res.seeders),
+		"incomplete": int64(res.leechers),
+	}
+	if q.Get("compact") == "0" {
+		list := make([]interface{}, 0, len(res.peers))
+		for _, p := range res.peers {
+			list = append(list, map[string]interface{}{
+				"peer id": p.id,
+				"ip":      p.ip.String(),
+				"port":    int64(p.port),
+			})
+		}
+		d["peers"] = list
+	} else {
+		var peers4, peers6 []byte
+		for _, p := range res.peers {
+			if ip4 := p.ip.To4(); ip4 != nil {
+				peers4 = binary.BigEndian.AppendUint16(append(peers4, ip4...), p.port)
+			} else {
+				peers6 = binary.BigEndian.AppendUint16(append(peers6, p.ip.To16()...), p.port)
+			}
+		}
+		d["peers"] = string(peers4)
+		if len(peers6) > 0 {
+			d["peers6"] = string(peers6)
+		}
+	}
+	writeBencode(w, d)
+}
+
+// HandleScrape serves scrape requests for allowed info hashes.
+func (t *Tracker) HandleScrape(w http.ResponseWriter, r *http.Request) {
+	files := make(map[string]interface{})
+	for _, raw := range r.URL.Query()["info_hash"] {
+		if len(raw) != 20 {
+			continue
+		}
+		var ih InfoHash
+		copy(ih[:], raw)
+		res, ok := t.scrape(ih)
+		if !ok {
+			continue
+		}
+		files[raw] = map[string]interface{}{
+			"complete":   int64(res.seeders),
+			"downloaded": int64(res.completed),
+			"incomplete": int64(res.leechers),
+		}
+	}
+	writeBencode(w, map[string]interface{}{"files": files})
+}
+
+// clientIP returns the address a request came from. Behind a trusted proxy,
+// such as Koyeb's or cloudflared, that is the one the proxy reports: the
+// CF-Connecting-IP header, or else the last X-Forwarded-For hop that isn't
+// itself a trusted proxy.
+func (t *Tracker) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	if !t.trusted(remote) {
+		return net.IP(remote.Unmap().AsSlice())
+	}
+	if ip := net.ParseIP(r.Header.Get("CF-Connecting-IP")); ip != nil {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !t.trusted(hop) {
+			return net.IP(hop.Unmap().AsSlice())
+		}
+	}
+	return net.IP(remote.Unmap().AsSlice())
+}
+
+func (t *Tracker) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]interface{}{"failure reason": reason})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	var buf bytes.Buffer
+	if err := encodeBencode(&buf, v); err != nil {
+		log.Printf("[tracker] Failed to encode response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// encodeBencode supports the value types tracker responses use.
+func encodeBencode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := encodeBencode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%d:%s", len(k), k)
+			if err := encodeBencode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", v)
+	}
+	return nil
+}
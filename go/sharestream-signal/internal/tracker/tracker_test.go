@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHash = InfoHash{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+func testAnnounce(peerID string, ip string, left int64) announce {
+	return announce{
+		infoHash: testHash,
+		peerID:   peerID,
+		ip:       net.ParseIP(ip),
+		port:     6881,
+		left:     left,
+	}
+}
+
+func TestAnnounceNotAllowed(t *testing.T) {
+	tr := New(time.Minute)
+	if _, err := tr.announce(testAnnounce("a", "192.0.2.1", 0)); err != errNotAllowed {
+		t.Fatalf("announce of unshared info hash: err = %v, want %v", err, errNotAllowed)
+	}
+	if _, ok := tr.scrape(testHash); ok {
+		t.Fatal("scrape of unshared info hash succeeded")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	tr := New(time.Minute)
+	tr.Allow("ROOM1", testHash)
+
+	res, err := tr.announce(testAnnounce("seeder", "192.0.2.1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.peers) != 0 || res.seeders != 1 || res.leechers != 0 {
+		t.Fatalf("first announce: %d peers, %d seeders, %d leechers", len(res.peers), res.seeders, res.leechers)
+	}
+
+	res, err = tr.announce(testAnnounce("leecher", "192.0.2.2", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.peers) != 1 || res.peers[0].id != "seeder" {
+		t.Fatalf("leecher got peers %v, want the seeder", res.peers)
+	}
+	if res.seeders != 1 || res.leechers != 1 {
+		t.Fatalf("got %d seeders, %d leechers, want 1 and 1", res.seeders, res.leechers)
+	}
+
+	// A second seeder only learns of the leecher.
+	res, err = tr.announce(testAnnounce("seeder2", "192.0.2.3", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.peers) != 1 || res.peers[0].id != "leecher" {
+		t.Fatalf("seeder got peers %v, want only the leecher", res.peers)
+	}
+
+	stopped := testAnnounce("leecher", "192.0.2.2", 100)
+	stopped.event = "stopped"
+	if _, err := tr.announce(stopped); err != nil {
+		t.Fatal(err)
+	}
+	sr, ok := tr.scrape(testHash)
+	if !ok || sr.seeders != 2 || sr.leechers != 0 {
+		t.Fatalf("scrape after stop: %+v, %v", sr, ok)
+	}
+}
+
+func TestRevokeRoom(t *testing.T) {
+	tr := New(time.Minute)
+	tr.Allow("ROOM1", testHash)
+	tr.Allow("ROOM2", testHash)
+	if _, err := tr.announce(testAnnounce("a", "192.0.2.1", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still shared in ROOM2, so the swarm survives.
+	tr.RevokeRoom("ROOM1")
+	sr, ok := tr.scrape(testHash)
+	if !ok || sr.seeders != 1 {
+		t.Fatalf("scrape after revoking one room: %+v, %v", sr, ok)
+	}
+
+	tr.RevokeRoom("ROOM2")
+	if _, ok := tr.scrape(testHash); ok {
+		t.Fatal("scrape succeeded after revoking every room")
+	}
+	if _, err := tr.announce(testAnnounce("a", "192.0.2.1", 0)); err != errNotAllowed {
+		t.Fatalf("announce after revoke: err = %v, want %v", err, errNotAllowed)
+	}
+	if len(tr.allowed) != 0 || len(tr.swarms) != 0 {
+		t.Fatalf("revoke left %d allowed and %d swarms", len(tr.allowed), len(tr.swarms))
+	}
+
+	// Sharing it again starts a fresh swarm.
+	tr.Allow("ROOM3", testHash)
+	sr, ok = tr.scrape(testHash)
+	if !ok || sr.seeders != 0 {
+		t.Fatalf("scrape after sharing again: %+v, %v", sr, ok)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	tr := New(time.Minute)
+	query := url.Values{
+		"info_hash": {string(testHash[:])},
+		"peer_id":   {"-SS0001-000000000000"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+
+	announce := func() string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/announce?"+query.Encode(), nil)
+		tr.HandleAnnounce(w, r)
+		return w.Body.String()
+	}
+
+	if body := announce(); !strings.Contains(body, "failure reason") {
+		t.Fatalf("announce of unshared info hash: %q", body)
+	}
+	tr.Allow("ROOM1", testHash)
+	if body := announce(); strings.Contains(body, "failure reason") || !strings.Contains(body, "8:intervali60e") {
+		t.Fatalf("announce of shared info hash: %q", body)
+	}
+	tr.RevokeRoom("ROOM1")
+	if body := announce(); !strings.Contains(body, "failure reason") {
+		t.Fatalf("announce after revoke: %q", body)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tr := New(time.Minute)
+	tr.TrustProxies(netip.MustParsePrefix("127.0.0.1/32"), netip.MustParsePrefix("10.0.0.0/8"))
+
+	tests := []struct {
+		name   string
+		remote string
+		cf     string
+		xff    string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"untrusted cf header", "192.0.2.1:1234", "198.51.100.7", "", "192.0.2.1"},
+		{"untrusted xff header", "192.0.2.1:1234", "", "198.51.100.7", "192.0.2.1"},
+		{"trusted cf header", "127.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"trusted xff header", "10.1.2.3:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"spoofed first xff hop", "10.1.2.3:1234", "", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"chained proxies", "10.1.2.3:1234", "", "198.51.100.7, 10.4.5.6", "198.51.100.7"},
+		{"trusted without headers", "127.0.0.1:1234", "", "", "127.0.0.1"},
+		{"ipv6", "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/announce", nil)
+			r.RemoteAddr = tt.remote
+			if tt.cf != "" {
+				r.Header.Set("CF-Connecting-IP", tt.cf)
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := tr.clientIP(r); !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// BEP 15 constants.
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// Connection IDs are valid for two minutes; the window below issues IDs
+	// per minute and accepts the current and previous one.
+	udpConnIDWindow = time.Minute
+
+	udpMaxScrape = 74
+)
+
+var udpEvents = [...]string{"", "completed", "started", "stopped"}
+
+// ServeUDP answers UDP tracker requests on conn until it is closed.
+func (t *Tracker) ServeUDP(conn net.PacketConn) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		if resp := t.handleUDP(secret, buf[:n], udpAddr); resp != nil {
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Printf("[tracker] UDP write to %s failed: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (t *Tracker) handleUDP(secret, req []byte, addr *net.UDPAddr) []byte {
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	txID := req[12:16]
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		resp := udpHeader(udpActionConnect, txID)
+		return binary.BigEndian.AppendUint64(resp, udpConnectionID(secret, addr, time.Now()))
+	}
+
+	if !validUDPConnectionID(secret, addr, connID) {
+		return udpError(txID, "invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return t.handleUDPAnnounce(req, addr, txID)
+	case udpActionScrape:
+		return t.handleUDPScrape(req, txID)
+	default:
+		return udpError(txID, "unknown action")
+	}
+}
+
+func (t *Tracker) handleUDPAnnounce(req []byte, addr *net.UDPAddr, txID []byte) []byte {
+	if len(req) < 98 {
+		return udpError(txID, "short announce")
+	}
+
+	a := announce{
+		peerID:  string(req[36:56]),
+		ip:      addr.IP,
+		left:    int64(binary.BigEndian.Uint64(req[64:72])),
+		numWant: int(int32(binary.BigEndian.Uint32(req[92:96]))),
+		port:    binary.BigEndian.Uint16(req[96:98]),
+	}
+	copy(a.infoHash[:], req[16:36])
+	if ev := binary.BigEndian.Uint32(req[80:84]); int(ev) < len(udpEvents) {
+		a.event = udpEvents[ev]
+	}
+
+	res, err := t.announce(a)
+	if err != nil {
+		return udpError(txID, err.Error())
+	}
+
+	resp := udpHeader(udpActionAnnounce, txID)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(t.interval/time.Second))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.leechers))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.seeders))
+
+	// BEP 15 returns peers of the requester's address family only.
+	wantV4 := addr.IP.To4() != nil
+	for _, p := range res.peers {
+		ip4 := p.ip.To4()
+		switch {
+		case wantV4 && ip4 != nil:
+			resp = append(resp, ip4...)
+		case !wantV4 && ip4 == nil:
+			resp = append(resp, p.ip.To16()...)
+		default:
+			continue
+		}
+		resp = binary.BigEndian.AppendUint16(resp, p.port)
+	}
+	return resp
+}
+
+func (t *Tracker) handleUDPScrape(req []byte, txID []byte) []byte {
+	hashes := req[16:]
+	resp := udpHeader(udpActionScrape, txID)
+	for i := 0; i+20 <= len(hashes) && i/20 < udpMaxScrape; i += 20 {
+		var ih InfoHash
+		copy(ih[:], hashes[i:i+20])
+		res, _ := t.scrape(ih)
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.seeders))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.completed))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.leechers))
+	}
+	return resp
+}
+
+func udpHeader(action uint32, txID []byte) []byte {
+	resp := binary.BigEndian.AppendUint32(make([]byte, 0, 64), action)
+	return append(resp, txID...)
+}
+
+func udpError(txID []byte, msg string) []byte {
+	return append(udpHeader(udpActionError, txID), msg...)
+}
+
+// udpConnectionID derives a connection ID from the client address and the
+// current time window, so no per-client state has to be kept.
+func udpConnectionID(secret []byte, addr *net.UDPAddr, now time.Time) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(addr.IP.To16())
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(addr.Port)))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(now.Unix()/int64(udpConnIDWindow/time.Second))))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func validUDPConnectionID(secret []byte, addr *net.UDPAddr, connID uint64) bool {
+	now := time.Now()
+	return connID == udpConnectionID(secret, addr, now) ||
+		connID == udpConnectionID(secret, addr, now.Add(-udpConnIDWindow))
+}
@@ -17,20 +17,32 @@ type Credentials struct {
 	URLs     []string `json:"urls"`
 }
 
+// DefaultTTL is how long generated credentials are valid for unless
+// SetTTL says otherwise.
+const DefaultTTL = 24 * time.Hour
+
 type Generator struct {
 	staticURL  string
 	staticUser string
 	staticPass string
 	secretKey  []byte
+	ttl        time.Duration
 }
 
 func New() *Generator {
 	secret := uuid.Must(uuid.NewV4()).String()
 	return &Generator{
 		secretKey: []byte(secret),
+		ttl:       DefaultTTL,
 	}
 }
 
+// SetTTL sets how long generated credentials are valid for, rounded down
+// to whole seconds; at least a second.
+func (g *Generator) SetTTL(ttl time.Duration) {
+	g.ttl = max(ttl.Truncate(time.Second), time.Second)
+}
+
 func (g *Generator) SetStaticTURN(url, username, password string) {
 	g.staticURL = url
 	g.staticUser = username
@@ -42,7 +54,7 @@ func (g *Generator) GenerateCredentials(username, password string) Credentials {
 		return Credentials{
 			Username: g.staticUser,
 			Password: g.staticPass,
-			TTL:      86400,
+			TTL:      int64(g.ttl / time.Second),
 			URLs:     []string{g.staticURL},
 		}
 	}
@@ -58,7 +70,7 @@ func (g *Generator) GenerateCredentials(username, password string) Credentials {
 
 func (g *Generator) generateTOTPCredentials(username string) Credentials {
 	now := time.Now()
-	ttl := int64(86400)
+	ttl := int64(g.ttl / time.Second)
 
 	expiry := now.Unix() + ttl
 	username = fmt.Sprintf("%d:%s", expiry, username)
@@ -83,7 +95,7 @@ func (g *Generator) generatePassword(username string, t time.Time) string {
 
 func (g *Generator) GenerateCloudflareCredentials(username string) Credentials {
 	now := time.Now()
-	expiry := now.Add(24 * time.Hour).Unix()
+	expiry := now.Add(g.ttl).Unix()
 
 	username = fmt.Sprintf("%d:%s", expiry, username)
 
@@ -96,7 +108,7 @@ func (g *Generator) GenerateCloudflareCredentials(username string) Credentials {
 	return Credentials{
 		Username: username,
 		Password: password,
-		TTL:      86400,
+		TTL:      int64(g.ttl / time.Second),
 		URLs:     []string{g.staticURL},
 	}
 }